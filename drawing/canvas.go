@@ -0,0 +1,211 @@
+// Package drawing turns the drawings of lobbies, which only exist as the line
+// and fill packets sent by the drawer, into images. Drawings are rendered
+// the way the official client renders them, at the base size of the drawing
+// board.
+package drawing
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// Background is the color of an empty drawing board.
+var Background = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+// fillTolerance is the tolerance the client passes to the flood fill.
+const fillTolerance = 1
+
+// Canvas is a drawing board that draw operations can be applied to one by
+// one.
+type Canvas struct {
+	image *image.RGBA
+}
+
+// NewCanvas creates an empty canvas of the drawing boards base size.
+func NewCanvas() *Canvas {
+	canvas := &Canvas{image: image.NewRGBA(image.Rect(0, 0, game.DrawingBoardBaseWidth, game.DrawingBoardBaseHeight))}
+	canvas.Clear()
+	return canvas
+}
+
+// Render replays the draw operations onto an empty canvas and returns the
+// result.
+func Render(ops []*game.Packet) *image.RGBA {
+	canvas := NewCanvas()
+	for _, op := range ops {
+		canvas.Apply(op)
+	}
+	return canvas.Image()
+}
+
+// EncodePNG renders the draw operations and writes them as PNG.
+func EncodePNG(w io.Writer, ops []*game.Packet) error {
+	return png.Encode(w, Render(ops))
+}
+
+// Image returns the current state of the canvas. It is not a copy, applying
+// further operations changes it.
+func (c *Canvas) Image() *image.RGBA {
+	return c.image
+}
+
+// Clear paints the whole canvas in the background color.
+func (c *Canvas) Clear() {
+	pixels := c.image.Pix
+	for i := 0; i < len(pixels); i += 4 {
+		pixels[i], pixels[i+1], pixels[i+2], pixels[i+3] = Background.R, Background.G, Background.B, Background.A
+	}
+}
+
+// Apply draws a line or fill packet. Packets of other types, or ones that
+// can't be decoded, are ignored, as the client ignores them as well.
+func (c *Canvas) Apply(op *game.Packet) {
+	switch op.Type {
+	case game.PacketLine:
+		line := &game.Line{}
+		if json.Unmarshal(op.Data, line) == nil {
+			c.Line(line)
+		}
+	case game.PacketFill:
+		fill := &game.Fill{}
+		if json.Unmarshal(op.Data, fill) == nil {
+			c.Fill(fill)
+		}
+	}
+}
+
+// Line draws a line with round caps. Like the client, the coordinates are
+// rounded down and the width is rounded up.
+func (c *Canvas) Line(line *game.Line) {
+	lineColor, err := ParseColor(line.Color)
+	if err != nil {
+		return
+	}
+
+	x1, y1 := math.Floor(line.FromX), math.Floor(line.FromY)
+	x2, y2 := math.Floor(line.ToX), math.Floor(line.ToY)
+	radius := math.Ceil(line.LineWidth) / 2
+	if !(radius > 0) {
+		return
+	}
+
+	bounds := c.image.Bounds().Intersect(image.Rect(
+		int(math.Floor(math.Min(x1, x2)-radius)),
+		int(math.Floor(math.Min(y1, y2)-radius)),
+		int(math.Ceil(math.Max(x1, x2)+radius))+1,
+		int(math.Ceil(math.Max(y1, y2)+radius))+1,
+	))
+
+	// Every pixel whose center is within the radius of the segment is part
+	// of the line, which results in the round caps.
+	dx, dy := x2-x1, y2-y1
+	lengthSquared := dx*dx + dy*dy
+	radiusSquared := radius * radius
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			t := 0.0
+			if lengthSquared > 0 {
+				t = math.Max(0, math.Min(1, ((px-x1)*dx+(py-y1)*dy)/lengthSquared))
+			}
+			distX, distY := px-(x1+t*dx), py-(y1+t*dy)
+			if distX*distX+distY*distY <= radiusSquared {
+				c.image.SetRGBA(x, y, lineColor)
+			}
+		}
+	}
+}
+
+// Fill flood fills the area of the same color around the given point, just
+// like resources/floodfill.js does with the tolerance used by the client.
+func (c *Canvas) Fill(fill *game.Fill) {
+	c.floodFill(fill)
+}
+
+// span is a part of a row of pixels, including left and right.
+type span struct {
+	y, left, right int
+}
+
+// floodFill fills like Fill does and returns the filled parts of the rows.
+func (c *Canvas) floodFill(fill *game.Fill) []span {
+	fillColor, err := ParseColor(fill.Color)
+	if err != nil {
+		return nil
+	}
+
+	x, y := int(math.Floor(fill.X)), int(math.Floor(fill.Y))
+	if !(image.Point{X: x, Y: y}).In(c.image.Bounds()) {
+		return nil
+	}
+	target := c.image.RGBAAt(x, y)
+	if matches(target, fillColor) {
+		return nil
+	}
+
+	bounds := c.image.Bounds()
+	filled := []span{}
+	stack := []image.Point{{X: x, Y: y}}
+	for len(stack) > 0 {
+		point := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !matches(c.image.RGBAAt(point.X, point.Y), target) {
+			continue
+		}
+
+		// Fill the whole row the point is part of, then look at the rows
+		// above and below.
+		left, right := point.X, point.X
+		for left > bounds.Min.X && matches(c.image.RGBAAt(left-1, point.Y), target) {
+			left--
+		}
+		for right < bounds.Max.X-1 && matches(c.image.RGBAAt(right+1, point.Y), target) {
+			right++
+		}
+		filled = append(filled, span{y: point.Y, left: left, right: right})
+		for column := left; column <= right; column++ {
+			c.image.SetRGBA(column, point.Y, fillColor)
+			if point.Y > bounds.Min.Y && matches(c.image.RGBAAt(column, point.Y-1), target) {
+				stack = append(stack, image.Point{X: column, Y: point.Y - 1})
+			}
+			if point.Y < bounds.Max.Y-1 && matches(c.image.RGBAAt(column, point.Y+1), target) {
+				stack = append(stack, image.Point{X: column, Y: point.Y + 1})
+			}
+		}
+	}
+	return filled
+}
+
+func matches(a, b color.RGBA) bool {
+	return within(a.R, b.R) && within(a.G, b.G) && within(a.B, b.B) && within(a.A, b.A)
+}
+
+func within(a, b uint8) bool {
+	if a > b {
+		return a-b <= fillTolerance
+	}
+	return b-a <= fillTolerance
+}
+
+// ParseColor parses the colors accepted from clients, #rgb and #rrggbb.
+func ParseColor(value string) (color.RGBA, error) {
+	if len(value) == 4 && value[0] == '#' {
+		value = string([]byte{'#', value[1], value[1], value[2], value[2], value[3], value[3]})
+	}
+	if len(value) != 7 || value[0] != '#' {
+		return color.RGBA{}, fmt.Errorf("unsupported color %q", value)
+	}
+	rgb, err := strconv.ParseUint(value[1:], 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("unsupported color %q", value)
+	}
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}, nil
+}
@@ -0,0 +1,115 @@
+package drawing
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	black = color.RGBA{A: 0xff}
+	red   = color.RGBA{R: 0xff, A: 0xff}
+)
+
+func linePacket(t *testing.T, line game.Line) *game.Packet {
+	data, err := json.Marshal(line)
+	require.Nil(t, err)
+	return &game.Packet{Type: game.PacketLine, Data: data}
+}
+
+func fillPacket(t *testing.T, fill game.Fill) *game.Packet {
+	data, err := json.Marshal(fill)
+	require.Nil(t, err)
+	return &game.Packet{Type: game.PacketFill, Data: data}
+}
+
+func TestLinesHaveRoundCaps(t *testing.T) {
+	canvas := NewCanvas()
+	canvas.Line(&game.Line{FromX: 100, FromY: 100, ToX: 200, ToY: 100, Color: "#000000", LineWidth: 20})
+	image := canvas.Image()
+
+	require.Equal(t, black, image.RGBAAt(150, 100))
+	require.Equal(t, black, image.RGBAAt(150, 109))
+	require.Equal(t, Background, image.RGBAAt(150, 111))
+	// The caps extend the line by half its width ...
+	require.Equal(t, black, image.RGBAAt(91, 100))
+	require.Equal(t, black, image.RGBAAt(208, 100))
+	require.Equal(t, Background, image.RGBAAt(211, 100))
+	// ... but are round.
+	require.Equal(t, Background, image.RGBAAt(91, 91))
+	require.Equal(t, Background, image.RGBAAt(209, 109))
+}
+
+func TestLinesOutsideOfTheBoardAreClipped(t *testing.T) {
+	canvas := NewCanvas()
+	canvas.Line(&game.Line{FromX: -50, FromY: -50, ToX: 5000, ToY: 5000, Color: "#f00", LineWidth: 5})
+	require.Equal(t, red, canvas.Image().RGBAAt(10, 10))
+}
+
+func TestFillStopsAtLines(t *testing.T) {
+	// A closed square with a red inside.
+	ops := []*game.Packet{
+		linePacket(t, game.Line{FromX: 100, FromY: 100, ToX: 300, ToY: 100, Color: "#000000", LineWidth: 4}),
+		linePacket(t, game.Line{FromX: 300, FromY: 100, ToX: 300, ToY: 300, Color: "#000000", LineWidth: 4}),
+		linePacket(t, game.Line{FromX: 300, FromY: 300, ToX: 100, ToY: 300, Color: "#000000", LineWidth: 4}),
+		linePacket(t, game.Line{FromX: 100, FromY: 300, ToX: 100, ToY: 100, Color: "#000000", LineWidth: 4}),
+		fillPacket(t, game.Fill{X: 200, Y: 200, Color: "#ff0000"}),
+		{Type: game.PacketUndo},
+		{Type: game.PacketLine, Data: []byte(`"broken"`)},
+	}
+	image := Render(ops)
+
+	require.Equal(t, game.DrawingBoardBaseWidth, image.Bounds().Dx())
+	require.Equal(t, game.DrawingBoardBaseHeight, image.Bounds().Dy())
+	require.Equal(t, red, image.RGBAAt(200, 200))
+	require.Equal(t, red, image.RGBAAt(103, 103))
+	require.Equal(t, black, image.RGBAAt(100, 200))
+	require.Equal(t, Background, image.RGBAAt(50, 50))
+	require.Equal(t, Background, image.RGBAAt(400, 200))
+
+	// Filling the outside leaves the inside alone.
+	canvas := NewCanvas()
+	for _, op := range ops {
+		canvas.Apply(op)
+	}
+	canvas.Fill(&game.Fill{X: 0, Y: 0, Color: "#000000"})
+	require.Equal(t, black, canvas.Image().RGBAAt(1500, 800))
+	require.Equal(t, red, canvas.Image().RGBAAt(200, 200))
+
+	// Filling with the color that is already there changes nothing.
+	canvas.Fill(&game.Fill{X: 200, Y: 200, Color: "#ff0000"})
+	require.Equal(t, red, canvas.Image().RGBAAt(200, 200))
+}
+
+func TestEncodePNG(t *testing.T) {
+	var buffer bytes.Buffer
+	require.Nil(t, EncodePNG(&buffer, []*game.Packet{
+		fillPacket(t, game.Fill{X: 1, Y: 1, Color: "#ff0000"}),
+	}))
+
+	image, err := png.Decode(&buffer)
+	require.Nil(t, err)
+	require.Equal(t, game.DrawingBoardBaseWidth, image.Bounds().Dx())
+	r, g, b, _ := image.At(800, 450).RGBA()
+	require.Equal(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b})
+}
+
+func TestParseColor(t *testing.T) {
+	parsed, err := ParseColor("#0a0B0c")
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{R: 0x0a, G: 0x0b, B: 0x0c, A: 0xff}, parsed)
+
+	parsed, err = ParseColor("#fa0")
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{R: 0xff, G: 0xaa, B: 0x00, A: 0xff}, parsed)
+
+	for _, invalid := range []string{"", "red", "#12345", "#gggggg", "rgb(0,0,0)"} {
+		_, err := ParseColor(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
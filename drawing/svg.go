@@ -0,0 +1,173 @@
+package drawing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// SVGEncoder writes drawings as SVG. Lines become paths, one group per
+// gesture, so the result can be scaled to any size, for example for
+// printing. Fills can't be expressed as vectors, as their shape depends on
+// the pixels around them. They are rendered and embedded as images covering
+// only the filled area.
+type SVGEncoder struct {
+	// Precision is the number of decimal places of coordinates.
+	Precision int
+}
+
+// EncodeSVG writes the drawing as SVG using the default settings.
+func EncodeSVG(w io.Writer, ops []*game.Packet) error {
+	return (&SVGEncoder{Precision: 1}).Encode(w, ops)
+}
+
+// Encode writes the drawing made of the given draw operations as SVG.
+func (e *SVGEncoder) Encode(w io.Writer, ops []*game.Packet) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		game.DrawingBoardBaseWidth, game.DrawingBoardBaseHeight, game.DrawingBoardBaseWidth, game.DrawingBoardBaseHeight)
+	fmt.Fprintf(out, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", hexColor(Background))
+
+	// The fills depend on everything drawn before them, so the drawing is
+	// rendered along the way.
+	canvas := NewCanvas()
+	gesture := &svgGesture{encoder: e}
+	for _, op := range ops {
+		switch op.Type {
+		case game.PacketLine:
+			line := &game.Line{}
+			if json.Unmarshal(op.Data, line) != nil {
+				continue
+			}
+			canvas.Line(line)
+			if gesture.started && gesture.id != line.GestureID {
+				gesture.end(out)
+			}
+			gesture.add(out, line)
+		case game.PacketFill:
+			fill := &game.Fill{}
+			if json.Unmarshal(op.Data, fill) != nil {
+				continue
+			}
+			gesture.end(out)
+			if err := e.writeFill(out, fill, canvas.floodFill(fill)); err != nil {
+				return err
+			}
+		}
+	}
+	gesture.end(out)
+
+	fmt.Fprint(out, "</svg>\n")
+	return out.Flush()
+}
+
+// svgGesture writes the lines of a gesture as a group of paths. A new path
+// is started whenever color or width change.
+type svgGesture struct {
+	encoder *SVGEncoder
+	started bool
+	id      int
+
+	pathOpen bool
+	color    string
+	width    float64
+	// The end of the latest line, lines starting there continue the path.
+	x, y float64
+}
+
+func (g *svgGesture) add(out *bufio.Writer, line *game.Line) {
+	lineColor, err := ParseColor(line.Color)
+	if err != nil || !(line.LineWidth > 0) {
+		return
+	}
+
+	if !g.started {
+		fmt.Fprintf(out, `<g data-gesture="%d" fill="none" stroke-linecap="round" stroke-linejoin="round">`+"\n", line.GestureID)
+		g.started = true
+		g.id = line.GestureID
+	}
+	if g.pathOpen && (g.color != hexColor(lineColor) || g.width != line.LineWidth) {
+		g.closePath(out)
+	}
+	if !g.pathOpen {
+		g.color = hexColor(lineColor)
+		g.width = line.LineWidth
+		fmt.Fprintf(out, `<path stroke="%s" stroke-width="%s" d="`, g.color, g.encoder.number(g.width))
+		g.pathOpen = true
+		g.moveTo(out, line.FromX, line.FromY)
+	} else if line.FromX != g.x || line.FromY != g.y {
+		out.WriteByte(' ')
+		g.moveTo(out, line.FromX, line.FromY)
+	}
+	fmt.Fprintf(out, " L%s %s", g.encoder.number(line.ToX), g.encoder.number(line.ToY))
+	g.x, g.y = line.ToX, line.ToY
+}
+
+func (g *svgGesture) moveTo(out *bufio.Writer, x, y float64) {
+	fmt.Fprintf(out, "M%s %s", g.encoder.number(x), g.encoder.number(y))
+}
+
+func (g *svgGesture) closePath(out *bufio.Writer) {
+	out.WriteString(`"/>` + "\n")
+	g.pathOpen = false
+}
+
+func (g *svgGesture) end(out *bufio.Writer) {
+	if g.pathOpen {
+		g.closePath(out)
+	}
+	if g.started {
+		out.WriteString("</g>\n")
+	}
+	g.started = false
+}
+
+// writeFill embeds the filled area as an image, transparent wherever the
+// fill didn't reach.
+func (e *SVGEncoder) writeFill(out *bufio.Writer, fill *game.Fill, filled []span) error {
+	if len(filled) == 0 {
+		return nil
+	}
+	fillColor, err := ParseColor(fill.Color)
+	if err != nil {
+		return nil
+	}
+
+	bounds := image.Rect(filled[0].left, filled[0].y, filled[0].right+1, filled[0].y+1)
+	for _, row := range filled[1:] {
+		bounds = bounds.Union(image.Rect(row.left, row.y, row.right+1, row.y+1))
+	}
+	patch := image.NewPaletted(bounds, color.Palette{color.Transparent, fillColor})
+	for _, row := range filled {
+		for x := row.left; x <= row.right; x++ {
+			patch.SetColorIndex(x, row.y, 1)
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, patch); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, `<image x="%d" y="%d" width="%d" height="%d" xlink:href="data:image/png;base64,%s"/>`+"\n",
+		bounds.Min.X, bounds.Min.Y, bounds.Dx(), bounds.Dy(), base64.StdEncoding.EncodeToString(encoded.Bytes()))
+	return nil
+}
+
+func (e *SVGEncoder) number(value float64) string {
+	scale := math.Pow(10, float64(e.Precision))
+	return strconv.FormatFloat(math.Round(value*scale)/scale, 'f', -1, 64)
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,80 @@
+package drawing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/stretchr/testify/require"
+)
+
+type svgDocument struct {
+	Groups []struct {
+		Gesture string `xml:"data-gesture,attr"`
+		Paths   []struct {
+			Stroke string `xml:"stroke,attr"`
+			Width  string `xml:"stroke-width,attr"`
+			D      string `xml:"d,attr"`
+		} `xml:"path"`
+	} `xml:"g"`
+	Images []struct {
+		X      int    `xml:"x,attr"`
+		Y      int    `xml:"y,attr"`
+		Width  int    `xml:"width,attr"`
+		Height int    `xml:"height,attr"`
+		Href   string `xml:"href,attr"`
+	} `xml:"image"`
+}
+
+func TestEncodeSVG(t *testing.T) {
+	ops := []*game.Packet{
+		// The first gesture is a square, its last side changes color.
+		linePacket(t, game.Line{FromX: 100, FromY: 100, ToX: 300, ToY: 100, Color: "#000000", LineWidth: 4, GestureID: 1}),
+		linePacket(t, game.Line{FromX: 300, FromY: 100, ToX: 300, ToY: 300, Color: "#000000", LineWidth: 4, GestureID: 1}),
+		linePacket(t, game.Line{FromX: 300, FromY: 300, ToX: 100.25, ToY: 300, Color: "#000000", LineWidth: 4, GestureID: 1}),
+		linePacket(t, game.Line{FromX: 100.25, FromY: 300, ToX: 100, ToY: 100, Color: "#f00", LineWidth: 4, GestureID: 1}),
+		fillPacket(t, game.Fill{X: 200, Y: 200, Color: "#00ff00"}),
+		linePacket(t, game.Line{FromX: 500, FromY: 500, ToX: 600, ToY: 600, Color: "#0000ff", LineWidth: 20, GestureID: 2}),
+		linePacket(t, game.Line{FromX: 700, FromY: 500, ToX: 800, ToY: 600, Color: "#0000ff", LineWidth: 20, GestureID: 2}),
+		{Type: game.PacketUndo},
+	}
+
+	var buffer bytes.Buffer
+	require.Nil(t, EncodeSVG(&buffer, ops))
+	require.True(t, strings.HasPrefix(buffer.String(), "<svg "))
+
+	document := &svgDocument{}
+	require.Nil(t, xml.Unmarshal(buffer.Bytes(), document))
+
+	require.Len(t, document.Groups, 2)
+	first := document.Groups[0]
+	require.Equal(t, "1", first.Gesture)
+	require.Len(t, first.Paths, 2)
+	require.Equal(t, "#000000", first.Paths[0].Stroke)
+	require.Equal(t, "4", first.Paths[0].Width)
+	require.Equal(t, "M100 100 L300 100 L300 300 L100.3 300", first.Paths[0].D)
+	require.Equal(t, "#ff0000", first.Paths[1].Stroke)
+
+	second := document.Groups[1]
+	require.Equal(t, "2", second.Gesture)
+	require.Len(t, second.Paths, 1)
+	require.Equal(t, "M500 500 L600 600 M700 500 L800 600", second.Paths[0].D)
+
+	// The fill covers the inside of the square only.
+	require.Len(t, document.Images, 1)
+	patch := document.Images[0]
+	require.True(t, patch.X > 100 && patch.X < 110, patch.X)
+	require.True(t, patch.Width > 180 && patch.Width < 200, patch.Width)
+	require.True(t, strings.HasPrefix(patch.Href, "data:image/png;base64,"))
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(patch.Href, "data:image/png;base64,"))
+	require.Nil(t, err)
+	image, err := png.Decode(bytes.NewReader(data))
+	require.Nil(t, err)
+	require.Equal(t, patch.Width, image.Bounds().Dx())
+	_, g, _, a := image.At(patch.Width/2, patch.Height/2).RGBA()
+	require.Equal(t, []uint32{0xffff, 0xffff}, []uint32{g, a})
+}
@@ -0,0 +1,330 @@
+package drawing
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// timelapseHold is how long the finished drawing is shown at the end of a
+// timelapse, before it starts over.
+const timelapseHold = 3 * time.Second
+
+// Timelapse renders the draw log of a turn as animated GIF, showing how the
+// drawing came together. Turns that took longer than Length are sped up,
+// shorter ones are shown in real time.
+type Timelapse struct {
+	// FrameRate is the number of frames per second.
+	FrameRate int
+	// Length is the longest the animation may take, not counting the time
+	// the finished drawing is shown.
+	Length time.Duration
+	// Width of the animation, the height follows from the aspect ratio of
+	// the drawing board. Zero means the base size.
+	Width int
+}
+
+// Encode writes the timelapse of the given draw log as GIF.
+func (t *Timelapse) Encode(w io.Writer, ops []*game.TimedDrawOp) error {
+	frameRate := t.FrameRate
+	if frameRate < 1 {
+		frameRate = 1
+	} else if frameRate > 100 {
+		// GIF delays are given in hundredths of a second.
+		frameRate = 100
+	}
+	delay := int(math.Round(100 / float64(frameRate)))
+
+	width := t.Width
+	if width <= 0 || width > game.DrawingBoardBaseWidth {
+		width = game.DrawingBoardBaseWidth
+	}
+	height := width * game.DrawingBoardBaseHeight / game.DrawingBoardBaseWidth
+
+	// Every frame is a point in time of the turn, at most as many as fit
+	// into the length of the animation.
+	var start, end float64
+	if len(ops) > 0 {
+		start, end = float64(ops[0].Time), float64(ops[len(ops)-1].Time)
+	}
+	step := 1000 / float64(frameRate)
+	maxFrames := int(t.Length * time.Duration(frameRate) / time.Second)
+	if maxFrames > 1 && (end-start)/step > float64(maxFrames-1) {
+		step = (end - start) / float64(maxFrames-1)
+	}
+
+	encoder := &gifEncoder{
+		palette:   timelapsePalette(ops),
+		indices:   map[color.RGBA]uint8{},
+		bounds:    image.Rect(0, 0, width, height),
+		animation: &gif.GIF{Config: image.Config{Width: width, Height: height}},
+	}
+	encoder.animation.Config.ColorModel = encoder.palette
+
+	replay := &timelapseReplay{canvas: NewCanvas()}
+	next := 0
+	for frame := 0; ; frame++ {
+		at := start + float64(frame)*step
+		for next < len(ops) && float64(ops[next].Time) <= at {
+			replay.apply(ops[next].Op)
+			next++
+		}
+		encoder.addFrame(replay.render(), delay)
+		if next == len(ops) {
+			break
+		}
+	}
+	encoder.hold(int(timelapseHold / (10 * time.Millisecond)))
+
+	return gif.EncodeAll(w, encoder.animation)
+}
+
+// TimelapseCache keeps the encoded timelapses of finished turns, which don't
+// change anymore, so that every turn is rendered only once. It also limits
+// how many timelapses are rendered at the same time, as rendering is
+// expensive.
+type TimelapseCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[*game.Turn]*cachedTimelapse
+	// order holds the cached turns from the oldest to the newest.
+	order   []*game.Turn
+	renders chan struct{}
+}
+
+// cachedTimelapse is a timelapse that is done once done is closed.
+type cachedTimelapse struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewTimelapseCache creates a cache keeping the timelapses of up to size
+// turns, rendering at most renders of them at once.
+func NewTimelapseCache(size, renders int) *TimelapseCache {
+	if size < 1 {
+		size = 1
+	}
+	if renders < 1 {
+		renders = 1
+	}
+	return &TimelapseCache{
+		size:    size,
+		entries: map[*game.Turn]*cachedTimelapse{},
+		renders: make(chan struct{}, renders),
+	}
+}
+
+// Get returns the timelapse of the finished turn as GIF, rendering it unless
+// it is cached. Concurrent requests for the same turn share one rendering.
+func (c *TimelapseCache) Get(turn *game.Turn, timelapse *Timelapse) ([]byte, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[turn]
+	if !ok {
+		entry = &cachedTimelapse{done: make(chan struct{})}
+		c.entries[turn] = entry
+		c.order = append(c.order, turn)
+		if len(c.order) > c.size {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.data, entry.err
+	}
+
+	c.renders <- struct{}{}
+	var buffer bytes.Buffer
+	entry.err = timelapse.Encode(&buffer, turn.Ops)
+	entry.data = buffer.Bytes()
+	<-c.renders
+	close(entry.done)
+
+	// Failures aren't kept, so that the next request tries again.
+	if entry.err != nil {
+		c.forget(turn, entry)
+	}
+	return entry.data, entry.err
+}
+
+// forget removes the entry of the turn, unless it has been replaced.
+func (c *TimelapseCache) forget(turn *game.Turn, entry *cachedTimelapse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[turn] != entry {
+		return
+	}
+	delete(c.entries, turn)
+	for i, cached := range c.order {
+		if cached == turn {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// timelapseReplay applies a draw log to a canvas. As undos can't be applied
+// to pixels, the visible operations are kept and redrawn from scratch
+// whenever some have been removed.
+type timelapseReplay struct {
+	canvas  *Canvas
+	visible []*game.Packet
+	// applied is the number of visible operations already on the canvas.
+	applied int
+	redraw  bool
+}
+
+func (r *timelapseReplay) apply(op *game.Packet) {
+	switch op.Type {
+	case game.PacketLine, game.PacketFill:
+		r.visible = append(r.visible, op)
+	case game.PacketUndo:
+		// The log has every segment of a line, even if the stored drawing
+		// has fewer, so the count of the undo might not match.
+		if len(r.visible) == 0 {
+			return
+		}
+		r.visible = r.visible[:game.LastGestureStart(r.visible)]
+		r.redraw = true
+	case game.PacketClearDrawingBoard:
+		r.visible = nil
+		r.redraw = true
+	}
+}
+
+func (r *timelapseReplay) render() *image.RGBA {
+	if r.redraw {
+		r.canvas.Clear()
+		r.applied = 0
+		r.redraw = false
+	}
+	for ; r.applied < len(r.visible); r.applied++ {
+		r.canvas.Apply(r.visible[r.applied])
+	}
+	return r.canvas.Image()
+}
+
+// gifEncoder collects the frames of an animation. Each frame only contains
+// the area that changed since the previous one, which keeps the GIF small,
+// as most frames only add a few lines.
+type gifEncoder struct {
+	palette   color.Palette
+	indices   map[color.RGBA]uint8
+	bounds    image.Rectangle
+	animation *gif.GIF
+	previous  *image.Paletted
+}
+
+func (e *gifEncoder) addFrame(source *image.RGBA, delay int) {
+	frame := image.NewPaletted(e.bounds, e.palette)
+	sourceBounds := source.Bounds()
+	// Neighbouring pixels mostly have the same color, which saves looking
+	// them up.
+	var last color.RGBA
+	lastIndex := e.index(last)
+	for y := 0; y < e.bounds.Dy(); y++ {
+		sourceY := y * sourceBounds.Dy() / e.bounds.Dy()
+		for x := 0; x < e.bounds.Dx(); x++ {
+			sourceX := x * sourceBounds.Dx() / e.bounds.Dx()
+			offset := source.PixOffset(sourceX, sourceY)
+			pixel := color.RGBA{R: source.Pix[offset], G: source.Pix[offset+1], B: source.Pix[offset+2], A: source.Pix[offset+3]}
+			if pixel != last {
+				last, lastIndex = pixel, e.index(pixel)
+			}
+			frame.Pix[frame.PixOffset(x, y)] = lastIndex
+		}
+	}
+
+	changed := e.bounds
+	if e.previous != nil {
+		changed = changedArea(e.previous, frame)
+	}
+	e.previous = frame
+	if changed.Empty() {
+		// Nothing happened, the previous frame is shown for longer.
+		e.hold(delay)
+		return
+	}
+
+	patch := image.NewPaletted(changed, e.palette)
+	for y := changed.Min.Y; y < changed.Max.Y; y++ {
+		copy(patch.Pix[patch.PixOffset(changed.Min.X, y):patch.PixOffset(changed.Max.X, y)],
+			frame.Pix[frame.PixOffset(changed.Min.X, y):frame.PixOffset(changed.Max.X, y)])
+	}
+	e.animation.Image = append(e.animation.Image, patch)
+	e.animation.Delay = append(e.animation.Delay, delay)
+	e.animation.Disposal = append(e.animation.Disposal, gif.DisposalNone)
+}
+
+// hold shows the latest frame for the given number of hundredths of a
+// second longer.
+func (e *gifEncoder) hold(delay int) {
+	if last := len(e.animation.Delay) - 1; last >= 0 {
+		e.animation.Delay[last] += delay
+	}
+}
+
+func (e *gifEncoder) index(c color.RGBA) uint8 {
+	index, ok := e.indices[c]
+	if !ok {
+		index = uint8(e.palette.Index(c))
+		e.indices[c] = index
+	}
+	return index
+}
+
+// changedArea returns the smallest rectangle containing all pixels that
+// differ between the two frames.
+func changedArea(a, b *image.Paletted) image.Rectangle {
+	changed := image.Rectangle{}
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		rowA := a.Pix[a.PixOffset(bounds.Min.X, y):a.PixOffset(bounds.Max.X, y)]
+		rowB := b.Pix[b.PixOffset(bounds.Min.X, y):b.PixOffset(bounds.Max.X, y)]
+		for x := range rowA {
+			if rowA[x] != rowB[x] {
+				changed = changed.Union(image.Rect(bounds.Min.X+x, y, bounds.Min.X+x+1, y+1))
+			}
+		}
+	}
+	return changed
+}
+
+// timelapsePalette contains the background and every color used in the
+// draw log, as drawings don't blend colors. Should there be too many for a
+// GIF, a generic palette is used instead.
+func timelapsePalette(ops []*game.TimedDrawOp) color.Palette {
+	colors := color.Palette{Background}
+	seen := map[color.RGBA]bool{Background: true}
+	for _, op := range ops {
+		var value struct {
+			Color string `json:"color"`
+		}
+		if (op.Op.Type != game.PacketLine && op.Op.Type != game.PacketFill) || json.Unmarshal(op.Op.Data, &value) != nil {
+			continue
+		}
+		parsed, err := ParseColor(value.Color)
+		if err != nil || seen[parsed] {
+			continue
+		}
+		seen[parsed] = true
+		colors = append(colors, parsed)
+		if len(colors) > 256 {
+			return palette.Plan9
+		}
+	}
+	return colors
+}
@@ -0,0 +1,136 @@
+package drawing
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/gif"
+	"testing"
+	"time"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/stretchr/testify/require"
+)
+
+func timed(at int64, op *game.Packet) *game.TimedDrawOp {
+	return &game.TimedDrawOp{Time: at, Op: op}
+}
+
+func undoPacket(t *testing.T, count int) *game.Packet {
+	data, err := json.Marshal(count)
+	require.Nil(t, err)
+	return &game.Packet{Type: game.PacketUndo, Data: data}
+}
+
+func encodeTimelapse(t *testing.T, timelapse *Timelapse, ops []*game.TimedDrawOp) *gif.GIF {
+	var buffer bytes.Buffer
+	require.Nil(t, timelapse.Encode(&buffer, ops))
+	animation, err := gif.DecodeAll(&buffer)
+	require.Nil(t, err)
+	return animation
+}
+
+// lastFrame puts all frames on top of each other, like a viewer does.
+func lastFrame(animation *gif.GIF) *image.RGBA {
+	result := image.NewRGBA(image.Rect(0, 0, animation.Config.Width, animation.Config.Height))
+	for _, frame := range animation.Image {
+		draw.Draw(result, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+	}
+	return result
+}
+
+func totalDelay(animation *gif.GIF) int {
+	total := 0
+	for _, delay := range animation.Delay {
+		total += delay
+	}
+	return total
+}
+
+func TestTimelapseIsRealTimeForShortTurns(t *testing.T) {
+	ops := []*game.TimedDrawOp{
+		timed(0, linePacket(t, game.Line{FromX: 100, FromY: 100, ToX: 300, ToY: 100, Color: "#000000", LineWidth: 10})),
+		timed(500, fillPacket(t, game.Fill{X: 800, Y: 800, Color: "#ff0000"})),
+		timed(1000, linePacket(t, game.Line{FromX: 100, FromY: 500, ToX: 300, ToY: 500, Color: "#000000", LineWidth: 10})),
+	}
+	animation := encodeTimelapse(t, &Timelapse{FrameRate: 10, Length: 10 * time.Second, Width: 800}, ops)
+
+	require.Equal(t, 800, animation.Config.Width)
+	require.Equal(t, 450, animation.Config.Height)
+	// One frame for every change, frames without changes only prolong the
+	// previous one.
+	require.Len(t, animation.Image, 3)
+	require.Equal(t, 110+300, totalDelay(animation))
+	// Only the changed area is part of the frames.
+	require.True(t, animation.Image[2].Bounds().Dy() < 10)
+
+	final := lastFrame(animation)
+	require.Equal(t, black, final.RGBAAt(100, 50))
+	require.Equal(t, red, final.RGBAAt(400, 400))
+	require.Equal(t, black, final.RGBAAt(100, 250))
+}
+
+func TestTimelapseOfLongTurnsIsSpedUp(t *testing.T) {
+	ops := []*game.TimedDrawOp{}
+	for i := int64(0); i < 100; i++ {
+		ops = append(ops, timed(i*1000, linePacket(t, game.Line{
+			FromX: float64(i * 10), FromY: 100, ToX: float64(i*10 + 10), ToY: 100, Color: "#000", LineWidth: 4,
+		})))
+	}
+	animation := encodeTimelapse(t, &Timelapse{FrameRate: 10, Length: 5 * time.Second}, ops)
+
+	require.True(t, len(animation.Image) <= 50)
+	require.True(t, totalDelay(animation) <= 500+300)
+	require.Equal(t, black, lastFrame(animation).RGBAAt(995, 100))
+}
+
+func TestTimelapseShowsUndoAndClear(t *testing.T) {
+	ops := []*game.TimedDrawOp{
+		timed(0, linePacket(t, game.Line{FromX: 100, FromY: 100, ToX: 300, ToY: 100, Color: "#f00", LineWidth: 10})),
+		timed(100, &game.Packet{Type: game.PacketClearDrawingBoard}),
+		timed(200, linePacket(t, game.Line{FromX: 100, FromY: 300, ToX: 300, ToY: 300, Color: "#000", LineWidth: 10, GestureID: 1})),
+		timed(300, linePacket(t, game.Line{FromX: 100, FromY: 500, ToX: 300, ToY: 500, Color: "#000", LineWidth: 10, GestureID: 2})),
+		timed(400, undoPacket(t, 1)),
+	}
+	final := lastFrame(encodeTimelapse(t, &Timelapse{FrameRate: 10, Length: time.Second}, ops))
+
+	require.Equal(t, Background, final.RGBAAt(200, 100))
+	require.Equal(t, black, final.RGBAAt(200, 300))
+	require.Equal(t, Background, final.RGBAAt(200, 500))
+}
+
+func TestTimelapseOfEmptyTurn(t *testing.T) {
+	animation := encodeTimelapse(t, &Timelapse{FrameRate: 10, Length: time.Second}, nil)
+	require.Len(t, animation.Image, 1)
+	require.Equal(t, Background, lastFrame(animation).RGBAAt(800, 450))
+}
+
+func TestTimelapseCache(t *testing.T) {
+	cache := NewTimelapseCache(1, 1)
+	timelapse := &Timelapse{FrameRate: 10, Length: time.Second, Width: 100}
+	first, second := &game.Turn{}, &game.Turn{}
+
+	// Concurrent requests share the rendering.
+	results := make(chan []byte, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			data, _ := cache.Get(first, timelapse)
+			results <- data
+		}()
+	}
+	data := <-results
+	for i := 1; i < cap(results); i++ {
+		require.True(t, &data[0] == &(<-results)[0])
+	}
+	_, err := gif.DecodeAll(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	// Only the latest turn is kept.
+	_, err = cache.Get(second, timelapse)
+	require.Nil(t, err)
+	again, err := cache.Get(first, timelapse)
+	require.Nil(t, err)
+	require.Equal(t, data, again)
+	require.False(t, &data[0] == &again[0])
+}
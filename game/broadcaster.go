@@ -0,0 +1,117 @@
+package game
+
+import (
+	"sync"
+)
+
+// Broadcaster delivers the events of a lobby to its players. Each Lobby is
+// given its Broadcaster on construction, so that lobbies using different
+// transports can coexist in one process.
+type Broadcaster interface {
+	// TriggerSimpleUpdateEvent sends an event without data to all players.
+	TriggerSimpleUpdateEvent(eventType string, lobby *Lobby)
+	// TriggerComplexUpdateEvent sends the same event data to all players.
+	TriggerComplexUpdateEvent(eventType string, data interface{}, lobby *Lobby)
+	// TriggerComplexUpdatePerPlayerEvent sends event data that is
+	// specific to each player.
+	TriggerComplexUpdatePerPlayerEvent(eventType string, data func(*Player) interface{}, lobby *Lobby)
+	// SendDataToOtherPlayers forwards data to all players but the sender.
+	SendDataToOtherPlayers(sender *Player, lobby *Lobby, data interface{})
+	// WriteAsJSON sends data to a single player of the lobby.
+	WriteAsJSON(player *Player, lobby *Lobby, object interface{}) error
+	// WritePublicSystemMessage sends a system message to all players.
+	WritePublicSystemMessage(lobby *Lobby, text string)
+}
+
+// RecordedEvent is an event captured by a RecordingBroadcaster.
+type RecordedEvent struct {
+	// Type is empty for events sent via WriteAsJSON or
+	// SendDataToOtherPlayers, since their data is passed through as is.
+	Type string
+	// Target is the ID of the receiving player, empty if the event was
+	// meant for all players of the lobby.
+	Target string
+	// Sender is the ID of the player whose data has been forwarded via
+	// SendDataToOtherPlayers.
+	Sender string
+	Data   interface{}
+}
+
+// RecordingBroadcaster doesn't deliver anything, but records all events for
+// later inspection. It is meant for tests.
+type RecordingBroadcaster struct {
+	mu     sync.Mutex
+	events []*RecordedEvent
+}
+
+func NewRecordingBroadcaster() *RecordingBroadcaster {
+	return &RecordingBroadcaster{}
+}
+
+func (b *RecordingBroadcaster) record(event *RecordedEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.events = append(b.events, event)
+}
+
+// Events returns all events recorded so far.
+func (b *RecordingBroadcaster) Events() []*RecordedEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]*RecordedEvent(nil), b.events...)
+}
+
+// EventsOfType returns all recorded events of the given type.
+func (b *RecordingBroadcaster) EventsOfType(eventType string) []*RecordedEvent {
+	events := []*RecordedEvent{}
+	for _, event := range b.Events() {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Reset drops all recorded events.
+func (b *RecordingBroadcaster) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.events = nil
+}
+
+func (b *RecordingBroadcaster) TriggerSimpleUpdateEvent(eventType string, lobby *Lobby) {
+	b.record(&RecordedEvent{Type: eventType})
+}
+
+func (b *RecordingBroadcaster) TriggerComplexUpdateEvent(eventType string, data interface{}, lobby *Lobby) {
+	b.record(&RecordedEvent{Type: eventType, Data: data})
+}
+
+func (b *RecordingBroadcaster) TriggerComplexUpdatePerPlayerEvent(eventType string, data func(*Player) interface{}, lobby *Lobby) {
+	for _, player := range lobby.State.Players {
+		b.record(&RecordedEvent{Type: eventType, Target: player.ID, Data: data(player)})
+	}
+}
+
+func (b *RecordingBroadcaster) SendDataToOtherPlayers(sender *Player, lobby *Lobby, data interface{}) {
+	b.record(&RecordedEvent{Sender: sender.ID, Data: data})
+}
+
+func (b *RecordingBroadcaster) WriteAsJSON(player *Player, lobby *Lobby, object interface{}) error {
+	event := &RecordedEvent{Target: player.ID, Data: object}
+	switch packet := object.(type) {
+	case Packet:
+		event.Type = packet.Type
+	case *Packet:
+		event.Type = packet.Type
+	}
+	b.record(event)
+	return nil
+}
+
+func (b *RecordingBroadcaster) WritePublicSystemMessage(lobby *Lobby, text string) {
+	b.record(&RecordedEvent{Type: EventSystemMessage, Data: text})
+}
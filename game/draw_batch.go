@@ -0,0 +1,114 @@
+package game
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// drawBatch collects the line and fill packets of the drawer, so that they
+// are stored and sent to the other players together once DrawBatchWindow
+// has passed, instead of one by one for every mouse movement.
+//
+// A nil drawBatch doesn't collect anything, packets are handled right away.
+type drawBatch struct {
+	mu     sync.Mutex
+	sender *Player
+	ops    []*Packet
+	timer  *time.Timer
+}
+
+func newDrawBatch() *drawBatch {
+	return &drawBatch{}
+}
+
+// queueDrawOp adds a line or fill packet of the drawer to the current batch.
+// The first packet of a batch starts the timer flushing it.
+func (l *Lobby) queueDrawOp(sender *Player, op *Packet) {
+	// Drawing something new makes undone gestures unrecoverable.
+	l.undone = nil
+
+	batch := l.drawBatch
+	if batch == nil || DrawBatchWindow <= 0 {
+		l.appendDrawOps(op)
+		l.broadcaster.SendDataToOtherPlayers(sender, l, op)
+		return
+	}
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	// Packets of different players never share a batch.
+	if batch.sender != nil && batch.sender != sender {
+		l.flushDrawOpsLocked()
+	}
+	batch.sender = sender
+	batch.ops = append(batch.ops, op)
+	if batch.timer == nil {
+		batch.timer = time.AfterFunc(DrawBatchWindow, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.flushDrawOps()
+		})
+	}
+}
+
+// flushDrawOps adds the collected packets to the drawing and sends them to
+// the other players. It has to be called before anything else changes the
+// drawing, so that the players see all changes in order.
+func (l *Lobby) flushDrawOps() {
+	batch := l.drawBatch
+	if batch == nil {
+		return
+	}
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	l.flushDrawOpsLocked()
+}
+
+func (l *Lobby) flushDrawOpsLocked() {
+	batch := l.drawBatch
+	ops, sender := batch.ops, batch.sender
+	batch.ops, batch.sender = nil, nil
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+	if len(ops) == 0 {
+		return
+	}
+
+	// The whole batch is a single write to the store.
+	l.appendDrawOps(ops...)
+
+	if len(ops) == 1 {
+		l.broadcaster.SendDataToOtherPlayers(sender, l, ops[0])
+		return
+	}
+	data, err := json.Marshal(ops)
+	if err != nil {
+		log.Printf("Error encoding draw batch: %s\n", err)
+		return
+	}
+	l.broadcaster.SendDataToOtherPlayers(sender, l, &Packet{Type: EventDrawBatch, Data: data})
+}
+
+// discardDrawOps drops the collected packets without sending them, which is
+// used when the drawing is cleared anyway.
+func (l *Lobby) discardDrawOps() {
+	batch := l.drawBatch
+	if batch == nil {
+		return
+	}
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	batch.ops, batch.sender = nil, nil
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+}
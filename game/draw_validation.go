@@ -0,0 +1,72 @@
+package game
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// All coordinates sent by clients refer to a drawing board of this size.
+// Clients scale them to the size of their canvas.
+const (
+	DrawingBoardBaseWidth  = 1600
+	DrawingBoardBaseHeight = 900
+)
+
+// Bounds of the width of lines, relative to the drawing board base size.
+const (
+	MinLineWidth = 1
+	MaxLineWidth = 80
+)
+
+// maxOffBoardDistance is how far points may be off the drawing board, for
+// example when a touch moves beyond the canvas. Such points are moved onto
+// the edge of the board. Points further away are rejected.
+const maxOffBoardDistance = DrawingBoardBaseWidth
+
+// colorPattern matches the color formats accepted from clients, which are
+// the hex notations #rgb and #rrggbb.
+var colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// validate makes sure that the line can be drawn by every client. Points off
+// the board are moved onto its edge, so all clients draw the same line.
+func (line *Line) validate() error {
+	if err := clampPoint(&line.FromX, &line.FromY); err != nil {
+		return err
+	}
+	if err := clampPoint(&line.ToX, &line.ToY); err != nil {
+		return err
+	}
+	if math.IsNaN(line.LineWidth) || line.LineWidth < MinLineWidth || line.LineWidth > MaxLineWidth {
+		return fmt.Errorf("line width %v isn't between %d and %d", line.LineWidth, MinLineWidth, MaxLineWidth)
+	}
+	return validateColor(line.Color)
+}
+
+// validate makes sure that the fill can be applied by every client.
+func (fill *Fill) validate() error {
+	if err := clampPoint(&fill.X, &fill.Y); err != nil {
+		return err
+	}
+	return validateColor(fill.Color)
+}
+
+// clampPoint moves a point that is off the drawing board onto its edge. It
+// fails for points that are too far away, which includes NaN and infinity.
+func clampPoint(x, y *float64) error {
+	// Written so that NaN fails the comparisons.
+	if !(*x >= -maxOffBoardDistance && *x <= DrawingBoardBaseWidth+maxOffBoardDistance) ||
+		!(*y >= -maxOffBoardDistance && *y <= DrawingBoardBaseHeight+maxOffBoardDistance) {
+		return fmt.Errorf("point (%v, %v) is far outside of the %dx%d drawing board", *x, *y, DrawingBoardBaseWidth, DrawingBoardBaseHeight)
+	}
+	*x = math.Max(0, math.Min(DrawingBoardBaseWidth, *x))
+	*y = math.Max(0, math.Min(DrawingBoardBaseHeight, *y))
+	return nil
+}
+
+func validateColor(color string) error {
+	if !colorPattern.MatchString(color) {
+		return fmt.Errorf("color %q isn't of the form #rgb or #rrggbb", color)
+	}
+	return nil
+}
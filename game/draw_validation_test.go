@@ -0,0 +1,56 @@
+package game
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineValidation(t *testing.T) {
+	valid := Line{FromX: 0, FromY: 0, ToX: DrawingBoardBaseWidth, ToY: DrawingBoardBaseHeight, Color: "#00ff00", LineWidth: 15}
+	require.Nil(t, valid.validate())
+
+	for name, modify := range map[string]func(*Line){
+		"NaN coordinate":    func(l *Line) { l.FromX = math.NaN() },
+		"infinite":          func(l *Line) { l.ToY = math.Inf(1) },
+		"far left of board": func(l *Line) { l.FromX = -5000 },
+		"far below board":   func(l *Line) { l.ToY = DrawingBoardBaseHeight + 5000 },
+		"huge width":        func(l *Line) { l.LineWidth = 10000 },
+		"zero width":        func(l *Line) { l.LineWidth = 0 },
+		"NaN width":         func(l *Line) { l.LineWidth = math.NaN() },
+		"named color":       func(l *Line) { l.Color = "red" },
+		"markup as color":   func(l *Line) { l.Color = "<script>alert(1)</script>" },
+		"too long hex":      func(l *Line) { l.Color = "#0000000" },
+		"missing hash":      func(l *Line) { l.Color = "00ff00" },
+		"invalid hex char":  func(l *Line) { l.Color = "#00ffzz" },
+	} {
+		line := valid
+		modify(&line)
+		require.NotNil(t, line.validate(), name)
+	}
+
+	// Rounding errors of the clients scaling are tolerated.
+	line := valid
+	line.ToX = DrawingBoardBaseWidth + 0.0001
+	line.Color = "#ABC"
+	require.Nil(t, line.validate())
+	require.Equal(t, float64(DrawingBoardBaseWidth), line.ToX)
+
+	// Touches moving beyond the board draw along its edge.
+	line = valid
+	line.FromX, line.FromY = -50, 300
+	line.ToX, line.ToY = 100, DrawingBoardBaseHeight+50
+	require.Nil(t, line.validate())
+	require.Equal(t, Line{FromX: 0, FromY: 300, ToX: 100, ToY: DrawingBoardBaseHeight, Color: "#00ff00", LineWidth: 15}, line)
+}
+
+func TestFillValidation(t *testing.T) {
+	require.Nil(t, (&Fill{X: 800, Y: 450, Color: "#ffffff"}).validate())
+	require.NotNil(t, (&Fill{X: math.NaN(), Y: 450, Color: "#ffffff"}).validate())
+	require.NotNil(t, (&Fill{X: 800, Y: -5000, Color: "#ffffff"}).validate())
+	fill := &Fill{X: 800, Y: -100, Color: "#ffffff"}
+	require.Nil(t, fill.validate())
+	require.Equal(t, 0.0, fill.Y)
+	require.NotNil(t, (&Fill{X: 800, Y: 450, Color: "url(javascript:x)"}).validate())
+}
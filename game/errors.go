@@ -0,0 +1,91 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ErrorCode tells clients why a packet they sent has been rejected. The
+// codes are part of the protocol and don't change, unlike the messages that
+// accompany them. See PROTOCOL.md for the list meant for client authors.
+type ErrorCode string
+
+// Error codes sent to clients
+const (
+	// ErrorInvalidPacket means that the packet wasn't valid JSON or didn't
+	// have the shape of a packet.
+	ErrorInvalidPacket ErrorCode = "invalid-packet"
+	// ErrorUnknownPacketType means that the server doesn't handle packets
+	// of the given type.
+	ErrorUnknownPacketType ErrorCode = "unknown-packet-type"
+	// ErrorInvalidData means that the data of the packet couldn't be
+	// decoded or contained invalid values.
+	ErrorInvalidData ErrorCode = "invalid-data"
+	// ErrorGameNotStarted means that the action is only possible once the
+	// game has been started.
+	ErrorGameNotStarted ErrorCode = "game-not-started"
+	// ErrorGameAlreadyStarted means that the game can't be started again
+	// while it is running.
+	ErrorGameAlreadyStarted ErrorCode = "game-already-started"
+	// ErrorNotOwner means that only the owner of the lobby may do this.
+	ErrorNotOwner ErrorCode = "not-owner"
+	// ErrorCannotDraw means that the player isn't the drawer or hasn't
+	// chosen a word yet.
+	ErrorCannotDraw ErrorCode = "cannot-draw"
+	// ErrorNotDrawer means that only the current drawer may do this.
+	ErrorNotDrawer ErrorCode = "not-drawer"
+	// ErrorVotekickDisabled means that votekicking is disabled in the
+	// lobby.
+	ErrorVotekickDisabled ErrorCode = "votekick-disabled"
+	// ErrorUnsupportedProtocolVersion means that the client speaks a
+	// protocol version the server doesn't support anymore. The connection
+	// is closed.
+	ErrorUnsupportedProtocolVersion ErrorCode = "unsupported-protocol-version"
+	// ErrorReadOnly means that the lobby is a replay, in which viewers can
+	// only control the playback.
+	ErrorReadOnly ErrorCode = "read-only"
+	// ErrorNotReplay means that the lobby isn't a replay, so there is no
+	// playback to control.
+	ErrorNotReplay ErrorCode = "not-replay"
+	// ErrorInternal means that the server failed to handle a valid packet.
+	ErrorInternal ErrorCode = "internal-error"
+)
+
+// PacketError is a rejected packet. It is returned by HandlePacket and sent
+// to the player as an "error" event.
+type PacketError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// PacketType is the type of the rejected packet, if it was known.
+	PacketType string `json:"packetType,omitempty"`
+}
+
+func (e *PacketError) Error() string {
+	if e.PacketType == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s (%s): %s", e.Code, e.PacketType, e.Message)
+}
+
+func newPacketError(code ErrorCode, packetType, format string, args ...interface{}) *PacketError {
+	return &PacketError{
+		Code:       code,
+		Message:    fmt.Sprintf(format, args...),
+		PacketType: packetType,
+	}
+}
+
+// sendError tells the player why their packet has been rejected. Errors that
+// aren't PacketErrors are reported as ErrorInternal.
+func (l *Lobby) sendError(player *Player, packetType string, err error) {
+	packetErr, ok := err.(*PacketError)
+	if !ok {
+		packetErr = newPacketError(ErrorInternal, packetType, "%s", err)
+	}
+
+	data, err := json.Marshal(packetErr)
+	if err != nil {
+		panic(err)
+	}
+	l.broadcaster.WriteAsJSON(player, l, Packet{Type: EventError, Data: data})
+}
@@ -0,0 +1,126 @@
+package game
+
+import (
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// EventLog numbers the events sent to the players of a lobby and keeps the
+// most recent ones. Players whose connection dropped for a moment can be
+// sent the events they missed, instead of a full snapshot of the lobby.
+// Sequence numbers start over whenever a lobby is loaded, for example after
+// a restart or on another node of a cluster, therefore each log has a random
+// epoch, which has to match for resuming.
+//
+// A nil EventLog numbers nothing and keeps nothing.
+type EventLog struct {
+	mu    sync.Mutex
+	epoch string
+	seq   uint64
+	size  int
+	// dropped is the highest sequence number that isn't available anymore.
+	dropped uint64
+	// events is a ring buffer, next is the position of the oldest event
+	// once the buffer is full.
+	events []*LoggedEvent
+	next   int
+}
+
+// LoggedEvent is an event as it has been sent to the players.
+type LoggedEvent struct {
+	Seq uint64
+	// Target is the only player the event was meant for. If it is empty,
+	// the event went to all players but Exclude.
+	Target  string
+	Exclude string
+	// Data is the encoded event, including its sequence number.
+	Data []byte
+}
+
+// NewEventLog creates a log keeping the given number of events.
+func NewEventLog(size int) *EventLog {
+	return &EventLog{epoch: uuid.NewV4().String(), size: size}
+}
+
+// Append assigns the next sequence number to an event and logs it. As the
+// sequence number is part of the event, encode is called with it. The
+// encoded event is returned.
+func (log *EventLog) Append(target, exclude string, encode func(seq uint64) ([]byte, error)) ([]byte, error) {
+	if log == nil {
+		return encode(0)
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	data, err := encode(log.seq + 1)
+	if err != nil {
+		return nil, err
+	}
+	log.seq++
+
+	if log.size <= 0 {
+		log.dropped = log.seq
+		return data, nil
+	}
+
+	event := &LoggedEvent{Seq: log.seq, Target: target, Exclude: exclude, Data: data}
+	if len(log.events) < log.size {
+		log.events = append(log.events, event)
+	} else {
+		log.dropped = log.events[log.next].Seq
+		log.events[log.next] = event
+		log.next = (log.next + 1) % len(log.events)
+	}
+	return data, nil
+}
+
+// Epoch identifies the log. Sequence numbers of other logs are meaningless
+// to it.
+func (log *EventLog) Epoch() string {
+	if log == nil {
+		return ""
+	}
+	return log.epoch
+}
+
+// Seq returns the sequence number of the latest event.
+func (log *EventLog) Seq() uint64 {
+	if log == nil {
+		return 0
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.seq
+}
+
+// Since returns the events the player has received after lastSeq of the
+// given epoch, oldest first. If some of them aren't available anymore, or
+// lastSeq stems from another log, for example because the lobby has been
+// reloaded, false is returned.
+func (log *EventLog) Since(playerID, epoch string, lastSeq uint64) ([]*LoggedEvent, bool) {
+	if log == nil || epoch != log.epoch {
+		return nil, false
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if lastSeq > log.seq || lastSeq < log.dropped {
+		return nil, false
+	}
+
+	missed := []*LoggedEvent{}
+	for i := range log.events {
+		event := log.events[(log.next+i)%len(log.events)]
+		if event.Seq <= lastSeq {
+			continue
+		}
+		if event.Target == playerID || (event.Target == "" && event.Exclude != playerID) {
+			missed = append(missed, event)
+		}
+	}
+	return missed, true
+}
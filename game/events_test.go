@@ -0,0 +1,76 @@
+package game
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func appendEvent(t *testing.T, log *EventLog, target, exclude string) uint64 {
+	var seq uint64
+	_, err := log.Append(target, exclude, func(s uint64) ([]byte, error) {
+		seq = s
+		return []byte(strconv.FormatUint(s, 10)), nil
+	})
+	require.Nil(t, err)
+	return seq
+}
+
+func seqs(events []*LoggedEvent) []uint64 {
+	result := []uint64{}
+	for _, event := range events {
+		result = append(result, event.Seq)
+	}
+	return result
+}
+
+func TestEventLogReplaysEventsOfPlayer(t *testing.T) {
+	log := NewEventLog(10)
+	require.Equal(t, uint64(1), appendEvent(t, log, "", ""))
+	require.Equal(t, uint64(2), appendEvent(t, log, "a", ""))
+	require.Equal(t, uint64(3), appendEvent(t, log, "b", ""))
+	require.Equal(t, uint64(4), appendEvent(t, log, "", "a"))
+	require.Equal(t, uint64(5), appendEvent(t, log, "", ""))
+	require.Equal(t, uint64(5), log.Seq())
+
+	missed, ok := log.Since("a", log.Epoch(), 1)
+	require.True(t, ok)
+	require.Equal(t, []uint64{2, 5}, seqs(missed))
+	require.Equal(t, "2", string(missed[0].Data))
+
+	missed, ok = log.Since("b", log.Epoch(), 0)
+	require.True(t, ok)
+	require.Equal(t, []uint64{1, 3, 4, 5}, seqs(missed))
+
+	missed, ok = log.Since("b", log.Epoch(), 5)
+	require.True(t, ok)
+	require.Empty(t, missed)
+
+	// Sequence numbers from before a reload are unknown.
+	_, ok = log.Since("b", log.Epoch(), 6)
+	require.False(t, ok)
+	_, ok = log.Since("b", NewEventLog(10).Epoch(), 1)
+	require.False(t, ok)
+	_, ok = log.Since("b", "", 1)
+	require.False(t, ok)
+}
+
+func TestEventLogDropsOldEvents(t *testing.T) {
+	log := NewEventLog(3)
+	for i := 0; i < 7; i++ {
+		appendEvent(t, log, "", "")
+	}
+
+	// Events 1 to 4 are gone.
+	_, ok := log.Since("a", log.Epoch(), 3)
+	require.False(t, ok)
+
+	missed, ok := log.Since("a", log.Epoch(), 4)
+	require.True(t, ok)
+	require.Equal(t, []uint64{5, 6, 7}, seqs(missed))
+
+	missed, ok = log.Since("a", log.Epoch(), 5)
+	require.True(t, ok)
+	require.Equal(t, []uint64{6, 7}, seqs(missed))
+}
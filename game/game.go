@@ -1,16 +1,108 @@
 package game
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 )
 
+// LobbyStore persists lobbies. Settings, state and the draw log of a lobby
+// can be written and read separately, so that hot paths such as drawing
+// don't have to rewrite the whole lobby.
 type LobbyStore interface {
-	SaveSettings(id string, l *LobbySettings) error
-	SaveState(id string, s *LobbyState) error
-	SaveDrawOp(id string, l ...*Packet) error
-	ClearDrawing(id string) error
-	Load(id string) (*Lobby, error)
-	Save(*Lobby) error
+	SaveSettings(ctx context.Context, id string, s *LobbySettings) error
+	SaveState(ctx context.Context, id string, s *LobbyState) error
+	SaveDrawOp(ctx context.Context, id string, ops ...*Packet) error
+	PopDrawOps(ctx context.Context, id string, count int) error
+	ClearDrawing(ctx context.Context, id string) error
+	// SaveTurn adds a finished turn to the archive of the lobby.
+	SaveTurn(ctx context.Context, id string, turn *Turn) error
+	// ClearTurns empties the archive of finished turns.
+	ClearTurns(ctx context.Context, id string) error
+	Save(ctx context.Context, l *Lobby) error
+
+	Load(ctx context.Context, id string) (*Lobby, error)
+	LoadSettings(ctx context.Context, id string) (*LobbySettings, error)
+	LoadState(ctx context.Context, id string) (*LobbyState, error)
+	LoadDrawing(ctx context.Context, id string) (*LobbyDrawing, error)
+	// LoadTurns returns the archive of finished turns, oldest first.
+	LoadTurns(ctx context.Context, id string) ([]*Turn, error)
+
+	// List returns a page of lobbies matching the given options, ordered by
+	// creation time.
+	List(ctx context.Context, opts ListOptions) (*LobbyPage, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// ErrLobbyNotFound is returned by a LobbyStore if the requested lobby
+// doesn't exist or has already expired.
+var ErrLobbyNotFound = errors.New("lobby not found")
+
+// DefaultListLimit is the page size used by LobbyStore.List if no limit
+// has been given.
+const DefaultListLimit = 20
+
+// ListOptions filters and paginates LobbyStore.List. Nil filters match all
+// lobbies.
+type ListOptions struct {
+	Language string
+	Public   *bool
+	Started  *bool
+
+	// Cursor is the position to continue listing from, as returned by the
+	// previous page. Zero starts at the beginning.
+	Cursor int64
+	Limit  int
+}
+
+// Matches checks whether the given lobby passes all filters.
+func (o *ListOptions) Matches(s *LobbySummary) bool {
+	if o.Language != "" && o.Language != s.Language {
+		return false
+	}
+	if o.Public != nil && *o.Public != s.Public {
+		return false
+	}
+	if o.Started != nil && *o.Started != s.Started {
+		return false
+	}
+	return true
+}
+
+// LobbyPage is a single page of lobbies returned by LobbyStore.List.
+type LobbyPage struct {
+	Lobbies []*LobbySummary `json:"lobbies"`
+	// Next is the cursor for the following page, zero if there are no
+	// further lobbies.
+	Next int64 `json:"next"`
+}
+
+// LobbySummary describes a lobby without its drawing and player details.
+type LobbySummary struct {
+	ID          string `json:"id"`
+	Language    string `json:"language"`
+	Public      bool   `json:"public"`
+	Started     bool   `json:"started"`
+	Round       int    `json:"round"`
+	MaxRounds   int    `json:"maxRounds"`
+	PlayerCount int    `json:"playerCount"`
+	MaxPlayers  int    `json:"maxPlayers"`
+}
+
+// NewLobbySummary creates the summary of a stored lobby.
+func NewLobbySummary(id string, settings *LobbySettings, state *LobbyState) *LobbySummary {
+	return &LobbySummary{
+		ID:          id,
+		Language:    settings.Language,
+		Public:      settings.Public,
+		Started:     state.Started,
+		Round:       state.Round,
+		MaxRounds:   settings.Rounds,
+		PlayerCount: len(state.Players),
+		MaxPlayers:  settings.MaxPlayers,
+	}
 }
 
 var (
@@ -32,21 +124,102 @@ var (
 		"english": "English",
 		"french":  "French",
 	}
+
+	// LobbyIdleTimeout is the time after which a lobby without connected
+	// players is considered abandoned and removed by SweepLobbies.
+	LobbyIdleTimeout = time.Hour
+	// StoreTimeout bounds every call the game logic makes to the Store.
+	StoreTimeout = 5 * time.Second
+	// ReconnectGracePeriod is the time a drawer whose connection dropped has
+	// to come back before their turn is forfeited. Zero ends the turn
+	// immediately.
+	ReconnectGracePeriod = 30 * time.Second
+	// EventLogSize is the number of recent events kept per lobby, for
+	// players catching up after a short connection loss.
+	EventLogSize = 512
+	// DrawBatchWindow is the time line and fill packets of the drawer are
+	// collected, before they are stored and sent to the other players as a
+	// single batch. Zero sends every packet on its own right away.
+	DrawBatchWindow = 30 * time.Millisecond
+	// RedoLimit is the number of undone gestures the drawer can restore.
+	RedoLimit = 20
+	// MaxRecordingEntries bounds the length of the recording of a lobby,
+	// later entries are dropped.
+	MaxRecordingEntries = 100000
+	// MaxRecordingDataSize is the largest uncompressed size of a recording
+	// that is loaded for replay.
+	MaxRecordingDataSize = int64(256 << 20)
+	// MaxReplayLobbies is the number of replay lobbies that can run at the
+	// same time, further recordings are turned down until one is removed.
+	MaxReplayLobbies = 16
+	// SnapshotThreshold is the number of draw operations from which on
+	// connecting players are sent an image of the drawing, instead of all of
+	// its operations. Zero always sends the operations.
+	SnapshotThreshold = 1000
+	// SnapshotKeepGestures is the number of latest gestures that are sent
+	// as operations along with a snapshot, so that they can be undone
+	// without a new image.
+	SnapshotKeepGestures = 20
+	// SimplifyTolerance is the distance in pixels of the drawing board by
+	// which finished lines may deviate from what has been drawn, when their
+	// segments are merged to store fewer operations. Zero keeps all segments.
+	SimplifyTolerance = 0.0
 )
 
-var TriggerSimpleUpdateEvent func(eventType string, lobby *Lobby)
-var TriggerComplexUpdatePerPlayerEvent func(eventType string, data func(*Player) interface{}, lobby *Lobby)
-var TriggerComplexUpdateEvent func(eventType string, data interface{}, lobby *Lobby)
-var SendDataToOtherPlayers func(sender *Player, lobby *Lobby, data interface{})
-var WriteAsJSON func(player *Player, object interface{}) error
-var WritePublicSystemMessage func(lobby *Lobby, text string)
+func storeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), StoreTimeout)
+}
+
+// saveState persists the lobby state, logging failures instead of
+// interrupting the game.
+func (l *Lobby) saveState() {
+	// Replays aren't stored, removed lobbies might have been loaded again.
+	if l.replay != nil || l.removed {
+		return
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	err := Store.SaveState(ctx, l.ID, l.State)
+	if err != nil {
+		fmt.Println("store SaveState error:", err)
+	}
+}
+
+// SaveTo writes the whole lobby to the given store, including its finished
+// turns, while nothing can change it.
+func (l *Lobby) SaveTo(ctx context.Context, store LobbyStore) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := store.Save(ctx, l)
+	if err != nil {
+		return err
+	}
+	err = store.ClearTurns(ctx, l.ID)
+	if err != nil {
+		return err
+	}
+	for _, turn := range l.Turns() {
+		err = store.SaveTurn(ctx, l.ID, turn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 func (l *Lobby) triggerPlayersUpdate() {
-	TriggerComplexUpdateEvent("update-players", l.State.Players, l)
+	// The viewers of a replay are shown the players of the recording.
+	if l.replay != nil {
+		return
+	}
+	l.broadcaster.TriggerComplexUpdateEvent(EventUpdatePlayers, l.State.Players, l)
 }
 
 func (l *Lobby) triggerCorrectGuessEvent() {
-	TriggerSimpleUpdateEvent("correct-guess", l)
+	l.broadcaster.TriggerSimpleUpdateEvent(EventCorrectGuess, l)
 }
 
 func (l *Lobby) triggerWordHintUpdate() {
@@ -54,7 +227,8 @@ func (l *Lobby) triggerWordHintUpdate() {
 		return
 	}
 
-	TriggerComplexUpdatePerPlayerEvent("update-wordhint", func(player *Player) interface{} {
+	l.recording.add(RecordWordHints, l.State.WordHints)
+	l.broadcaster.TriggerComplexUpdatePerPlayerEvent(EventUpdateWordHint, func(player *Player) interface{} {
 		return l.GetAvailableWordHints(player)
 	}, l)
 }
@@ -81,4 +255,13 @@ type Ready struct {
 	WordHints      []*WordHint `json:"wordHints"`
 	Players        []*Player   `json:"players"`
 	CurrentDrawing []*Packet   `json:"currentDrawing"`
+	// Snapshot is a PNG data URL of the beginning of a large drawing, in
+	// which case CurrentDrawing only contains the operations drawn after
+	// it. See SnapshotThreshold.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Replay is the playback status, only set in replay lobbies.
+	Replay *ReplayStatus `json:"replay,omitempty"`
+	// Epoch identifies the numbering of the events, a client resuming the
+	// connection has to send it along with the last seq received.
+	Epoch string `json:"epoch"`
 }
@@ -1,7 +1,10 @@
 package game_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
@@ -13,28 +16,10 @@ import (
 
 func TestGame(t *testing.T) {
 	game.Store = store.NewRedisStore(&redis.Options{
-		Addr: "127.0.01:6379",
+		Addr: "127.0.0.1:6379",
 	})
 
-	game.TriggerSimpleUpdateEvent = func(eventType string, lobby *game.Lobby) {
-		fmt.Println("TriggerSimpleUpdateEvent", eventType)
-	}
-	game.TriggerComplexUpdatePerPlayerEvent = func(eventType string, data func(*game.Player) interface{}, lobby *game.Lobby) {
-		fmt.Println("TriggerComplexUpdatePerPlayerEvent", eventType)
-	}
-	game.TriggerComplexUpdateEvent = func(eventType string, data interface{}, lobby *game.Lobby) {
-		fmt.Println("TriggerComplexUpdateEvent", eventType)
-	}
-	game.SendDataToOtherPlayers = func(sender *game.Player, lobby *game.Lobby, data interface{}) {
-		fmt.Println("SendDataToOtherPlayers")
-	}
-	game.WriteAsJSON = func(player *game.Player, object interface{}) error {
-		fmt.Println("WriteAsJSON")
-		return nil
-	}
-	game.WritePublicSystemMessage = func(lobby *game.Lobby, text string) {
-		fmt.Println("WritePublicSystemMessage")
-	}
+	broadcaster := game.NewRecordingBroadcaster()
 
 	bro, lobby, err := game.NewLobby("test-bro", "test-bro-session", "english", 1, game.LobbySettings{
 		ClientsPerIPLimit: 5,
@@ -44,11 +29,12 @@ func TestGame(t *testing.T) {
 		EnableVotekick:    true,
 		MaxPlayers:        12,
 		Rounds:            5,
-	})
+	}, broadcaster)
 
 	require.Nil(t, err)
 	require.NotNil(t, lobby)
 	require.NotNil(t, bro)
+	defer game.RemoveLobby(lobby.ID)
 
 	// no players connected
 	require.Len(t, lobby.State.Players, 1)
@@ -67,6 +53,8 @@ func TestGame(t *testing.T) {
 
 	// connect player
 	lobby.Connect(bro)
+	require.Len(t, broadcaster.EventsOfType("ready"), 1)
+	require.Equal(t, bro.ID, broadcaster.EventsOfType("ready")[0].Target)
 
 	require.Equal(t, bro.State, game.PlayerStateGuessing)
 	require.Equal(t, lobby.State.Round, 0)
@@ -88,6 +76,8 @@ func TestGame(t *testing.T) {
 
 	time.Sleep(time.Millisecond)
 
+	require.Len(t, broadcaster.EventsOfType("next-turn"), 1)
+	require.Len(t, broadcaster.EventsOfType("your-turn"), 1)
 	require.Equal(t, bro.State, game.PlayerStateDrawing)
 	require.Equal(t, lobby.State.Round, 1)
 	require.True(t, lobby.State.RoundEndTime > 0)
@@ -169,3 +159,680 @@ func TestGame(t *testing.T) {
 		}
 	}
 }
+
+func TestSweepLobbies(t *testing.T) {
+	game.Store = store.NewRedisStore(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+
+	_, lobby, err := game.NewLobby("test-bro", "test-bro-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, game.NewRecordingBroadcaster())
+	require.Nil(t, err)
+
+	defaultTimeout := game.LobbyIdleTimeout
+	defer func() { game.LobbyIdleTimeout = defaultTimeout }()
+
+	// Fresh lobbies must survive a sweep.
+	game.SweepLobbies()
+	require.NotNil(t, game.GetLobby(lobby.ID))
+
+	game.LobbyIdleTimeout = 0
+	require.True(t, game.SweepLobbies() >= 1)
+	require.Nil(t, game.GetLobby(lobby.ID))
+
+	_, err = game.Store.Load(context.Background(), lobby.ID)
+	require.NotNil(t, err)
+
+	// Lobbies that expired in redis are dropped from the index as well.
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer client.Close()
+	require.Nil(t, client.ZAdd("lobbies", redis.Z{Score: 1, Member: "expired-lobby"}).Err())
+	game.SweepLobbies()
+	require.Equal(t, redis.Nil, client.ZScore("lobbies", "expired-lobby").Err())
+}
+
+// testSocket stands in for a players websocket, all writes are recorded by
+// the lobbies broadcaster instead.
+type testSocket struct{}
+
+func (testSocket) WriteJSON(v interface{}) error { return nil }
+func (testSocket) Close() error                  { return nil }
+func (testSocket) RemoteAddr() net.Addr          { return &net.TCPAddr{} }
+
+func TestDrawerReconnect(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultGracePeriod := game.ReconnectGracePeriod
+	game.ReconnectGracePeriod = 200 * time.Millisecond
+	defer func() { game.ReconnectGracePeriod = defaultGracePeriod }()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	owner.SetWebsocket(testSocket{})
+	lobby.Connect(owner)
+	other := lobby.JoinPlayer("other", "other-session", 0)
+	other.SetWebsocket(testSocket{})
+	lobby.Connect(other)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer, guesser := owner, other
+	if lobby.State.Drawer == other.ID {
+		drawer, guesser = other, owner
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+	word := lobby.State.CurrentWord
+	roundEndTime := lobby.State.RoundEndTime
+
+	// Refreshing the page keeps the turn.
+	lobby.Disconnect(drawer)
+	require.True(t, drawer.Reconnecting)
+	require.Equal(t, drawer.ID, lobby.State.Drawer)
+
+	broadcaster.Reset()
+	drawer.SetWebsocket(testSocket{})
+	lobby.Connect(drawer)
+	require.False(t, drawer.Reconnecting)
+	require.Equal(t, drawer.ID, lobby.State.Drawer)
+	require.Equal(t, word, lobby.State.CurrentWord)
+	require.Equal(t, roundEndTime, lobby.State.RoundEndTime)
+	require.Empty(t, broadcaster.EventsOfType("your-turn"))
+
+	readyEvents := broadcaster.EventsOfType("ready")
+	require.Len(t, readyEvents, 1)
+	ready := &game.Ready{}
+	require.Nil(t, json.Unmarshal(readyEvents[0].Data.(game.Packet).Data, ready))
+	require.True(t, ready.Drawing)
+	shownWord := []rune{}
+	for _, hint := range ready.WordHints {
+		shownWord = append(shownWord, hint.Character)
+	}
+	require.Equal(t, word, string(shownWord))
+
+	// The reconnect must have cancelled the forfeit.
+	time.Sleep(2 * game.ReconnectGracePeriod)
+	require.Empty(t, broadcaster.EventsOfType(game.EventNextTurn))
+
+	// Not coming back in time ends the turn. The next turn is announced
+	// once the lobby is done changing.
+	lobby.Disconnect(drawer)
+	require.True(t, drawer.Reconnecting)
+	require.Eventually(t, func() bool {
+		return len(broadcaster.EventsOfType(game.EventNextTurn)) > 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, guesser.ID, lobby.State.Drawer)
+	require.False(t, drawer.Reconnecting)
+}
+
+func TestRejectedPacketsAreReported(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.Connect(owner)
+	guest := lobby.JoinPlayer("guest", "guest-session", 0)
+	lobby.Connect(guest)
+
+	for _, testCase := range []struct {
+		packet     string
+		from       *game.Player
+		code       game.ErrorCode
+		packetType string
+	}{
+		{`{"type":`, owner, game.ErrorInvalidPacket, ""},
+		{`{"type":"dance"}`, owner, game.ErrorUnknownPacketType, "dance"},
+		{`{"type":"message","data":1}`, owner, game.ErrorInvalidData, "message"},
+		{`{"type":"line","data":{}}`, owner, game.ErrorGameNotStarted, "line"},
+		{`{"type":"start"}`, guest, game.ErrorNotOwner, "start"},
+	} {
+		broadcaster.Reset()
+		err := lobby.HandlePacket([]byte(testCase.packet), testCase.from)
+		packetErr, ok := err.(*game.PacketError)
+		require.True(t, ok, testCase.packet)
+		require.Equal(t, testCase.code, packetErr.Code, testCase.packet)
+
+		events := broadcaster.EventsOfType("error")
+		require.Len(t, events, 1, testCase.packet)
+		require.Equal(t, testCase.from.ID, events[0].Target)
+		sent := &game.PacketError{}
+		require.Nil(t, json.Unmarshal(events[0].Data.(game.Packet).Data, sent))
+		require.Equal(t, testCase.code, sent.Code)
+		require.Equal(t, testCase.packetType, sent.PacketType)
+		require.NotEmpty(t, sent.Message)
+	}
+
+	// Once started, only the drawer may draw.
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	guesser := owner
+	if lobby.State.Drawer == owner.ID {
+		guesser = guest
+	}
+	err = lobby.HandlePacket([]byte(`{"type":"line","data":{}}`), guesser)
+	require.Equal(t, game.ErrorCannotDraw, err.(*game.PacketError).Code)
+	err = lobby.HandlePacket([]byte(`{"type":"choose-word","data":0}`), guesser)
+	require.Equal(t, game.ErrorNotDrawer, err.(*game.PacketError).Code)
+	err = lobby.HandlePacket([]byte(`{"type":"start"}`), owner)
+	require.Equal(t, game.ErrorGameAlreadyStarted, err.(*game.PacketError).Code)
+}
+
+func TestDrawOpsAreBatched(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 100 * time.Millisecond
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	owner.SetWebsocket(testSocket{})
+	lobby.Connect(owner)
+	other := lobby.JoinPlayer("other", "other-session", 0)
+	other.SetWebsocket(testSocket{})
+	lobby.Connect(other)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer := owner
+	if lobby.State.Drawer == other.ID {
+		drawer = other
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+
+	forwarded := func() []*game.Packet {
+		packets := []*game.Packet{}
+		for _, event := range broadcaster.Events() {
+			if event.Sender == drawer.ID {
+				packets = append(packets, event.Data.(*game.Packet))
+			}
+		}
+		return packets
+	}
+
+	broadcaster.Reset()
+	for gesture := 1; gesture <= 2; gesture++ {
+		for x := 0; x < 3; x++ {
+			line := fmt.Sprintf(`{"type":"line","data":{"fromX":%d,"fromY":0,"toX":%d,"toY":1,"color":"#000000","lineWidth":5,"gestureId":%d}}`, x, x+1, gesture)
+			require.Nil(t, lobby.HandlePacket([]byte(line), drawer))
+		}
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"fill","data":{"x":10,"y":10,"color":"#ff0000"}}`), drawer))
+	require.Empty(t, forwarded())
+
+	require.Eventually(t, func() bool {
+		return len(forwarded()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	batch := forwarded()[0]
+	require.Equal(t, game.EventDrawBatch, batch.Type)
+	ops := []*game.Packet{}
+	require.Nil(t, json.Unmarshal(batch.Data, &ops))
+	require.Len(t, ops, 7)
+	for index, op := range ops[:6] {
+		line := &game.Line{}
+		require.Nil(t, json.Unmarshal(op.Data, line))
+		require.Equal(t, index/3+1, line.GestureID)
+		require.Equal(t, float64(index%3), line.FromX)
+	}
+	require.Equal(t, "fill", ops[6].Type)
+
+	ctx := context.Background()
+	drawing, err := game.Store.LoadDrawing(ctx, lobby.ID)
+	require.Nil(t, err)
+	require.Len(t, drawing.CurrentDrawing, 7)
+
+	// Undoing sends the pending packets first, so that the right one is
+	// undone for everyone.
+	broadcaster.Reset()
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"line","data":{"fromX":0,"fromY":0,"toX":1,"toY":1,"color":"#000000","lineWidth":5,"gestureId":3}}`), drawer))
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"undo"}`), drawer))
+	packets := forwarded()
+	require.Len(t, packets, 2)
+	require.Equal(t, "line", packets[0].Type)
+	require.Equal(t, "undo", packets[1].Type)
+	require.Len(t, lobby.CurrentDrawing.CurrentDrawing, 7)
+}
+
+func TestInvalidDrawingIsRejected(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 0
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.Connect(owner)
+	guest := lobby.JoinPlayer("guest", "guest-session", 0)
+	lobby.Connect(guest)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer := owner
+	if lobby.State.Drawer == guest.ID {
+		drawer = guest
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+
+	for _, packet := range []string{
+		`{"type":"line","data":{"fromX":0,"fromY":0,"toX":99999,"toY":1,"color":"#000000","lineWidth":5}}`,
+		`{"type":"line","data":{"fromX":0,"fromY":0,"toX":1,"toY":1,"color":"#000000","lineWidth":5000}}`,
+		`{"type":"line","data":{"fromX":0,"fromY":0,"toX":1,"toY":1,"color":"javascript:alert(1)","lineWidth":5}}`,
+		`{"type":"fill","data":{"x":-5000,"y":10,"color":"#000000"}}`,
+		`{"type":"fill","data":{"x":10,"y":10}}`,
+	} {
+		broadcaster.Reset()
+		err := lobby.HandlePacket([]byte(packet), drawer)
+		require.NotNil(t, err, packet)
+		require.Equal(t, game.ErrorInvalidData, err.(*game.PacketError).Code, packet)
+		require.Len(t, broadcaster.EventsOfType("error"), 1, packet)
+		for _, event := range broadcaster.Events() {
+			require.NotEqual(t, drawer.ID, event.Sender, packet)
+		}
+	}
+	require.Empty(t, lobby.CurrentDrawing.CurrentDrawing)
+
+	// Fields the server doesn't know aren't passed on.
+	broadcaster.Reset()
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"line","data":{"fromX":0,"fromY":0,"toX":1,"toY":1,"color":"#000000","lineWidth":5,"payload":"<img>"}}`), drawer))
+	events := broadcaster.Events()
+	require.Len(t, events, 1)
+	require.Equal(t, drawer.ID, events[0].Sender)
+	require.NotContains(t, string(events[0].Data.(*game.Packet).Data), "payload")
+	ops := lobby.Drawing()
+	require.Len(t, ops, 1)
+
+	// The drawing is copied, so it can be used while the lobby changes.
+	ops[0] = nil
+	require.NotNil(t, lobby.Drawing()[0])
+}
+
+func TestUndoAndRedoWholeGestures(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 0
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.Connect(owner)
+	guest := lobby.JoinPlayer("guest", "guest-session", 0)
+	lobby.Connect(guest)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer := owner
+	if lobby.State.Drawer == guest.ID {
+		drawer = guest
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+
+	send := func(packet string) {
+		require.Nil(t, lobby.HandlePacket([]byte(packet), drawer), packet)
+	}
+	drawLine := func(gesture, segments int) {
+		for x := 0; x < segments; x++ {
+			send(fmt.Sprintf(`{"type":"line","data":{"fromX":%d,"fromY":0,"toX":%d,"toY":1,"color":"#000000","lineWidth":5,"gestureId":%d}}`, x, x+1, gesture))
+		}
+	}
+	storedOps := func() int {
+		drawing, err := game.Store.LoadDrawing(context.Background(), lobby.ID)
+		require.Nil(t, err)
+		require.Len(t, lobby.CurrentDrawing.CurrentDrawing, len(drawing.CurrentDrawing))
+		return len(drawing.CurrentDrawing)
+	}
+	lastForwarded := func() *game.Packet {
+		events := broadcaster.Events()
+		require.NotEmpty(t, events)
+		return events[len(events)-1].Data.(*game.Packet)
+	}
+
+	// Undoing on an empty board is harmless.
+	broadcaster.Reset()
+	send(`{"type":"undo"}`)
+	send(`{"type":"redo"}`)
+	require.Empty(t, broadcaster.Events())
+
+	drawLine(1, 3)
+	send(`{"type":"fill","data":{"x":10,"y":10,"color":"#ff0000"}}`)
+	drawLine(2, 2)
+	require.Equal(t, 6, storedOps())
+
+	send(`{"type":"undo"}`)
+	require.Equal(t, game.EventUndo, lastForwarded().Type)
+	require.Equal(t, "2", string(lastForwarded().Data))
+	require.Equal(t, 4, storedOps())
+
+	send(`{"type":"undo"}`)
+	require.Equal(t, "1", string(lastForwarded().Data))
+	require.Equal(t, 3, storedOps())
+
+	broadcaster.Reset()
+	send(`{"type":"redo"}`)
+	redone := broadcaster.EventsOfType(game.EventRedo)
+	require.Len(t, redone, 1)
+	require.Len(t, redone[0].Data, 1)
+	require.Equal(t, "fill", redone[0].Data.([]*game.Packet)[0].Type)
+	require.Equal(t, 4, storedOps())
+
+	send(`{"type":"redo"}`)
+	require.Equal(t, 6, storedOps())
+	broadcaster.Reset()
+	send(`{"type":"redo"}`)
+	require.Empty(t, broadcaster.Events())
+
+	// Drawing something new drops what has been undone.
+	send(`{"type":"undo"}`)
+	drawLine(3, 1)
+	send(`{"type":"redo"}`)
+	require.Equal(t, 5, storedOps())
+
+	for i := 0; i < 5; i++ {
+		send(`{"type":"undo"}`)
+	}
+	require.Equal(t, 0, storedOps())
+}
+
+func TestFinishedTurnsAreArchived(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 0
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      1,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.Connect(owner)
+	guest := lobby.JoinPlayer("guest", "guest-session", 0)
+	lobby.Connect(guest)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer, guesser := owner, guest
+	if lobby.State.Drawer == guest.ID {
+		drawer, guesser = guest, owner
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+	word := lobby.State.CurrentWord
+
+	for _, packet := range []string{
+		`{"type":"clear-drawing-board"}`,
+		`{"type":"line","data":{"fromX":0,"fromY":0,"toX":10,"toY":10,"color":"#000000","lineWidth":5,"gestureId":1}}`,
+		`{"type":"fill","data":{"x":100,"y":100,"color":"#ff0000"}}`,
+		`{"type":"undo"}`,
+	} {
+		require.Nil(t, lobby.HandlePacket([]byte(packet), drawer), packet)
+	}
+	require.Nil(t, lobby.Turn(1))
+
+	// Guessing the word ends the turn.
+	require.Nil(t, lobby.HandlePacket([]byte(fmt.Sprintf(`{"type":"message","data":%q}`, word)), guesser))
+
+	turn := lobby.Turn(1)
+	require.NotNil(t, turn)
+	require.Equal(t, 1, turn.Number)
+	require.Equal(t, 1, turn.Round)
+	require.Equal(t, word, turn.Word)
+	require.Equal(t, drawer.Name, turn.Drawer)
+	require.Equal(t, []string{guesser.Name}, turn.Guessers)
+	require.Len(t, turn.Drawing, 1)
+	require.Equal(t, game.PacketLine, turn.Drawing[0].Type)
+	types := []string{}
+	for _, op := range turn.Ops {
+		types = append(types, op.Op.Type)
+	}
+	require.Equal(t, []string{game.PacketClearDrawingBoard, game.PacketLine, game.PacketFill, game.PacketUndo}, types)
+	require.Equal(t, "1", string(turn.Ops[3].Op.Data))
+
+	announced := broadcaster.EventsOfType(game.EventTurnOver)
+	require.Len(t, announced, 1)
+	require.Equal(t, &turn.TurnSummary, announced[0].Data)
+
+	// Once every player has drawn, the game is over and all turns are
+	// listed.
+	drawer, guesser = guesser, drawer
+	require.Equal(t, drawer.ID, lobby.State.Drawer)
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+	require.Nil(t, lobby.HandlePacket([]byte(fmt.Sprintf(`{"type":"message","data":%q}`, lobby.State.CurrentWord)), guesser))
+
+	require.Len(t, lobby.Turn(2).Ops, 0)
+	gameOver := broadcaster.EventsOfType(game.EventGameOver)
+	require.Len(t, gameOver, 1)
+	require.Equal(t, lobby.TurnSummaries(), gameOver[0].Data)
+	require.Len(t, lobby.TurnSummaries(), 2)
+
+	// The archive survives the lobby being loaded from the store again.
+	game.RemoveLobby(lobby.ID)
+	loaded, err := game.GetLoadLobby(lobby.ID, broadcaster)
+	require.Nil(t, err)
+	require.Equal(t, lobby.TurnSummaries(), loaded.TurnSummaries())
+	require.Equal(t, turn.Drawing, loaded.Turn(1).Drawing)
+
+	// Snapshots of lobbies running elsewhere include the archive, but no
+	// recording.
+	snapshot, err := game.LoadLobbySnapshot(context.Background(), lobby.ID)
+	require.Nil(t, err)
+	require.Equal(t, lobby.TurnSummaries(), snapshot.TurnSummaries())
+	require.Nil(t, snapshot.Recording())
+
+	// Concurrent requests for a lobby that isn't running share one instance.
+	game.RemoveLobby(lobby.ID)
+	loadedLobbies := make(chan *game.Lobby, 4)
+	for i := 0; i < cap(loadedLobbies); i++ {
+		go func() {
+			loaded, _ := game.GetLoadLobby(lobby.ID, broadcaster)
+			loadedLobbies <- loaded
+		}()
+	}
+	loaded = <-loadedLobbies
+	require.NotNil(t, loaded)
+	for i := 1; i < cap(loadedLobbies); i++ {
+		require.Same(t, loaded, <-loadedLobbies)
+	}
+	require.Same(t, loaded, game.GetLobby(lobby.ID))
+}
+
+func TestLateJoinersReceiveSnapshots(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultWindow := game.DrawBatchWindow
+	defaultThreshold, defaultKeep := game.SnapshotThreshold, game.SnapshotKeepGestures
+	game.DrawBatchWindow = 0
+	game.SnapshotThreshold, game.SnapshotKeepGestures = 7, 2
+	var lobby *game.Lobby
+	var rendered []int
+	game.SnapshotRenderer = func(ops []*game.Packet) ([]byte, error) {
+		// Rendering mustn't block the lobby.
+		unlocked := make(chan struct{})
+		go func() {
+			lobby.Drawing()
+			close(unlocked)
+		}()
+		select {
+		case <-unlocked:
+		case <-time.After(time.Second):
+			t.Error("snapshot rendered while holding the lobby lock")
+		}
+		rendered = append(rendered, len(ops))
+		return []byte("png"), nil
+	}
+	defer func() {
+		game.DrawBatchWindow = defaultWindow
+		game.SnapshotThreshold, game.SnapshotKeepGestures = defaultThreshold, defaultKeep
+		game.SnapshotRenderer = nil
+	}()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.Connect(owner)
+	guest := lobby.JoinPlayer("guest", "guest-session", 0)
+	lobby.Connect(guest)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer := owner
+	if lobby.State.Drawer == guest.ID {
+		drawer = guest
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+
+	drawGesture := func(gesture int) {
+		for x := 0; x < 2; x++ {
+			packet := fmt.Sprintf(`{"type":"line","data":{"fromX":%d,"fromY":0,"toX":%d,"toY":1,"color":"#000000","lineWidth":5,"gestureId":%d}}`, x, x+1, gesture)
+			require.Nil(t, lobby.HandlePacket([]byte(packet), drawer))
+		}
+	}
+	connect := func(player *game.Player) *game.Ready {
+		broadcaster.Reset()
+		lobby.Connect(player)
+		return readyOf(t, broadcaster.EventsOfType(game.EventReady)[0])
+	}
+
+	// Small drawings are sent as they are.
+	drawGesture(1)
+	late := lobby.JoinPlayer("late", "late-session", 0)
+	ready := connect(late)
+	require.Empty(t, ready.Snapshot)
+	require.Len(t, ready.CurrentDrawing, 2)
+
+	// The first two gestures end up in the image, the latest two are sent
+	// as operations.
+	for gesture := 2; gesture <= 4; gesture++ {
+		drawGesture(gesture)
+	}
+	ready = connect(late)
+	require.Equal(t, "data:image/png;base64,cG5n", ready.Snapshot)
+	require.Len(t, ready.CurrentDrawing, 4)
+	require.Equal(t, []int{4}, rendered)
+
+	// The image is reused while only a few operations have been added.
+	drawGesture(5)
+	later := lobby.JoinPlayer("later", "later-session", 0)
+	ready = connect(later)
+	require.Equal(t, "data:image/png;base64,cG5n", ready.Snapshot)
+	require.Len(t, ready.CurrentDrawing, 6)
+	require.Equal(t, []int{4}, rendered)
+
+	drawGesture(6)
+	ready = connect(later)
+	require.Len(t, ready.CurrentDrawing, 4)
+	require.Equal(t, []int{4, 8}, rendered)
+
+	// The drawer has to be able to undo everything.
+	ready = connect(drawer)
+	require.Empty(t, ready.Snapshot)
+	require.Len(t, ready.CurrentDrawing, 12)
+}
+
+func TestFinishedLinesAreSimplified(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultWindow, defaultTolerance := game.DrawBatchWindow, game.SimplifyTolerance
+	game.DrawBatchWindow, game.SimplifyTolerance = 0, 1
+	defer func() { game.DrawBatchWindow, game.SimplifyTolerance = defaultWindow, defaultTolerance }()
+
+	broadcaster := game.NewRecordingBroadcaster()
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      5,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.Connect(owner)
+	guest := lobby.JoinPlayer("guest", "guest-session", 0)
+	lobby.Connect(guest)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer := owner
+	if lobby.State.Drawer == guest.ID {
+		drawer = guest
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":0}`), drawer))
+
+	send := func(packet string) {
+		require.Nil(t, lobby.HandlePacket([]byte(packet), drawer), packet)
+	}
+	drawLine := func(gesture, y, segments int) {
+		for x := 0; x < segments; x++ {
+			send(fmt.Sprintf(`{"type":"line","data":{"fromX":%d,"fromY":%d,"toX":%d,"toY":%d,"color":"#000000","lineWidth":5,"gestureId":%d}}`, x, y, x+1, y, gesture))
+		}
+	}
+	storedOps := func() int {
+		drawing, err := game.Store.LoadDrawing(context.Background(), lobby.ID)
+		require.Nil(t, err)
+		require.Equal(t, lobby.CurrentDrawing.CurrentDrawing, drawing.CurrentDrawing)
+		return len(drawing.CurrentDrawing)
+	}
+
+	// The line being drawn is kept as it is.
+	drawLine(1, 10, 10)
+	require.Equal(t, 10, storedOps())
+
+	// Once the next line is started, the first one is a single segment.
+	drawLine(2, 20, 5)
+	require.Equal(t, 6, storedOps())
+	line := &game.Line{}
+	require.Nil(t, json.Unmarshal(lobby.CurrentDrawing.CurrentDrawing[0].Data, line))
+	require.Equal(t, game.Line{FromX: 0, FromY: 10, ToX: 10, ToY: 10, Color: "#000000", LineWidth: 5, GestureID: 1}, *line)
+
+	// The other players still got every segment, which they undo as a
+	// whole, no matter how many operations are stored.
+	forwarded := map[string][]string{}
+	for _, event := range broadcaster.Events() {
+		if packet, ok := event.Data.(*game.Packet); ok {
+			forwarded[packet.Type] = append(forwarded[packet.Type], string(packet.Data))
+		}
+	}
+	require.Len(t, forwarded[game.EventLine], 15)
+
+	broadcaster.Reset()
+	send(`{"type":"undo"}`)
+	send(`{"type":"undo"}`)
+	var undos []string
+	for _, event := range broadcaster.Events() {
+		undos = append(undos, string(event.Data.(*game.Packet).Data))
+	}
+	require.Equal(t, []string{"5", "1"}, undos)
+	require.Equal(t, 0, storedOps())
+}
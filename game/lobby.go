@@ -1,7 +1,10 @@
 package game
 
 import (
+	"fmt"
 	"math/rand"
+	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/vmihailenco/msgpack"
@@ -17,11 +20,37 @@ type Lobby struct {
 
 	State *LobbyState
 
+	// mu serializes everything that changes the lobby, the packets of the
+	// players, connecting and disconnecting them and the timers of turns,
+	// draw batches and replays.
+	mu sync.Mutex
+	// removed is set once the lobby has been removed from the list of
+	// running lobbies, its state isn't saved anymore.
+	removed bool
+
 	// calculated on init
+	broadcaster Broadcaster
+	events      *EventLog
+	drawBatch   *drawBatch
+	// undone are the gestures removed by undo, latest last, which can be
+	// restored by redo.
+	undone [][]*Packet
+	// turnStart and turnOps log the changes of the drawing during the
+	// current turn, finished turns are kept in turns.
+	turnStart             time.Time
+	turnOps               []*TimedDrawOp
+	turnGuessers          []string
+	turnsMu               sync.Mutex
+	turns                 []*Turn
+	lastActivity          int64 // unix timestamp, accessed atomically
 	words                 []string
 	scoreEarnedByGuessers int
 	alreadyUsedWords      []string
 	turnDone              chan struct{}
+	recording             *Recording
+	snapshot              drawingSnapshot
+	// replay is set for read-only lobbies playing back a recording.
+	replay *replay
 }
 
 func (m *Lobby) MarshalBinary() ([]byte, error) {
@@ -34,6 +63,8 @@ func (m *Lobby) UnmarshalBinary(data []byte) error {
 }
 
 type LobbySettings struct {
+	Language          string
+	Public            bool
 	DrawingTime       int
 	Rounds            int
 	MaxPlayers        int
@@ -89,6 +120,21 @@ type LobbyDrawing struct {
 	CurrentDrawing []*Packet
 }
 
+// CompactDrawOps applies all undo packets contained in the given draw log and
+// returns only the operations that are still visible. Logs written before
+// undos were compacted in the store still contain these packets.
+func CompactDrawOps(ops []*Packet) []*Packet {
+	compacted := make([]*Packet, 0, len(ops))
+	for _, op := range ops {
+		if op.Type != PacketUndo {
+			compacted = append(compacted, op)
+		} else if len(compacted) > 0 {
+			compacted = compacted[:len(compacted)-1]
+		}
+	}
+	return compacted
+}
+
 // SettingBounds defines the lower and upper bounds for the user-specified
 // lobby creation input.
 type SettingBounds struct {
@@ -134,8 +180,10 @@ type Rounds struct {
 }
 
 // NewLobby allows creating a lobby, optionally returning errors that
-// occured during creation.
-func NewLobby(ownerName, session, language string, avatarId int, settings LobbySettings) (*Player, *Lobby, error) {
+// occured during creation. All events of the lobby are sent via the given
+// broadcaster.
+func NewLobby(ownerName, session, language string, avatarId int, settings LobbySettings, broadcaster Broadcaster) (*Player, *Lobby, error) {
+	settings.Language = language
 
 	lobby := &Lobby{
 		ID: uuid.NewV4().String(),
@@ -146,7 +194,11 @@ func NewLobby(ownerName, session, language string, avatarId int, settings LobbyS
 		},
 		CurrentDrawing: &LobbyDrawing{CurrentDrawing: []*Packet{}},
 		turnDone:       make(chan struct{}),
+		broadcaster:    broadcaster,
+		events:         NewEventLog(EventLogSize),
+		drawBatch:      newDrawBatch(),
 	}
+	lobby.touch()
 
 	if len(settings.CustomWords) > 1 {
 		rand.Shuffle(len(lobby.Settings.CustomWords), func(i, j int) {
@@ -162,6 +214,7 @@ func NewLobby(ownerName, session, language string, avatarId int, settings LobbyS
 
 	lobby.State.Players[player.ID] = player
 	lobby.State.Owner = player.ID
+	lobby.startRecording()
 
 	// Read wordlist according to the chosen language
 	words, err := readWordList(language)
@@ -172,7 +225,13 @@ func NewLobby(ownerName, session, language string, avatarId int, settings LobbyS
 
 	lobby.words = words
 
-	Store.Save(lobby)
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	err = Store.Save(ctx, lobby)
+	if err != nil {
+		fmt.Println("store Save error:", err)
+	}
 
 	return player, lobby, nil
 }
@@ -6,13 +6,21 @@ import (
 	"html"
 	"log"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/Bios-Marcel/discordemojimap"
 )
 
 // RemoveLobby deletes a lobby, not allowing anyone to connect to it again.
+// Once it returns, the timers of the lobby don't change it anymore.
 func RemoveLobby(id string) {
+	lobbiesMu.Lock()
+	defer lobbiesMu.Unlock()
+	removeLobbyLocked(id)
+}
+
+func removeLobbyLocked(id string) {
 	indexToDelete := -1
 	for index, l := range lobbies {
 		if l.ID == id {
@@ -21,59 +29,201 @@ func RemoveLobby(id string) {
 	}
 
 	if indexToDelete != -1 {
+		lobbies[indexToDelete].stop()
 		lobbies = append(lobbies[:indexToDelete], lobbies[indexToDelete+1:]...)
 	}
 }
 
+// stop makes the pending timers of a removed lobby do nothing, so they
+// neither change it nor its stored state anymore. Timers that are already
+// running are waited for. Players that are still connected don't save the
+// state when they disconnect either.
+func (l *Lobby) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.removed = true
+	// The turn timers and reconnect timers only act during their turn.
+	l.turnDone = make(chan struct{})
+	for _, player := range l.State.Players {
+		player.stopReconnecting()
+	}
+	l.discardDrawOps()
+	if l.replay != nil {
+		l.pauseReplay()
+	}
+}
+
+// SweepLobbies removes all lobbies that have no connected players and haven't
+// seen any activity for LobbyIdleTimeout. Abandoned lobbies are deleted from
+// the store as well, so they can't be loaded again.
+func SweepLobbies() int {
+	// Lobbies are checked and removed at once, so that nobody can connect
+	// to a lobby in between.
+	lobbiesMu.Lock()
+	abandoned := []*Lobby{}
+	kept := lobbies[:0]
+	for _, l := range lobbies {
+		if !l.HasConnectedPlayers() && l.IdleFor() >= LobbyIdleTimeout {
+			l.stop()
+			abandoned = append(abandoned, l)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	lobbies = kept
+	lobbiesMu.Unlock()
+
+	for _, l := range abandoned {
+		ctx, cancel := storeContext()
+		err := Store.Delete(ctx, l.ID)
+		cancel()
+		if err != nil {
+			fmt.Println("store Delete error:", err)
+		}
+	}
+
+	if len(abandoned) > 0 {
+		log.Printf("Swept %d abandoned lobbies.\n", len(abandoned))
+	}
+
+	pruneStoredLobbies()
+
+	return len(abandoned)
+}
+
+// pruneStoredLobbies walks all lobbies of the store, which drops the index
+// entries of lobbies that have expired without being swept, for example
+// because they weren't running on this instance.
+func pruneStoredLobbies() {
+	opts := ListOptions{Limit: 100}
+	for {
+		ctx, cancel := storeContext()
+		page, err := Store.List(ctx, opts)
+		cancel()
+		if err != nil {
+			fmt.Println("store List error:", err)
+			return
+		}
+		if page.Next == 0 {
+			return
+		}
+		opts.Cursor = page.Next
+	}
+}
+
+// RunLobbySweeper calls SweepLobbies every interval until stop is closed.
+func RunLobbySweeper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			SweepLobbies()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// touch marks the lobby as active, postponing its removal by SweepLobbies.
+func (l *Lobby) touch() {
+	atomic.StoreInt64(&l.lastActivity, time.Now().Unix())
+}
+
 func (l *Lobby) JoinPlayer(playerName, session string, avatarId int) *Player {
-	player := createPlayer(playerName, session, avatarId)
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	//FIXME Make a dedicated method that uses a mutex?
+	l.touch()
+	player := createPlayer(playerName, session, avatarId)
 
 	l.State.Players[player.ID] = player
 	l.triggerPlayersUpdate()
 
-	err := Store.SaveState(l.ID, l.State)
-	if err != nil {
-		fmt.Println("store save error:", err)
-	}
+	l.saveState()
 
 	return player
 }
 
 func (l *Lobby) Connect(player *Player) {
-	player.Connected = true
+	l.prepareSnapshot(player)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.connect(player, true)
+}
 
-	players := []*Player{}
-	for _, p := range l.State.Players {
-		players = append(players, p)
+// Resume connects a player whose client has already received all events up
+// to lastSeq of the event log with the given epoch, for example before a
+// short connection loss. Instead of a ready snapshot, the client is sent the
+// events it has missed. If these aren't available anymore, or the lobby has
+// been reloaded since, the player connects like in Connect.
+func (l *Lobby) Resume(player *Player, epoch string, lastSeq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resume(player, epoch, lastSeq)
+}
+
+// ConnectSocket makes the socket the players connection and connects the
+// player, like Resume if lastSeq isn't zero and like Connect otherwise. No
+// event can be sent in between, so the new socket doesn't get any event
+// before the ones it has missed. The previous connection of the player is
+// returned, it isn't closed.
+func (l *Lobby) ConnectSocket(player *Player, socket Socket, epoch string, lastSeq uint64) Socket {
+	if lastSeq == 0 {
+		l.prepareSnapshot(player)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	mutex := player.GetWebsocketMutex()
+	mutex.Lock()
+	previous := player.ws
+	player.ws = socket
+	mutex.Unlock()
+
+	if lastSeq > 0 {
+		l.resume(player, epoch, lastSeq)
+	} else {
+		l.connect(player, true)
 	}
-	readyBytes, err := json.Marshal(&Ready{
-		PlayerID: player.ID,
-		Drawing:  player.State == PlayerStateDrawing,
+	return previous
+}
 
-		OwnerID:        l.State.Owner,
-		Round:          l.State.Round,
-		MaxRound:       l.Settings.Rounds,
-		RoundEndTime:   l.State.RoundEndTime,
-		WordHints:      l.GetAvailableWordHints(player),
-		Players:        players,
-		CurrentDrawing: l.CurrentDrawing.CurrentDrawing,
-	})
-	if err != nil {
-		panic(err)
+func (l *Lobby) resume(player *Player, epoch string, lastSeq uint64) {
+	// The missed events are written while holding the socket lock, before
+	// the player counts as connected again, so that events sent in the
+	// meantime can't overtake them.
+	mutex := player.GetWebsocketMutex()
+	mutex.Lock()
+	missed, resumed := l.events.Since(player.ID, epoch, lastSeq)
+	resumed = resumed && player.ws != nil
+	if resumed {
+		for _, event := range missed {
+			player.ws.WriteJSON(json.RawMessage(event.Data))
+		}
+		player.Connected = true
 	}
+	mutex.Unlock()
 
-	WriteAsJSON(player, Packet{Type: "ready", Data: readyBytes})
+	l.connect(player, !resumed)
+}
 
-	if l.State.Drawer == player.ID {
+func (l *Lobby) connect(player *Player, sendReady bool) {
+	l.touch()
+	player.stopReconnecting()
+	player.setConnected(true)
 
-	}
+	if sendReady {
+		l.sendReady(player)
 
-	//This state is reached when the player refreshes before having chosen a word.
-	if l.State.Drawer == player.ID {
-		l.sendWordChoice()
+		//This state is reached when the player refreshes before having chosen a word.
+		if l.State.Drawer == player.ID && l.State.CurrentWord == "" {
+			l.sendWordChoice()
+		}
 	}
+
 	if l.State.Drawer != "" {
 		l.triggerPlayersUpdate()
 		return
@@ -86,88 +236,302 @@ func (l *Lobby) Connect(player *Player) {
 
 	l.triggerPlayersUpdate()
 
-	err = Store.SaveState(l.ID, l.State)
+	l.saveState()
+	return
+}
+
+func (l *Lobby) sendReady(player *Player) {
+	if l.replay != nil {
+		l.sendReplayReady(player)
+		return
+	}
+
+	players := []*Player{}
+	for _, p := range l.State.Players {
+		players = append(players, p)
+	}
+	// The drawer undoes gestures on their own and therefore needs all
+	// operations.
+	snapshot, ops := "", l.CurrentDrawing.CurrentDrawing
+	if player.State != PlayerStateDrawing {
+		snapshot, ops = l.snapshotDrawing(ops)
+	}
+	readyBytes, err := json.Marshal(&Ready{
+		PlayerID: player.ID,
+		Drawing:  player.State == PlayerStateDrawing,
+
+		OwnerID:        l.State.Owner,
+		Round:          l.State.Round,
+		MaxRound:       l.Settings.Rounds,
+		RoundEndTime:   l.State.RoundEndTime,
+		WordHints:      l.GetAvailableWordHints(player),
+		Players:        players,
+		CurrentDrawing: ops,
+		Snapshot:       snapshot,
+		Epoch:          l.events.Epoch(),
+	})
 	if err != nil {
-		fmt.Println("store save error:", err)
+		panic(err)
 	}
-	return
+
+	l.broadcaster.WriteAsJSON(player, l, Packet{Type: EventReady, Data: readyBytes})
 }
 
 func (l *Lobby) Disconnect(player *Player) {
+	l.mu.Lock()
+	abandoned := l.disconnect(player)
+	l.mu.Unlock()
+
+	if abandoned {
+		l.removeIfAbandoned()
+	}
+}
+
+// disconnect disconnects the player and tells whether nobody is left in the
+// lobby, in which case it should be removed.
+func (l *Lobby) disconnect(player *Player) bool {
 	//We want to avoid calling the handler twice.
 	if player.ws == nil {
-		return
+		return false
 	}
 
+	l.touch()
+	mutex := player.GetWebsocketMutex()
+	mutex.Lock()
 	player.Connected = false
 	player.ws = nil
+	mutex.Unlock()
 
-	err := Store.SaveState(l.ID, l.State)
-	if err != nil {
-		fmt.Println("store save error:", err)
+	isDrawer := l.State.Drawer == player.ID
+	if isDrawer && ReconnectGracePeriod > 0 {
+		player.Reconnecting = true
 	}
 
-	if !l.HasConnectedPlayers() {
-		RemoveLobby(l.ID)
-		log.Printf("There are currently %d open lobbies.\n", len(lobbies))
+	l.saveState()
+
+	if !l.hasConnectedPlayers() && l.replay != nil {
+		// Replays can't be loaded again, so they are kept until they are
+		// swept for being idle.
+		l.pauseReplay()
+	} else if !l.hasConnectedPlayers() {
+		return true
 	} else {
 		l.triggerPlayersUpdate()
 
-		if l.State.Drawer == player.ID {
+		if player.Reconnecting {
+			l.awaitReconnect(player)
+		} else if isDrawer {
 			l.advanceLobby()
 		}
 	}
+	return false
+}
+
+// removeIfAbandoned removes the lobby, unless someone has connected since its
+// last player left. The list of lobbies is locked before the lobby, like in
+// SweepLobbies.
+func (l *Lobby) removeIfAbandoned() {
+	lobbiesMu.Lock()
+	defer lobbiesMu.Unlock()
+
+	if l.HasConnectedPlayers() {
+		return
+	}
+	removeLobbyLocked(l.ID)
+	log.Printf("There are currently %d open lobbies.\n", len(lobbies))
+}
+
+// DisconnectSocket disconnects the player, unless the given socket has
+// already been replaced by a newer connection of the same session, for
+// example from another tab.
+func (l *Lobby) DisconnectSocket(player *Player, socket Socket) {
+	l.mu.Lock()
+	abandoned := player.GetWebsocket() == socket && l.disconnect(player)
+	l.mu.Unlock()
+
+	if abandoned {
+		l.removeIfAbandoned()
+	}
+}
+
+// awaitReconnect gives a drawer whose connection dropped ReconnectGracePeriod
+// to come back, for example after refreshing the page. The turn timer keeps
+// running meanwhile. If the player doesn't return in time, the turn ends.
+func (l *Lobby) awaitReconnect(player *Player) {
+	turnDone := l.turnDone
+	player.reconnectTimer = time.AfterFunc(ReconnectGracePeriod, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// The player is back or the turn has ended regularly.
+		if player.Connected || l.turnDone != turnDone || l.State.Drawer != player.ID {
+			return
+		}
+
+		player.Reconnecting = false
+		l.broadcaster.WritePublicSystemMessage(l, fmt.Sprintf("%s didn't reconnect in time, their turn is over.", player.Name))
+		l.advanceLobby()
+	})
 }
 
 func (l *Lobby) ClearDrawing() {
+	l.discardDrawOps()
 	l.CurrentDrawing.CurrentDrawing = []*Packet{}
+	l.undone = nil
 
-	err := Store.ClearDrawing(l.ID)
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	err := Store.ClearDrawing(ctx, l.ID)
 	if err != nil {
 		fmt.Println("store clear drawing error:", err)
 	}
 }
 
+// sendSystemMessage sends a system message to a single player.
+func (l *Lobby) sendSystemMessage(player *Player, text string) {
+	l.sendString(player, EventSystemMessage, html.EscapeString(text))
+}
+
+// sendString sends an event whose data is a single string to the player.
+func (l *Lobby) sendString(player *Player, eventType, text string) {
+	data, err := json.Marshal(text)
+	if err != nil {
+		panic(err)
+	}
+	l.broadcaster.WriteAsJSON(player, l, Packet{Type: eventType, Data: data})
+}
+
 func (l *Lobby) sendWordChoice() {
 	choiceBytes, err := json.Marshal(l.State.WordChoice)
 	if err != nil {
 		panic(err)
 	}
 	player := l.State.Players[l.State.Drawer]
-	WriteAsJSON(player, &Packet{Type: "your-turn", Data: choiceBytes})
+	l.broadcaster.WriteAsJSON(player, l, &Packet{Type: EventYourTurn, Data: choiceBytes})
 }
 
 // AppendLine adds a line direction to the current drawing. This exists in order
 // to prevent adding arbitrary elements to the drawing, as the backing array is
 // an empty interface type.
 func (l *Lobby) AppendLine(line *Packet) {
-	l.CurrentDrawing.CurrentDrawing = append(l.CurrentDrawing.CurrentDrawing, line)
-
-	err := Store.SaveDrawOp(l.ID, line)
-	if err != nil {
-		fmt.Println("store SaveDrawOp error:", err)
-	}
+	l.appendDrawOps(line)
 }
 
 // AppendFill adds a fill direction to the current drawing. This exists in order
 // to prevent adding arbitrary elements to the drawing, as the backing array is
 // an empty interface type.
 func (l *Lobby) AppendFill(fill *Packet) {
-	l.CurrentDrawing.CurrentDrawing = append(l.CurrentDrawing.CurrentDrawing, fill)
+	l.appendDrawOps(fill)
+}
+
+// appendDrawOps adds line and fill directions to the current drawing and
+// stores them with a single write. Lines that are finished by them are
+// simplified first, unless SimplifyTolerance is zero. The log of the turn
+// still gets every segment, so its timelapse shows how they were drawn.
+func (l *Lobby) appendDrawOps(ops ...*Packet) {
+	l.logDrawOps(ops...)
+	drawing, removed := l.CurrentDrawing.CurrentDrawing, 0
+	if SimplifyTolerance > 0 {
+		drawing, ops, removed = simplifyFinishedGestures(drawing, ops, SimplifyTolerance)
+	}
+	l.CurrentDrawing.CurrentDrawing = append(drawing, ops...)
 
-	err := Store.SaveDrawOp(l.ID, fill)
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	// The simplified line replaces the stored segments.
+	if removed > 0 {
+		err := Store.PopDrawOps(ctx, l.ID, removed)
+		if err != nil {
+			fmt.Println("store PopDrawOps error:", err)
+		}
+	}
+	err := Store.SaveDrawOp(ctx, l.ID, ops...)
 	if err != nil {
 		fmt.Println("store SaveDrawOp error:", err)
 	}
 }
 
-func (l *Lobby) AppendUndo(undo *Packet) {
-	l.CurrentDrawing.CurrentDrawing = l.CurrentDrawing.CurrentDrawing[:len(l.CurrentDrawing.CurrentDrawing)-1]
+// AppendUndo removes the latest gesture from the current drawing, which is
+// either all segments of the latest line or the latest fill. Instead of
+// logging the undo itself, the stored draw log drops these entries as well,
+// so it always matches what the players see. The number of removed
+// operations is returned, zero if the drawing is empty.
+func (l *Lobby) AppendUndo() int {
+	drawing := l.CurrentDrawing.CurrentDrawing
+	start := LastGestureStart(drawing)
+	if start == len(drawing) {
+		return 0
+	}
 
-	err := Store.SaveDrawOp(l.ID, undo)
+	// Copied, as the drawing will be appended to again.
+	removed := append([]*Packet(nil), drawing[start:]...)
+	l.CurrentDrawing.CurrentDrawing = drawing[:start]
+	l.undone = append(l.undone, removed)
+	if len(l.undone) > RedoLimit {
+		l.undone = l.undone[len(l.undone)-RedoLimit:]
+	}
+	l.logUndo(len(removed))
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	err := Store.PopDrawOps(ctx, l.ID, len(removed))
 	if err != nil {
-		fmt.Println("store SaveDrawOp error:", err)
+		fmt.Println("store PopDrawOps error:", err)
+	}
+	return len(removed)
+}
+
+// AppendRedo restores the latest gesture removed by AppendUndo and returns
+// its operations. If there's nothing to restore, nil is returned. Drawing
+// anything new makes the undone gestures unrecoverable.
+func (l *Lobby) AppendRedo() []*Packet {
+	if len(l.undone) == 0 {
+		return nil
 	}
+
+	restored := l.undone[len(l.undone)-1]
+	l.undone = l.undone[:len(l.undone)-1]
+	l.appendDrawOps(restored...)
+	return restored
+}
+
+// LastGestureStart returns the index of the first operation of the latest
+// gesture in the drawing, or the length of the drawing if it is empty. Fills
+// are gestures on their own, lines belong to the same gesture as long as
+// their GestureID is the same.
+func LastGestureStart(ops []*Packet) int {
+	last := len(ops) - 1
+	if last < 0 {
+		return 0
+	}
+
+	gesture, isLine := lineGesture(ops[last])
+	if !isLine {
+		return last
+	}
+	start := last
+	for start > 0 {
+		previous, isLine := lineGesture(ops[start-1])
+		if !isLine || previous != gesture {
+			break
+		}
+		start--
+	}
+	return start
+}
+
+func lineGesture(op *Packet) (int, bool) {
+	if op.Type != PacketLine {
+		return 0, false
+	}
+	line := &Line{}
+	if err := json.Unmarshal(op.Data, line); err != nil {
+		return 0, false
+	}
+	return line.GestureID, true
 }
 
 // NextTurn represents the data necessary for displaying the lobby state right
@@ -180,6 +544,8 @@ type NextTurn struct {
 }
 
 func (l *Lobby) endTurn() {
+	l.recording.endTurn()
+
 	var turnMsg string
 	if l.State.CurrentWord == "" {
 		turnMsg = "Turn over. No word was chosen."
@@ -197,6 +563,10 @@ func (l *Lobby) endTurn() {
 		}
 	}
 
+	//Whatever the drawer drew last still belongs to this turn.
+	l.flushDrawOps()
+	l.archiveTurn()
+
 	l.scoreEarnedByGuessers = 0
 	l.alreadyUsedWords = append(l.alreadyUsedWords, l.State.CurrentWord)
 	l.State.CurrentWord = ""
@@ -212,7 +582,7 @@ func (l *Lobby) endTurn() {
 		}
 	}
 
-	WritePublicSystemMessage(l, turnMsg)
+	l.broadcaster.WritePublicSystemMessage(l, turnMsg)
 }
 
 func (l *Lobby) advanceLobby() {
@@ -225,10 +595,16 @@ func (l *Lobby) advanceLobby() {
 	l.ClearDrawing()
 	l.turnDone = make(chan struct{})
 
-	p := l.GetPlayerById(l.State.Drawer)
-	if p != nil {
+	p, ok := l.State.Players[l.State.Drawer]
+	if ok {
 		p.Drawn = true
-		p.State = PlayerStateGuessing
+	}
+
+	//Everyone that guessed correctly last turn has to guess again. A drawer
+	//that is still reconnecting has lost their turn anyway.
+	for _, player := range l.State.Players {
+		player.State = PlayerStateGuessing
+		player.stopReconnecting()
 	}
 
 	next := l.nextDrawer()
@@ -248,7 +624,8 @@ func (l *Lobby) advanceLobby() {
 	turnTime := time.Second * time.Duration(l.Settings.DrawingTime)
 	l.State.RoundEndTime = time.Now().Add(turnTime).Unix()
 
-	TriggerComplexUpdateEvent("next-turn", &NextTurn{
+	l.recording.startTurn()
+	l.broadcaster.TriggerComplexUpdateEvent(EventNextTurn, &NextTurn{
 		Round:        l.State.Round,
 		Players:      l.State.Players,
 		RoundEndTime: l.State.RoundEndTime,
@@ -259,10 +636,7 @@ func (l *Lobby) advanceLobby() {
 
 	//We use milliseconds for higher accuracy (noob)
 
-	err := Store.SaveState(l.ID, l.State)
-	if err != nil {
-		fmt.Println("store SaveState error:", err)
-	}
+	l.saveState()
 
 	go func(ch chan struct{}) {
 		turnEnd := time.NewTimer(turnTime)
@@ -271,20 +645,34 @@ func (l *Lobby) advanceLobby() {
 		for {
 			select {
 			case <-turnEnd.C:
-				l.advanceLobby()
+				l.runDuringTurn(ch, l.advanceLobby)
 				return
 			case <-hint1.C:
-				l.nextHint()
+				l.runDuringTurn(ch, l.nextHint)
 			case <-hint2.C:
-				l.nextHint()
+				l.runDuringTurn(ch, l.nextHint)
 			case <-ch:
-				fmt.Printf("Finished turn in round %d at %s", l.State.Round, time.Now())
+				l.mu.Lock()
+				round := l.State.Round
+				l.mu.Unlock()
+				fmt.Printf("Finished turn in round %d at %s", round, time.Now())
 				return
 			}
 		}
 	}(l.turnDone)
 }
 
+// runDuringTurn calls f for a timer of the turn, unless the turn has ended
+// while the timer was waiting for the lobby.
+func (l *Lobby) runDuringTurn(turnDone chan struct{}, f func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.turnDone == turnDone {
+		f()
+	}
+}
+
 func (l *Lobby) nextHint() {
 	tries := 0
 	hints := len(l.State.WordHints)
@@ -303,10 +691,7 @@ func (l *Lobby) nextHint() {
 			return
 		}
 	}
-	err := Store.SaveState(l.ID, l.State)
-	if err != nil {
-		fmt.Println("store SaveState error:", err)
-	}
+	l.saveState()
 
 }
 
@@ -318,7 +703,8 @@ func (l *Lobby) endRound() {
 		// game over
 		l.State.Drawer = ""
 		l.State.Round = 1
-		WritePublicSystemMessage(l, "Game over. Type !start again to start a new round.")
+		l.broadcaster.WritePublicSystemMessage(l, "Game over. Type !start again to start a new round.")
+		l.broadcaster.TriggerComplexUpdateEvent(EventGameOver, l.TurnSummaries(), l)
 	} else {
 		l.State.Round++
 	}
@@ -326,38 +712,37 @@ func (l *Lobby) endRound() {
 
 	fmt.Println("Next round", l.State.Round)
 
-	err := Store.SaveState(l.ID, l.State)
-	if err != nil {
-		fmt.Println("store SaveState error:", err)
-	}
+	l.saveState()
 }
 
 func (l *Lobby) sendMessageToAll(message string, sender *Player) {
-	escaped := html.EscapeString(discordemojimap.Replace(message))
+	chat := Message{
+		Author:  html.EscapeString(sender.Name),
+		Content: html.EscapeString(discordemojimap.Replace(message)),
+	}
+	l.recordChat(chat, false)
 	for _, target := range l.State.Players {
-		data, err := json.Marshal(Message{
-			Author:  html.EscapeString(sender.Name),
-			Content: escaped,
-		})
+		data, err := json.Marshal(chat)
 		if err != nil {
 			panic(err)
 		}
-		WriteAsJSON(target, Packet{Type: "message", Data: data})
+		l.broadcaster.WriteAsJSON(target, l, Packet{Type: EventMessage, Data: data})
 	}
 }
 
 func (l *Lobby) sendMessageToAllNonGuessing(message string, sender *Player) {
-	escaped := html.EscapeString(discordemojimap.Replace(message))
+	chat := Message{
+		Author:  html.EscapeString(sender.Name),
+		Content: html.EscapeString(discordemojimap.Replace(message)),
+	}
+	l.recordChat(chat, true)
 	for _, target := range l.State.Players {
 		if target.State != PlayerStateGuessing {
-			data, err := json.Marshal(Message{
-				Author:  html.EscapeString(sender.Name),
-				Content: escaped,
-			})
+			data, err := json.Marshal(chat)
 			if err != nil {
 				panic(err)
 			}
-			WriteAsJSON(target, Packet{Type: "non-guessing-player-message", Data: data})
+			l.broadcaster.WriteAsJSON(target, l, Packet{Type: EventNonGuessingPlayerMessage, Data: data})
 		}
 	}
 }
@@ -380,12 +765,7 @@ func (l *Lobby) kick(from *Player, toKickID string) {
 	}
 	from.votedForKick[toKickID] = true
 
-	defer func() {
-		err := Store.SaveState(l.ID, l.State)
-		if err != nil {
-			fmt.Println("store SaveState error:", err)
-		}
-	}()
+	defer l.saveState()
 
 	var voteKickCount int
 	for _, p := range l.State.Players {
@@ -401,7 +781,7 @@ func (l *Lobby) kick(from *Player, toKickID string) {
 		votesNeeded = (len(l.State.Players) / 2) + 1
 	}
 
-	WritePublicSystemMessage(l, fmt.Sprintf("(%d/%d) players voted to kick %s", voteKickCount, votesNeeded, playerToKick.Name))
+	l.broadcaster.WritePublicSystemMessage(l, fmt.Sprintf("(%d/%d) players voted to kick %s", voteKickCount, votesNeeded, playerToKick.Name))
 
 	if voteKickCount < votesNeeded {
 		return
@@ -414,10 +794,10 @@ func (l *Lobby) kick(from *Player, toKickID string) {
 		delete(p.votedForKick, toKickID)
 	}
 
-	WritePublicSystemMessage(l, fmt.Sprintf("%s has been kicked from the lobby", playerToKick.Name))
+	l.broadcaster.WritePublicSystemMessage(l, fmt.Sprintf("%s has been kicked from the lobby", playerToKick.Name))
 
 	if l.State.Drawer == toKickID {
-		WritePublicSystemMessage(l, "Since the kicked player has been drawing, none of you will get any points this round.")
+		l.broadcaster.WritePublicSystemMessage(l, "Since the kicked player has been drawing, none of you will get any points this round.")
 		//Since the drawing person has been kicked, that probably means that he/she was trolling, therefore
 		//we redact everyones last earned score.
 		for _, p := range l.State.Players {
@@ -435,7 +815,7 @@ func (l *Lobby) kick(from *Player, toKickID string) {
 		for _, p := range l.State.Players {
 			if p.Connected {
 				l.State.Owner = p.ID
-				WritePublicSystemMessage(l, fmt.Sprintf("%s is the new lobby owner.", p.Name))
+				l.broadcaster.WritePublicSystemMessage(l, fmt.Sprintf("%s is the new lobby owner.", p.Name))
 				break
 			}
 		}
@@ -444,6 +824,10 @@ func (l *Lobby) kick(from *Player, toKickID string) {
 	// triggers Disconnect events to advance lobby.
 	if playerToKick.ws != nil {
 		playerToKick.ws.Close()
+	} else if playerToKick.Reconnecting {
+		// There is nobody left to disconnect, don't wait for the drawer.
+		playerToKick.stopReconnecting()
+		l.advanceLobby()
 	}
 }
 
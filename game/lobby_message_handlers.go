@@ -36,7 +36,8 @@ func (l *Lobby) handleMessage(input string, from *Player) {
 			from.Score += from.LastScore
 			l.scoreEarnedByGuessers += from.LastScore
 			from.State = PlayerStateStandby
-			WriteAsJSON(from, Packet{Type: "system-message", Data: []byte("You have correctly guessed the word.")})
+			l.turnGuessers = append(l.turnGuessers, from.Name)
+			l.sendSystemMessage(from, "You have correctly guessed the word.")
 
 			if !l.isAnyoneStillGuessing() {
 				l.advanceLobby()
@@ -47,14 +48,14 @@ func (l *Lobby) handleMessage(input string, from *Player) {
 				}
 
 				//Since the word has been guessed correctly, we reveal it.
-				WriteAsJSON(from, Packet{Type: "update-wordhint", Data: bytes})
+				l.broadcaster.WriteAsJSON(from, l, Packet{Type: EventUpdateWordHint, Data: bytes})
 				l.triggerCorrectGuessEvent()
 				l.triggerPlayersUpdate()
 			}
 
 			return
 		} else if levenshtein.ComputeDistance(lowerCasedInput, lowerCasedSearched) == 1 {
-			WriteAsJSON(from, Packet{Type: "system-message", Data: []byte(fmt.Sprintf("'%s' is very close.", trimmed))})
+			l.sendSystemMessage(from, fmt.Sprintf("'%s' is very close.", trimmed))
 		}
 
 		l.sendMessageToAll(trimmed, from)
@@ -78,7 +79,7 @@ func (l *Lobby) handleCommand(commandString string, caller *Player) {
 func (l *Lobby) commandNick(from *Player, args []string) {
 	if len(args) == 1 {
 		from.Name = GeneratePlayerName()
-		WriteAsJSON(from, Packet{Type: "reset-username"})
+		l.broadcaster.WriteAsJSON(from, l, Packet{Type: EventResetUsername})
 		l.triggerPlayersUpdate()
 	} else {
 		//We join all arguments, since people won't sue quotes either way.
@@ -86,7 +87,7 @@ func (l *Lobby) commandNick(from *Player, args []string) {
 		newName := html.EscapeString(strings.TrimSpace(strings.Join(args[1:], " ")))
 		if len(newName) == 0 {
 			from.Name = GeneratePlayerName()
-			WriteAsJSON(from, Packet{Type: "reset-username"})
+			l.broadcaster.WriteAsJSON(from, l, Packet{Type: EventResetUsername})
 		} else {
 			fmt.Printf("%s is now %s\n", from.Name, newName)
 			//We don't want super-long names
@@ -94,7 +95,7 @@ func (l *Lobby) commandNick(from *Player, args []string) {
 				newName = newName[:31]
 			}
 			from.Name = newName
-			WriteAsJSON(from, Packet{Type: "persist-username", Data: []byte(newName)})
+			l.sendString(from, EventPersistUsername, newName)
 		}
 		l.triggerPlayersUpdate()
 	}
@@ -112,18 +113,18 @@ func (l *Lobby) commandSetMP(from *Player, args []string) {
 			if int(newMaxPlayersValueInt) >= len(l.State.Players) && newMaxPlayersValueInt <= LobbySettingBounds.MaxMaxPlayers && newMaxPlayersValueInt >= LobbySettingBounds.MinMaxPlayers {
 				l.Settings.MaxPlayers = int(newMaxPlayersValueInt)
 
-				WritePublicSystemMessage(l, fmt.Sprintf("MaxPlayers value has been changed to %d", l.Settings.MaxPlayers))
+				l.broadcaster.WritePublicSystemMessage(l, fmt.Sprintf("MaxPlayers value has been changed to %d", l.Settings.MaxPlayers))
 			} else {
 				if len(l.State.Players) > int(LobbySettingBounds.MinMaxPlayers) {
-					WriteAsJSON(from, Packet{Type: "system-message", Data: []byte(fmt.Sprintf("MaxPlayers value should be between %d and %d.", len(l.State.Players), LobbySettingBounds.MaxMaxPlayers))})
+					l.sendSystemMessage(from, fmt.Sprintf("MaxPlayers value should be between %d and %d.", len(l.State.Players), LobbySettingBounds.MaxMaxPlayers))
 				} else {
-					WriteAsJSON(from, Packet{Type: "system-message", Data: []byte(fmt.Sprintf("MaxPlayers value should be between %d and %d.", LobbySettingBounds.MinMaxPlayers, LobbySettingBounds.MaxMaxPlayers))})
+					l.sendSystemMessage(from, fmt.Sprintf("MaxPlayers value should be between %d and %d.", LobbySettingBounds.MinMaxPlayers, LobbySettingBounds.MaxMaxPlayers))
 				}
 			}
 		} else {
-			WriteAsJSON(from, Packet{Type: "system-message", Data: []byte(fmt.Sprintf("MaxPlayers value must be numeric."))})
+			l.sendSystemMessage(from, "MaxPlayers value must be numeric.")
 		}
 	} else {
-		WriteAsJSON(from, Packet{Type: "system-message", Data: []byte(fmt.Sprintf("Only the lobby owner can change MaxPlayers setting."))})
+		l.sendSystemMessage(from, "Only the lobby owner can change MaxPlayers setting.")
 	}
 }
@@ -2,9 +2,6 @@ package game
 
 import (
 	"encoding/json"
-	"errors"
-
-	"fmt"
 	"log"
 	"strings"
 
@@ -22,14 +19,16 @@ type packetHandler = func(p *Packet, bytes []byte, from *Player) error
 // routes helper function
 func (l *Lobby) routes() map[string]packetHandler {
 	return map[string]packetHandler{
-		"start":               l.start,
-		"message":             l.message,
-		"choose-word":         l.isStartedMiddleware(l.chooseWord),
-		"kick-vote":           l.isStartedMiddleware(l.kickVote),
-		"line":                l.isStartedMiddleware(l.canDrawMiddleware(l.line)),
-		"fill":                l.isStartedMiddleware(l.canDrawMiddleware(l.fill)),
-		"undo":                l.isStartedMiddleware(l.canDrawMiddleware(l.undo)),
-		"clear-drawing-board": l.isStartedMiddleware(l.canDrawMiddleware(l.clearDrawingBoard)),
+		PacketStart:             l.start,
+		PacketMessage:           l.message,
+		PacketChooseWord:        l.isStartedMiddleware(l.chooseWord),
+		PacketKickVote:          l.isStartedMiddleware(l.kickVote),
+		PacketLine:              l.isStartedMiddleware(l.canDrawMiddleware(l.line)),
+		PacketFill:              l.isStartedMiddleware(l.canDrawMiddleware(l.fill)),
+		PacketUndo:              l.isStartedMiddleware(l.canDrawMiddleware(l.undo)),
+		PacketRedo:              l.isStartedMiddleware(l.canDrawMiddleware(l.redo)),
+		PacketClearDrawingBoard: l.isStartedMiddleware(l.canDrawMiddleware(l.clearDrawingBoard)),
+		PacketReplayControl:     l.isReplayMiddleware(l.replayControl),
 	}
 }
 
@@ -37,7 +36,7 @@ func (l *Lobby) routes() map[string]packetHandler {
 func (l *Lobby) isStartedMiddleware(handler packetHandler) packetHandler {
 	return func(p *Packet, bytes []byte, from *Player) error {
 		if l.State.Round == 0 {
-			return errors.New("game not started")
+			return newPacketError(ErrorGameNotStarted, p.Type, "the game hasn't been started yet")
 		}
 		return handler(p, bytes, from)
 	}
@@ -47,36 +46,61 @@ func (l *Lobby) isStartedMiddleware(handler packetHandler) packetHandler {
 func (l *Lobby) canDrawMiddleware(handler packetHandler) packetHandler {
 	return func(p *Packet, bytes []byte, from *Player) error {
 		if !l.canDraw(from) {
-			return errors.New("player cannot draw")
+			return newPacketError(ErrorCannotDraw, p.Type, "it's not your turn to draw")
+		}
+		return handler(p, bytes, from)
+	}
+}
+
+// isReplayMiddleware accepts messages only in replay lobbies
+func (l *Lobby) isReplayMiddleware(handler packetHandler) packetHandler {
+	return func(p *Packet, bytes []byte, from *Player) error {
+		if l.replay == nil {
+			return newPacketError(ErrorNotReplay, p.Type, "the lobby isn't a replay")
 		}
 		return handler(p, bytes, from)
 	}
 }
 
+// HandlePacket handles a packet sent by the player. If the packet is
+// rejected, the player is sent an "error" event and the *PacketError is
+// returned.
 func (l *Lobby) HandlePacket(bytes []byte, from *Player) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
 	p := &Packet{}
 	err := json.Unmarshal(bytes, p)
 	if err != nil {
 		log.Printf("json unmarshal error from websocket: %s\n", err)
+		err = newPacketError(ErrorInvalidPacket, "", "error decoding packet: %s", err)
+		l.sendError(from, "", err)
 		return err
 	}
 
 	pretty.Println(p.Type, string(p.Data))
+	l.touch()
 
 	handler, ok := l.routes()[p.Type]
 	if !ok {
-		return fmt.Errorf("handler not found %s", p.Type)
+		err = newPacketError(ErrorUnknownPacketType, p.Type, "unknown packet type '%s'", p.Type)
+	} else if l.replay != nil && p.Type != PacketReplayControl {
+		err = newPacketError(ErrorReadOnly, p.Type, "replays can only be watched")
+	} else {
+		err = handler(p, bytes, from)
 	}
 
-	return handler(p, bytes, from)
+	if err != nil {
+		l.sendError(from, p.Type, err)
+	}
+	return err
 }
 
 func (l *Lobby) message(p *Packet, bytes []byte, from *Player) error {
 	text := ""
 	err := json.Unmarshal(p.Data, &text)
 	if err != nil {
-		return fmt.Errorf("error decoding message data: %s", err)
+		return newPacketError(ErrorInvalidData, p.Type, "error decoding message data: %s", err)
 	}
 
 	if strings.HasPrefix(text, "!") {
@@ -91,13 +115,20 @@ func (l *Lobby) line(p *Packet, bytes []byte, from *Player) error {
 	line := &Line{}
 	err := json.Unmarshal(p.Data, &line)
 	if err != nil {
-		return fmt.Errorf("error decoding line data: %s", err)
+		return newPacketError(ErrorInvalidData, p.Type, "error decoding line data: %s", err)
+	}
+	err = line.validate()
+	if err != nil {
+		return newPacketError(ErrorInvalidData, p.Type, "invalid line: %s", err)
 	}
-	l.AppendLine(p)
-
-	//We directly forward the event, as it seems to be valid.
-	SendDataToOtherPlayers(from, l, p)
 
+	//Only the validated fields are passed on, anything else the client
+	//sent along is dropped.
+	p.Data, err = json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	l.queueDrawOp(from, p)
 	return nil
 }
 
@@ -106,26 +137,58 @@ func (l *Lobby) fill(p *Packet, bytes []byte, from *Player) error {
 	fill := &Fill{}
 	err := json.Unmarshal(p.Data, &fill)
 	if err != nil {
-		return fmt.Errorf("error decoding fill data: %s", err)
+		return newPacketError(ErrorInvalidData, p.Type, "error decoding fill data: %s", err)
+	}
+	err = fill.validate()
+	if err != nil {
+		return newPacketError(ErrorInvalidData, p.Type, "invalid fill: %s", err)
 	}
-	l.AppendFill(p)
 
-	//We directly forward the event, as it seems to be valid.
-	SendDataToOtherPlayers(from, l, p)
+	//Only the validated fields are passed on, anything else the client
+	//sent along is dropped.
+	p.Data, err = json.Marshal(fill)
+	if err != nil {
+		return err
+	}
+	l.queueDrawOp(from, p)
 	return nil
 
 }
 func (l *Lobby) undo(p *Packet, bytes []byte, from *Player) error {
 
-	l.AppendUndo(p)
-	SendDataToOtherPlayers(from, l, p)
+	l.flushDrawOps()
+	removed := l.AppendUndo()
+	//Undoing on an empty board doesn't change anything.
+	if removed == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(removed)
+	if err != nil {
+		return err
+	}
+	l.broadcaster.SendDataToOtherPlayers(from, l, &Packet{Type: EventUndo, Data: data})
 	return nil
 
 }
 
+func (l *Lobby) redo(p *Packet, bytes []byte, from *Player) error {
+	l.flushDrawOps()
+	restored := l.AppendRedo()
+	if restored == nil {
+		return nil
+	}
+
+	//The drawer is sent the restored gesture as well, so that clients don't
+	//have to remember what they have undone.
+	l.broadcaster.TriggerComplexUpdateEvent(EventRedo, restored, l)
+	return nil
+}
+
 func (l *Lobby) clearDrawingBoard(p *Packet, bytes []byte, from *Player) error {
 	l.ClearDrawing()
-	SendDataToOtherPlayers(from, l, p)
+	l.logDrawOps(p)
+	l.broadcaster.SendDataToOtherPlayers(from, l, p)
 	return nil
 }
 
@@ -133,17 +196,32 @@ func (l *Lobby) chooseWord(p *Packet, bytes []byte, from *Player) error {
 	chosenIndex := 0
 	err := json.Unmarshal(p.Data, &chosenIndex)
 	if err != nil {
-		return fmt.Errorf("error decoding chosen word data: %s", err)
+		return newPacketError(ErrorInvalidData, p.Type, "error decoding chosen word data: %s", err)
+	}
+
+	if from.ID != l.State.Drawer {
+		return newPacketError(ErrorNotDrawer, p.Type, "only the drawer can choose a word")
 	}
 
-	drawer := l.State.Drawer
-	if from.ID == drawer && len(l.State.WordChoice) > 0 && chosenIndex >= 0 && chosenIndex <= 2 {
-		l.State.CurrentWord = l.State.WordChoice[chosenIndex]
-		l.State.WordChoice = nil
-		l.State.WordHints = createWordHintFor(l.State.CurrentWord, false)
-		l.State.WordHintsShown = createWordHintFor(l.State.CurrentWord, true)
-		l.triggerWordHintUpdate()
+	//Choosing again after a word has been chosen is ignored.
+	if len(l.State.WordChoice) == 0 {
+		return nil
 	}
+	if chosenIndex < 0 || chosenIndex >= len(l.State.WordChoice) {
+		return newPacketError(ErrorInvalidData, p.Type, "there is no word number %d to choose from", chosenIndex)
+	}
+
+	l.State.CurrentWord = l.State.WordChoice[chosenIndex]
+	l.recording.add(RecordWordChoice, &RecordedWordChoice{
+		Drawer:  from.ID,
+		Choices: l.State.WordChoice,
+		Word:    l.State.CurrentWord,
+	})
+	l.State.WordChoice = nil
+	l.State.WordHints = createWordHintFor(l.State.CurrentWord, false)
+	l.State.WordHintsShown = createWordHintFor(l.State.CurrentWord, true)
+	l.startTurnLog()
+	l.triggerWordHintUpdate()
 	return nil
 
 }
@@ -171,32 +249,33 @@ func (l *Lobby) kickVote(p *Packet, bytes []byte, from *Player) error {
 	toKickID := ""
 	err := json.Unmarshal(p.Data, &toKickID)
 	if err != nil {
-		return fmt.Errorf("error decoding kick-vote data: %s", err)
+		return newPacketError(ErrorInvalidData, p.Type, "error decoding kick-vote data: %s", err)
 	}
 
 	if !l.Settings.EnableVotekick {
-		// Votekicking is disabled in the lobby
-		// We tell the user and do not continue with the event
-		WriteAsJSON(from, Packet{Type: "system-message", Data: []byte("Votekick is disabled in this lobby!")})
-	} else {
-		l.kick(from, toKickID)
+		return newPacketError(ErrorVotekickDisabled, p.Type, "Votekick is disabled in this lobby!")
 	}
 
+	l.kick(from, toKickID)
 	return nil
 }
 
 func (l *Lobby) start(p *Packet, bytes []byte, from *Player) error {
+	if from.ID != l.State.Owner {
+		return newPacketError(ErrorNotOwner, p.Type, "only the lobby owner can start the game")
+	}
+	if l.State.Started {
+		return newPacketError(ErrorGameAlreadyStarted, p.Type, "the game is already running")
+	}
 
-	if !l.State.Started && from.ID == l.State.Owner {
-		for _, otherPlayer := range l.State.Players {
-			otherPlayer.Score = 0
-			otherPlayer.LastScore = 0
-		}
-		l.State.Round = 1
-		l.advanceLobby()
-		l.State.Started = true
-
+	for _, otherPlayer := range l.State.Players {
+		otherPlayer.Score = 0
+		otherPlayer.LastScore = 0
 	}
+	l.State.Round = 1
+	l.resetTurns()
+	l.advanceLobby()
+	l.State.Started = true
 
 	return nil
 }
@@ -1,12 +1,18 @@
 package game
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 )
 
 // GetLobby returns a Lobby that has a matching ID or no Lobby if none could
 // be found.
 func GetLobby(id string) *Lobby {
+	lobbiesMu.Lock()
+	defer lobbiesMu.Unlock()
+
 	for _, l := range lobbies {
 		if l.ID == id {
 			return l
@@ -16,20 +22,51 @@ func GetLobby(id string) *Lobby {
 	return nil
 }
 
-func GetLoadLobby(id string) (*Lobby, error) {
+// GetLoadLobby returns the lobby with the given ID, loading it from the Store
+// if it isn't running yet. Loaded lobbies send their events via the given
+// broadcaster.
+func GetLoadLobby(id string, broadcaster Broadcaster) (*Lobby, error) {
 	lobby := GetLobby(id)
 	if lobby != nil {
 		return lobby, nil
 	}
 
-	lobby, err := Store.Load(id)
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	lobby, err := Store.Load(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
+	if lobby.Settings.Language != "" {
+		lobby.words, err = readWordList(lobby.Settings.Language)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	lobby.turnDone = make(chan struct{})
+	lobby.broadcaster = broadcaster
+	lobby.events = NewEventLog(EventLogSize)
+	lobby.drawBatch = newDrawBatch()
+	lobby.touch()
+	lobby.startRecording()
+
+	lobby.turns, err = Store.LoadTurns(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 
 	lobbiesMu.Lock()
+	// Another request might have loaded the lobby in the meantime, there
+	// must never be two running instances of it.
+	for _, l := range lobbies {
+		if l.ID == id {
+			lobbiesMu.Unlock()
+			return l, nil
+		}
+	}
 	lobbies = append(lobbies, lobby)
 	lobbiesMu.Unlock()
 
@@ -40,7 +77,40 @@ func GetLoadLobby(id string) (*Lobby, error) {
 	return lobby, nil
 }
 
+// LoadLobbySnapshot loads a lobby from the Store without running it, together
+// with its finished turns. The snapshot mustn't be modified. It has no
+// recording, as recordings are only kept by the running lobby.
+func LoadLobbySnapshot(ctx context.Context, id string) (*Lobby, error) {
+	lobby, err := Store.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	lobby.turns, err = Store.LoadTurns(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return lobby, nil
+}
+
+// Events returns the log of the events sent to the players of the lobby.
+func (l *Lobby) Events() *EventLog {
+	return l.events
+}
+
+// IdleFor returns the time that has passed since the last activity in the
+// lobby.
+func (l *Lobby) IdleFor() time.Duration {
+	return time.Since(time.Unix(atomic.LoadInt64(&l.lastActivity), 0))
+}
+
 func (l *Lobby) HasConnectedPlayers() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.hasConnectedPlayers()
+}
+
+func (l *Lobby) hasConnectedPlayers() bool {
 	for _, p := range l.State.Players {
 		if p.Connected {
 			return true
@@ -60,6 +130,9 @@ func (l *Lobby) nextDrawer() *Player {
 
 // GetPlayerBySession searches for a player, identifying them by usersession.
 func (l *Lobby) GetPlayerBySession(userSession string) *Player {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	for _, player := range l.State.Players {
 		if player.UserSession == userSession {
 			return player
@@ -71,6 +144,9 @@ func (l *Lobby) GetPlayerBySession(userSession string) *Player {
 
 // GetPlayer searches for a player, identifying them by usersession.
 func (l *Lobby) GetPlayerById(id string) *Player {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	for _id, player := range l.State.Players {
 		if id == _id {
 			return player
@@ -80,6 +156,15 @@ func (l *Lobby) GetPlayerById(id string) *Player {
 	return nil
 }
 
+// Drawing returns a copy of the operations of the current drawing, which can
+// be used without holding the lock of the lobby.
+func (l *Lobby) Drawing() []*Packet {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]*Packet{}, l.CurrentDrawing.CurrentDrawing...)
+}
+
 func (l *Lobby) GetAvailableWordHints(player *Player) []*WordHint {
 	//The draw simple gets every character as a word-hint. We basically abuse
 	//the hints for displaying the word, instead of having yet another GUI
@@ -106,6 +191,9 @@ func (l *Lobby) isAnyoneStillGuessing() bool {
 }
 
 func (l *Lobby) IsFull() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	numNeeded := l.Settings.MaxPlayers
 
 	for _, p := range l.State.Players {
@@ -1,11 +1,12 @@
 package game
 
 import (
+	"net"
 	"strings"
 	"sync"
+	"time"
 
 	petname "github.com/dustinkirkland/golang-petname"
-	"github.com/gorilla/websocket"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -19,15 +20,28 @@ const (
 	PlayerStateStandby
 )
 
+// Socket is the connection to a players client. Usually this is the players
+// websocket, but it can also be a connection relayed from another server
+// instance.
+type Socket interface {
+	WriteJSON(v interface{}) error
+	Close() error
+	RemoteAddr() net.Addr
+}
+
 // Player represents a participant in a Lobby.
 type Player struct {
 	// userSession uniquely identifies the player.
 	UserSession string `json:"-"`
-	ws          *websocket.Conn
+	ws          Socket
 	wsMu        *sync.Mutex
 
 	votedForKick map[string]bool
 
+	// reconnectTimer forfeits the players turn if they don't reconnect in
+	// time, see Reconnecting.
+	reconnectTimer *time.Timer
+
 	// ID uniquely identified the Player.
 	ID string `json:"id"`
 	// Name is the players displayed name
@@ -42,7 +56,10 @@ type Player struct {
 	// While checking the websocket against nil would be enough, we still need
 	// this field for sending it via the APIs.
 	Connected bool `json:"connected"`
-	Drawn     bool `json:"drawn"`
+	// Reconnecting is set while a drawer whose connection dropped still has
+	// the chance to come back and continue their turn.
+	Reconnecting bool `json:"reconnecting"`
+	Drawn        bool `json:"drawn"`
 
 	// Rank is the current ranking of the player in his Lobby
 	LastScore int         `json:"lastScore"`
@@ -74,12 +91,12 @@ func (p *Player) GetSession() string {
 // GetWebsocket simply returns the players websocket connection. This method
 // exists to encapsulate the websocket field and prevent accidental sending
 // the websocket data via the network.
-func (player *Player) GetWebsocket() *websocket.Conn {
+func (player *Player) GetWebsocket() Socket {
 	return player.ws
 }
 
 // SetWebsocket sets the given connection as the players websocket connection.
-func (player *Player) SetWebsocket(socket *websocket.Conn) {
+func (player *Player) SetWebsocket(socket Socket) {
 	player.ws = socket
 }
 
@@ -95,6 +112,31 @@ func (player *Player) SetWebsocketMutex(mu *sync.Mutex) {
 	player.wsMu = mu
 }
 
+// IsConnected tells whether the player is connected. Unlike reading
+// Connected, it is safe to call while the lobby is running.
+func (player *Player) IsConnected() bool {
+	player.wsMu.Lock()
+	defer player.wsMu.Unlock()
+	return player.Connected
+}
+
+// setConnected updates Connected while holding the socket lock, which is
+// also held when checking it before writing to the socket.
+func (player *Player) setConnected(connected bool) {
+	player.wsMu.Lock()
+	player.Connected = connected
+	player.wsMu.Unlock()
+}
+
+// stopReconnecting cancels a pending forfeit of the players turn.
+func (player *Player) stopReconnecting() {
+	if player.reconnectTimer != nil {
+		player.reconnectTimer.Stop()
+		player.reconnectTimer = nil
+	}
+	player.Reconnecting = false
+}
+
 // GeneratePlayerName creates a new playername. A so called petname. It consists
 // of an adverb, an adjective and a animal name. The result can generally be
 // trusted to be sane.
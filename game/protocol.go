@@ -0,0 +1,237 @@
+package game
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// ProtocolVersion is the version of the websocket protocol spoken by the
+// server. It is increased whenever messages change in a way that old clients
+// can't cope with. See PROTOCOL.md.
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest protocol version the server still
+// supports. Clients that don't announce a version speak the legacy version
+// 0, which isn't supported anymore.
+const MinProtocolVersion = 1
+
+// LegacyProtocolVersion is the version of clients from before versioning,
+// which don't announce one.
+const LegacyProtocolVersion = 0
+
+// DrawBatchProtocolVersion is the first protocol version with draw-batch
+// events. Connections speaking an older version receive the line and fill
+// events of a batch one by one.
+const DrawBatchProtocolVersion = 2
+
+// Types of the packets sent by clients
+const (
+	PacketStart             = "start"
+	PacketMessage           = "message"
+	PacketChooseWord        = "choose-word"
+	PacketKickVote          = "kick-vote"
+	PacketLine              = "line"
+	PacketFill              = "fill"
+	PacketUndo              = "undo"
+	PacketRedo              = "redo"
+	PacketClearDrawingBoard = "clear-drawing-board"
+	PacketReplayControl     = "replay-control"
+)
+
+// Types of the events sent to clients
+const (
+	EventHello                    = "hello"
+	EventReady                    = "ready"
+	EventUpdatePlayers            = "update-players"
+	EventNextTurn                 = "next-turn"
+	EventYourTurn                 = "your-turn"
+	EventUpdateWordHint           = "update-wordhint"
+	EventCorrectGuess             = "correct-guess"
+	EventMessage                  = "message"
+	EventNonGuessingPlayerMessage = "non-guessing-player-message"
+	EventSystemMessage            = "system-message"
+	EventResetUsername            = "reset-username"
+	EventPersistUsername          = "persist-username"
+	EventLine                     = "line"
+	EventFill                     = "fill"
+	EventUndo                     = "undo"
+	EventRedo                     = "redo"
+	EventClearDrawingBoard        = "clear-drawing-board"
+	EventDrawBatch                = "draw-batch"
+	EventTurnOver                 = "turn-over"
+	EventGameOver                 = "game-over"
+	EventError                    = "error"
+	EventSessionReplaced          = "session-replaced"
+	EventReplayStatus             = "replay-status"
+)
+
+// Hello is the first event on every connection. It tells the client which
+// protocol version the server speaks.
+type Hello struct {
+	// Version is the protocol version used for this connection.
+	Version int `json:"version"`
+	// MinVersion is the oldest version the server supports.
+	MinVersion int `json:"minVersion"`
+}
+
+// MessageSpec describes a message of the websocket protocol.
+type MessageSpec struct {
+	Type        string
+	Description string
+	// Data is a value of the type of the messages data, nil for messages
+	// without data.
+	Data interface{}
+}
+
+// ClientMessages are all packets the server accepts from clients.
+var ClientMessages = []MessageSpec{
+	{PacketStart, "Starts the game, only allowed for the lobby owner.", nil},
+	{PacketMessage, "A chat message or guess. Messages starting with ! are commands.", ""},
+	{PacketChooseWord, "The index of the word the drawer has chosen from the your-turn choice.", 0},
+	{PacketKickVote, "Votes to kick the player with the given ID.", ""},
+	{PacketLine, "A line drawn by the drawer.", Line{}},
+	{PacketFill, "A fill bucket usage of the drawer.", Fill{}},
+	{PacketUndo, "Removes the latest gesture, meaning a whole line or a fill.", nil},
+	{PacketRedo, "Restores the latest gesture removed by undo.", nil},
+	{PacketClearDrawingBoard, "Clears the drawing.", nil},
+	{PacketReplayControl, "Pauses, resumes, seeks or changes the speed of a replay, only allowed in replay lobbies.", ReplayControl{}},
+}
+
+// ServerMessages are all events the server sends to clients.
+var ServerMessages = []MessageSpec{
+	{EventHello, "First event of every connection, announces the protocol version.", Hello{}},
+	{EventReady, "Snapshot of the lobby, sent after connecting.", Ready{}},
+	{EventUpdatePlayers, "All players of the lobby by ID.", map[string]*Player{}},
+	{EventNextTurn, "A new turn has begun.", NextTurn{}},
+	{EventYourTurn, "The words the drawer may choose from.", []string{}},
+	{EventUpdateWordHint, "The hints for the current word.", []*WordHint{}},
+	{EventCorrectGuess, "Someone has guessed the word.", nil},
+	{EventMessage, "A chat message.", Message{}},
+	{EventNonGuessingPlayerMessage, "A chat message only shown to players that aren't guessing.", Message{}},
+	{EventSystemMessage, "A message from the server, HTML escaped.", ""},
+	{EventResetUsername, "The requested name has been rejected.", nil},
+	{EventPersistUsername, "The players new name, to be remembered by the client.", ""},
+	{EventLine, "A line drawn by the drawer.", Line{}},
+	{EventFill, "A fill bucket usage of the drawer.", Fill{}},
+	{EventUndo, "The latest gesture has been removed, the data is the number of removed operations.", 0},
+	{EventRedo, "The latest undone gesture has been restored, sent to everyone including the drawer.", []Packet{}},
+	{EventClearDrawingBoard, "The drawing has been cleared.", nil},
+	{EventDrawBatch, "Several line and fill events of the drawer, in the order they were drawn.", []Packet{}},
+	{EventTurnOver, "A turn in which a word was chosen has ended, its timelapse can now be downloaded.", TurnSummary{}},
+	{EventGameOver, "The last round has ended, the data are all turns of the game.", []*TurnSummary{}},
+	{EventError, "A packet sent by this client has been rejected.", PacketError{}},
+	{EventSessionReplaced, "The session has been opened in another tab, this connection is closed.", ""},
+	{EventReplayStatus, "The playback of the replay has been changed or has reached the end.", ReplayStatus{}},
+}
+
+// ProtocolSchema describes all messages of the protocol as JSON schema,
+// generated from the Go types of their data.
+func ProtocolSchema() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	messages := func(specs []MessageSpec) map[string]interface{} {
+		schemas := map[string]interface{}{}
+		for _, spec := range specs {
+			properties := map[string]interface{}{
+				"type": map[string]interface{}{"const": spec.Type},
+				"seq":  map[string]interface{}{"type": "integer", "minimum": 1},
+			}
+			if spec.Data != nil {
+				properties["data"] = schemaOf(reflect.TypeOf(spec.Data), definitions)
+			}
+			schemas[spec.Type] = map[string]interface{}{
+				"description": spec.Description,
+				"type":        "object",
+				"required":    []string{"type"},
+				"properties":  properties,
+			}
+		}
+		return schemas
+	}
+
+	return map[string]interface{}{
+		"$schema":            "http://json-schema.org/draft-07/schema#",
+		"title":              "scribble.rs websocket protocol",
+		"protocolVersion":    ProtocolVersion,
+		"minProtocolVersion": MinProtocolVersion,
+		"clientMessages":     messages(ClientMessages),
+		"serverMessages":     messages(ServerMessages),
+		"definitions":        definitions,
+	}
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// schemaOf returns the JSON schema of the type as encoded by encoding/json.
+// Named structs are added to definitions and referenced.
+func schemaOf(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), definitions)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), definitions)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		if _, ok := definitions[t.Name()]; ok {
+			return ref
+		}
+		// Registered before descending, so recursive types terminate.
+		definitions[t.Name()] = nil
+
+		properties := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name, omitEmpty := jsonFieldName(field)
+			if name == "-" {
+				continue
+			}
+			properties[name] = schemaOf(field.Type, definitions)
+			if !omitEmpty {
+				required = append(required, name)
+			}
+		}
+		definitions[t.Name()] = map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+		return ref
+	}
+
+	// Interfaces can hold anything.
+	return map[string]interface{}{}
+}
+
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("json"), ",")
+	name := tag[0]
+	if name == "" {
+		name = field.Name
+	}
+	omitEmpty := false
+	for _, option := range tag[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty
+}
@@ -0,0 +1,60 @@
+package game
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientMessagesMatchRoutes(t *testing.T) {
+	routes := (&Lobby{}).routes()
+	require.Len(t, ClientMessages, len(routes))
+	for _, spec := range ClientMessages {
+		require.Contains(t, routes, spec.Type)
+	}
+}
+
+func TestProtocolIsDocumented(t *testing.T) {
+	doc, err := ioutil.ReadFile("../PROTOCOL.md")
+	require.Nil(t, err)
+
+	for _, spec := range append(ClientMessages, ServerMessages...) {
+		require.Contains(t, string(doc), "`"+spec.Type+"`")
+	}
+	for _, code := range []ErrorCode{
+		ErrorInvalidPacket, ErrorUnknownPacketType, ErrorInvalidData,
+		ErrorGameNotStarted, ErrorGameAlreadyStarted, ErrorNotOwner,
+		ErrorCannotDraw, ErrorNotDrawer, ErrorVotekickDisabled,
+		ErrorUnsupportedProtocolVersion, ErrorReadOnly, ErrorNotReplay,
+		ErrorInternal,
+	} {
+		require.Contains(t, string(doc), "`"+string(code)+"`")
+	}
+}
+
+func TestProtocolSchema(t *testing.T) {
+	data, err := json.Marshal(ProtocolSchema())
+	require.Nil(t, err)
+
+	schema := struct {
+		ClientMessages map[string]interface{}
+		ServerMessages map[string]interface{}
+		Definitions    map[string]struct {
+			Properties map[string]interface{}
+			Required   []string
+		}
+	}{}
+	require.Nil(t, json.Unmarshal(data, &schema))
+	require.Len(t, schema.ClientMessages, len(ClientMessages))
+	require.Len(t, schema.ServerMessages, len(ServerMessages))
+
+	line := schema.Definitions["Line"]
+	require.Contains(t, line.Properties, "fromX")
+	require.Contains(t, line.Required, "lineWidth")
+	require.Contains(t, schema.Definitions, "Ready")
+	require.Contains(t, schema.Definitions, "Player")
+	// Unexported fields aren't part of the protocol.
+	require.NotContains(t, schema.Definitions["Player"].Properties, "reconnectTimer")
+}
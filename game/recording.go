@@ -0,0 +1,354 @@
+package game
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RecordingFormat identifies .scribble files, it is the format of their
+// header.
+const RecordingFormat = "scribble"
+
+// RecordingVersion is the version of the .scribble format written by the
+// server. Recordings of newer versions can't be replayed.
+const RecordingVersion = 1
+
+// Types of the recording entries that aren't events of the protocol. All
+// other entries are events as they were sent to every player of the lobby.
+const (
+	// RecordChat is a chat message, see RecordedChat.
+	RecordChat = "chat"
+	// RecordWordChoice is the word chosen by the drawer, see
+	// RecordedWordChoice.
+	RecordWordChoice = "word-choice"
+	// RecordWordHints are the hints for the current word as the guessing
+	// players see them.
+	RecordWordHints = "word-hints"
+)
+
+// Recording is the complete timeline of a lobby, from its creation on. Every
+// entry is stamped with the time it happened, so the lobby can be replayed
+// later, see NewReplayLobby. Recordings only live in memory, a lobby loaded
+// from the store starts a new one.
+//
+// A nil Recording records nothing.
+type Recording struct {
+	mu      sync.Mutex
+	header  RecordingHeader
+	started time.Time
+	entries []*RecordingEntry
+	// turnStart is the index of the first entry of the running turn, if
+	// turnRunning is set.
+	turnStart   int
+	turnRunning bool
+}
+
+// RecordingHeader is the first line of a .scribble file.
+type RecordingHeader struct {
+	// Format is always RecordingFormat.
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	LobbyID string `json:"lobbyId"`
+	// Started is the unix time in milliseconds the recording started at.
+	Started  int64          `json:"started"`
+	Settings *LobbySettings `json:"settings"`
+	// Truncated is set if the lobby went on for longer than
+	// MaxRecordingEntries allowed to record.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// RecordingEntry is something that happened in the lobby.
+type RecordingEntry struct {
+	// Time is the number of milliseconds since the recording started.
+	Time int64           `json:"time"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// RecordedChat is a chat message as it was shown to the players.
+type RecordedChat struct {
+	Message
+	// NonGuessing is set for messages that were only shown to players that
+	// weren't guessing.
+	NonGuessing bool `json:"nonGuessing,omitempty"`
+}
+
+// RecordedWordChoice is the word the drawer chose and what they could have
+// chosen instead.
+type RecordedWordChoice struct {
+	Drawer  string   `json:"drawer"`
+	Choices []string `json:"choices"`
+	Word    string   `json:"word"`
+}
+
+func newRecording(lobbyID string, settings *LobbySettings) *Recording {
+	// Copied, as the settings of a lobby can still change.
+	copied := *settings
+	now := time.Now()
+	return &Recording{
+		started: now,
+		header: RecordingHeader{
+			Format:   RecordingFormat,
+			Version:  RecordingVersion,
+			LobbyID:  lobbyID,
+			Started:  now.UnixNano() / int64(time.Millisecond),
+			Settings: &copied,
+		},
+	}
+}
+
+// add appends an entry of the given type, encoding its data right away, as
+// it may change afterwards.
+func (r *Recording) add(entryType string, data interface{}) {
+	if r == nil {
+		return
+	}
+
+	var encoded json.RawMessage
+	if data != nil {
+		var err error
+		encoded, err = json.Marshal(data)
+		if err != nil {
+			fmt.Println("recording encode error:", err)
+			return
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) >= MaxRecordingEntries {
+		r.header.Truncated = true
+		return
+	}
+	r.entries = append(r.entries, &RecordingEntry{
+		Time: int64(time.Since(r.started) / time.Millisecond),
+		Type: entryType,
+		Data: encoded,
+	})
+}
+
+// startTurn marks the following entries as part of a running turn.
+func (r *Recording) startTurn() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.turnStart = len(r.entries)
+	r.turnRunning = true
+}
+
+func (r *Recording) endTurn() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.turnRunning = false
+}
+
+// WithoutRunningTurn returns a copy of the recording that ends before the
+// turn that is still running, if any. The entries of that turn reveal the
+// word to the players that haven't guessed it yet.
+func (r *Recording) WithoutRunningTurn() *Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := r.entries
+	if r.turnRunning {
+		entries = entries[:r.turnStart]
+	}
+	return &Recording{
+		header:  r.header,
+		started: r.started,
+		entries: append([]*RecordingEntry(nil), entries...),
+	}
+}
+
+// Header returns the header of the recording.
+func (r *Recording) Header() RecordingHeader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.header
+}
+
+// Entries returns all entries recorded so far, oldest first.
+func (r *Recording) Entries() []*RecordingEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*RecordingEntry(nil), r.entries...)
+}
+
+// Duration is the time from the start of the recording until its latest
+// entry.
+func (r *Recording) Duration() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) == 0 {
+		return 0
+	}
+	return time.Duration(r.entries[len(r.entries)-1].Time) * time.Millisecond
+}
+
+// Encode writes the recording as .scribble file, which is gzipped JSON, one
+// object per line. The header comes first, followed by the entries.
+func (r *Recording) Encode(w io.Writer) error {
+	header, entries := r.Header(), r.Entries()
+
+	compressed := gzip.NewWriter(w)
+	encoder := json.NewEncoder(compressed)
+	if err := encoder.Encode(&header); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return compressed.Close()
+}
+
+// ErrInvalidRecording is returned by DecodeRecording for files that aren't
+// recordings the server can replay.
+var ErrInvalidRecording = errors.New("invalid recording")
+
+// DecodeRecording reads a .scribble file written by Recording.Encode.
+func DecodeRecording(reader io.Reader) (*Recording, error) {
+	uncompressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrInvalidRecording, err)
+	}
+	defer uncompressed.Close()
+
+	// A small upload can unpack to any size, reading one byte past the
+	// limit tells recordings that are too large apart from ones that end
+	// right at it.
+	limited := &io.LimitedReader{R: uncompressed, N: MaxRecordingDataSize + 1}
+	tooLarge := func() error {
+		if limited.N > 0 {
+			return nil
+		}
+		return fmt.Errorf("%s: larger than %d bytes uncompressed", ErrInvalidRecording, MaxRecordingDataSize)
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(limited))
+	recording := &Recording{}
+	if err := decoder.Decode(&recording.header); err != nil {
+		if sizeErr := tooLarge(); sizeErr != nil {
+			return nil, sizeErr
+		}
+		return nil, fmt.Errorf("%s: error decoding header: %s", ErrInvalidRecording, err)
+	}
+	header := &recording.header
+	if header.Format != RecordingFormat || header.Settings == nil {
+		return nil, fmt.Errorf("%s: not a .scribble file", ErrInvalidRecording)
+	}
+	if header.Version < 1 || header.Version > RecordingVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", ErrInvalidRecording, header.Version)
+	}
+	recording.started = time.Unix(0, header.Started*int64(time.Millisecond))
+
+	for {
+		entry := &RecordingEntry{}
+		err := decoder.Decode(entry)
+		if sizeErr := tooLarge(); sizeErr != nil {
+			return nil, sizeErr
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: error decoding entry %d: %s", ErrInvalidRecording, len(recording.entries)+1, err)
+		}
+		if len(recording.entries) >= MaxRecordingEntries {
+			return nil, fmt.Errorf("%s: more than %d entries", ErrInvalidRecording, MaxRecordingEntries)
+		}
+		recording.entries = append(recording.entries, entry)
+	}
+
+	// Replays rely on the entries being in order.
+	sort.SliceStable(recording.entries, func(i, j int) bool {
+		return recording.entries[i].Time < recording.entries[j].Time
+	})
+	return recording, nil
+}
+
+// Recording returns the recording of the lobby, nil for replays.
+func (l *Lobby) Recording() *Recording {
+	return l.recording
+}
+
+// startRecording starts recording everything the players of the lobby see,
+// beginning with the players that are already there.
+func (l *Lobby) startRecording() {
+	l.recording = newRecording(l.ID, l.Settings)
+	l.broadcaster = &recordingBroadcaster{Broadcaster: l.broadcaster, recording: l.recording}
+	l.recording.add(EventUpdatePlayers, l.State.Players)
+	// A lobby loaded from the store might be in the middle of a turn.
+	if l.State.Drawer != "" {
+		l.recording.startTurn()
+	}
+}
+
+// recordChat records a chat message, which is sent to each player on its
+// own and therefore not seen by the recordingBroadcaster.
+func (l *Lobby) recordChat(message Message, nonGuessing bool) {
+	l.recording.add(RecordChat, &RecordedChat{Message: message, NonGuessing: nonGuessing})
+}
+
+// recordingBroadcaster records all events meant for every player of a lobby
+// before passing them on. Events for single players, such as the word
+// choice of the drawer, aren't part of the recording, unless the lobby
+// records them explicitly.
+type recordingBroadcaster struct {
+	Broadcaster
+	recording *Recording
+}
+
+func (b *recordingBroadcaster) TriggerSimpleUpdateEvent(eventType string, lobby *Lobby) {
+	b.recording.add(eventType, nil)
+	b.Broadcaster.TriggerSimpleUpdateEvent(eventType, lobby)
+}
+
+func (b *recordingBroadcaster) TriggerComplexUpdateEvent(eventType string, data interface{}, lobby *Lobby) {
+	b.recording.add(eventType, data)
+	b.Broadcaster.TriggerComplexUpdateEvent(eventType, data, lobby)
+}
+
+// SendDataToOtherPlayers records the drawing of the drawer, which is only
+// sent to the other players, but affects what everyone sees.
+func (b *recordingBroadcaster) SendDataToOtherPlayers(sender *Player, lobby *Lobby, data interface{}) {
+	switch packet := data.(type) {
+	case Packet:
+		b.recordPacket(&packet)
+	case *Packet:
+		b.recordPacket(packet)
+	}
+	b.Broadcaster.SendDataToOtherPlayers(sender, lobby, data)
+}
+
+func (b *recordingBroadcaster) recordPacket(packet *Packet) {
+	var data interface{}
+	if len(packet.Data) > 0 {
+		data = packet.Data
+	}
+	b.recording.add(packet.Type, data)
+}
+
+func (b *recordingBroadcaster) WritePublicSystemMessage(lobby *Lobby, text string) {
+	b.recording.add(EventSystemMessage, text)
+	b.Broadcaster.WritePublicSystemMessage(lobby, text)
+}
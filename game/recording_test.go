@@ -0,0 +1,234 @@
+package game_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGameIsRecorded(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 0
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	owner, lobby, err := game.NewLobby("owner", "owner-session", "english", 1, game.LobbySettings{
+		DrawingTime: 120,
+		MaxPlayers:  12,
+		Rounds:      2,
+	}, game.NewRecordingBroadcaster())
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.Connect(owner)
+	guest := lobby.JoinPlayer("guest", "guest-session", 0)
+	lobby.Connect(guest)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer, guesser := owner, guest
+	if lobby.State.Drawer == guest.ID {
+		drawer, guesser = guest, owner
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word", "data":1}`), drawer))
+	word := lobby.State.CurrentWord
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"line","data":{"fromX":0,"fromY":0,"toX":10,"toY":10,"color":"#000000","lineWidth":5,"gestureId":1}}`), drawer))
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"message","data":"is it <b>?"}`), guesser))
+	require.Nil(t, lobby.HandlePacket([]byte(fmt.Sprintf(`{"type":"message","data":%q}`, word)), guesser))
+
+	recording := lobby.Recording()
+	header := recording.Header()
+	require.Equal(t, game.RecordingFormat, header.Format)
+	require.Equal(t, lobby.ID, header.LobbyID)
+	require.Equal(t, 2, header.Settings.Rounds)
+
+	entries := map[string][]*game.RecordingEntry{}
+	for _, entry := range recording.Entries() {
+		entries[entry.Type] = append(entries[entry.Type], entry)
+	}
+	for _, entryType := range []string{
+		game.EventUpdatePlayers, game.EventNextTurn, game.RecordWordHints,
+		game.EventLine, game.EventSystemMessage, game.EventTurnOver,
+	} {
+		require.NotEmpty(t, entries[entryType], entryType)
+	}
+
+	choice := &game.RecordedWordChoice{}
+	require.Len(t, entries[game.RecordWordChoice], 1)
+	require.Nil(t, json.Unmarshal(entries[game.RecordWordChoice][0].Data, choice))
+	require.Equal(t, drawer.ID, choice.Drawer)
+	require.Equal(t, word, choice.Word)
+	require.Equal(t, word, choice.Choices[1])
+
+	// Only the message is recorded, the correct guess isn't shown.
+	chat := &game.RecordedChat{}
+	require.Len(t, entries[game.RecordChat], 1)
+	require.Nil(t, json.Unmarshal(entries[game.RecordChat][0].Data, chat))
+	require.Equal(t, guesser.Name, chat.Author)
+	require.Equal(t, "is it &lt;b&gt;?", chat.Content)
+
+	var file bytes.Buffer
+	require.Nil(t, recording.Encode(&file))
+	decoded, err := game.DecodeRecording(&file)
+	require.Nil(t, err)
+	require.Equal(t, header, decoded.Header())
+	require.Equal(t, recording.Entries(), decoded.Entries())
+
+	_, err = game.DecodeRecording(bytes.NewBufferString("not a recording"))
+	require.NotNil(t, err)
+}
+
+// recordingFile writes a .scribble file by hand, so the entries can have
+// any time.
+func recordingFile(t *testing.T, started int64, entries ...*game.RecordingEntry) *bytes.Buffer {
+	var file bytes.Buffer
+	compressed := gzip.NewWriter(&file)
+	encoder := json.NewEncoder(compressed)
+	require.Nil(t, encoder.Encode(&game.RecordingHeader{
+		Format:   game.RecordingFormat,
+		Version:  game.RecordingVersion,
+		LobbyID:  "recorded",
+		Started:  started,
+		Settings: &game.LobbySettings{Language: "english", DrawingTime: 120, Rounds: 3, MaxPlayers: 2},
+	}))
+	for _, entry := range entries {
+		require.Nil(t, encoder.Encode(entry))
+	}
+	require.Nil(t, compressed.Close())
+	return &file
+}
+
+func readyOf(t *testing.T, event *game.RecordedEvent) *game.Ready {
+	ready := &game.Ready{}
+	require.Nil(t, json.Unmarshal(event.Data.(game.Packet).Data, ready))
+	return ready
+}
+
+func TestRecordingSizeIsLimited(t *testing.T) {
+	entries := []*game.RecordingEntry{}
+	for i := 0; i < 100; i++ {
+		entries = append(entries, &game.RecordingEntry{Time: int64(i), Type: game.RecordChat, Data: json.RawMessage(`{"author":"bob","content":"cat?"}`)})
+	}
+	file := recordingFile(t, 0, entries...).Bytes()
+
+	defaultSize := game.MaxRecordingDataSize
+	defer func() { game.MaxRecordingDataSize = defaultSize }()
+	game.MaxRecordingDataSize = 1024
+	_, err := game.DecodeRecording(bytes.NewReader(file))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "larger than 1024 bytes uncompressed")
+
+	game.MaxRecordingDataSize = 1 << 20
+	recording, err := game.DecodeRecording(bytes.NewReader(file))
+	require.Nil(t, err)
+	require.Len(t, recording.Entries(), 100)
+}
+
+func TestRecordingIsReplayed(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	started := time.Now().UnixNano() / int64(time.Millisecond)
+	players := `{"alice":{"id":"alice","name":"alice","score":0},"bob":{"id":"bob","name":"bob","score":0}}`
+	file := recordingFile(t, started,
+		&game.RecordingEntry{Time: 0, Type: game.EventUpdatePlayers, Data: json.RawMessage(players)},
+		&game.RecordingEntry{Time: 1000, Type: game.EventNextTurn, Data: json.RawMessage(fmt.Sprintf(
+			`{"round":1,"players":%s,"roundEndTime":%d}`, players, started/1000+121))},
+		&game.RecordingEntry{Time: 2000, Type: game.RecordWordHints, Data: json.RawMessage(`[{"character":0,"underline":true}]`)},
+		&game.RecordingEntry{Time: 3000, Type: game.EventLine, Data: json.RawMessage(
+			`{"fromX":0,"fromY":0,"toX":10,"toY":10,"color":"#000000","lineWidth":5,"gestureId":1}`)},
+		&game.RecordingEntry{Time: 4000, Type: game.RecordChat, Data: json.RawMessage(`{"author":"bob","content":"cat?"}`)},
+		&game.RecordingEntry{Time: 5000, Type: game.EventUndo, Data: json.RawMessage(`1`)},
+	)
+	recording, err := game.DecodeRecording(file)
+	require.Nil(t, err)
+
+	broadcaster := game.NewRecordingBroadcaster()
+	lobby, err := game.NewReplayLobby(recording, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	require.True(t, lobby.IsReplay())
+	require.Nil(t, lobby.Recording())
+
+	viewer := lobby.JoinPlayer("viewer", "viewer-session", 0)
+	lobby.Connect(viewer)
+	ready := readyOf(t, broadcaster.EventsOfType(game.EventReady)[0])
+	require.Equal(t, viewer.ID, ready.PlayerID)
+	require.Equal(t, &game.ReplayStatus{Duration: 5000, Speed: 1, Paused: true}, ready.Replay)
+	require.Len(t, ready.Players, 0)
+
+	err = lobby.HandlePacket([]byte(`{"type":"message","data":"hi"}`), viewer)
+	require.Equal(t, game.ErrorReadOnly, err.(*game.PacketError).Code)
+	err = lobby.HandlePacket([]byte(`{"type":"replay-control","data":{"action":"speed","speed":100}}`), viewer)
+	require.Equal(t, game.ErrorInvalidData, err.(*game.PacketError).Code)
+
+	// Seeking sends what the players saw at that time.
+	broadcaster.Reset()
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"replay-control","data":{"action":"seek","position":3500}}`), viewer))
+	ready = readyOf(t, broadcaster.EventsOfType(game.EventReady)[0])
+	require.Equal(t, int64(3500), ready.Replay.Position)
+	require.Equal(t, 1, ready.Round)
+	require.Len(t, ready.Players, 2)
+	require.Len(t, ready.WordHints, 1)
+	require.Len(t, ready.CurrentDrawing, 1)
+	// The turn ends 121 seconds into the recording.
+	require.InDelta(t, time.Now().Unix()+117, ready.RoundEndTime, 1)
+	require.Len(t, broadcaster.EventsOfType(game.EventReplayStatus), 1)
+
+	// The rest is played back as events, until the end is reached.
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"replay-control","data":{"action":"speed","speed":16}}`), viewer))
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"replay-control","data":{"action":"play"}}`), viewer))
+	require.Eventually(t, func() bool {
+		status := lobby.ReplayStatus()
+		return status.Paused && status.Position == 5000
+	}, 2*time.Second, 10*time.Millisecond)
+
+	messages := broadcaster.EventsOfType(game.EventMessage)
+	require.Len(t, messages, 1)
+	require.Equal(t, &game.Message{Author: "bob", Content: "cat?"}, messages[0].Data)
+	require.Len(t, broadcaster.EventsOfType(game.EventUndo), 1)
+	require.Len(t, broadcaster.EventsOfType(game.EventLine), 0)
+}
+
+func TestReplaySkipsEntriesForSinglePlayers(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	file := recordingFile(t, time.Now().UnixNano()/int64(time.Millisecond),
+		&game.RecordingEntry{Time: 100, Type: game.EventReady, Data: json.RawMessage(`{"playerId":"eve"}`)},
+		&game.RecordingEntry{Time: 200, Type: game.EventSessionReplaced},
+		&game.RecordingEntry{Time: 300, Type: game.EventYourTurn, Data: json.RawMessage(`["cat"]`)},
+		&game.RecordingEntry{Time: 400, Type: game.RecordChat, Data: json.RawMessage(`{"author":"<b>eve</b>","content":"&lt;i&gt; <script>"}`)},
+		&game.RecordingEntry{Time: 500, Type: game.EventLine, Data: json.RawMessage(
+			`{"fromX":0,"fromY":0,"toX":10,"toY":10,"color":"#000000","lineWidth":5,"gestureId":1}`)},
+	)
+	recording, err := game.DecodeRecording(file)
+	require.Nil(t, err)
+
+	broadcaster := game.NewRecordingBroadcaster()
+	lobby, err := game.NewReplayLobby(recording, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	viewer := lobby.JoinPlayer("viewer", "viewer-session", 0)
+	lobby.Connect(viewer)
+
+	broadcaster.Reset()
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"replay-control","data":{"action":"speed","speed":16}}`), viewer))
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"replay-control","data":{"action":"play"}}`), viewer))
+	require.Eventually(t, func() bool {
+		status := lobby.ReplayStatus()
+		return status.Paused && status.Position == 500
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Len(t, broadcaster.EventsOfType(game.EventReady), 0)
+	require.Len(t, broadcaster.EventsOfType(game.EventSessionReplaced), 0)
+	require.Len(t, broadcaster.EventsOfType(game.EventYourTurn), 0)
+	require.Len(t, broadcaster.EventsOfType(game.EventLine), 1)
+	messages := broadcaster.EventsOfType(game.EventMessage)
+	require.Len(t, messages, 1)
+	require.Equal(t, &game.Message{Author: "&lt;b&gt;eve&lt;/b&gt;", Content: "&lt;i&gt; &lt;script&gt;"}, messages[0].Data)
+}
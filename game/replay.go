@@ -0,0 +1,479 @@
+package game
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Actions of replay-control packets
+const (
+	ReplayPlay  = "play"
+	ReplayPause = "pause"
+	ReplaySeek  = "seek"
+	ReplaySpeed = "speed"
+)
+
+// Bounds of the playback speed of replays.
+const (
+	MinReplaySpeed = 0.25
+	MaxReplaySpeed = 16
+)
+
+// replayedEntries are the types of recording entries a replay plays back.
+// Uploaded recordings can contain anything, other entries, such as events
+// meant for single players, are skipped.
+var replayedEntries = map[string]bool{
+	RecordWordChoice:       true,
+	RecordWordHints:        true,
+	RecordChat:             true,
+	EventSystemMessage:     true,
+	EventNextTurn:          true,
+	EventUpdatePlayers:     true,
+	EventCorrectGuess:      true,
+	EventLine:              true,
+	EventFill:              true,
+	EventDrawBatch:         true,
+	EventUndo:              true,
+	EventRedo:              true,
+	EventClearDrawingBoard: true,
+	EventTurnOver:          true,
+	EventGameOver:          true,
+}
+
+// ReplayControl is sent by viewers of a replay lobby to control the
+// playback, which is the same for all viewers.
+type ReplayControl struct {
+	// Action is one of play, pause, seek and speed.
+	Action string `json:"action"`
+	// Position to seek to, in milliseconds since the start of the recording.
+	Position int64 `json:"position,omitempty"`
+	// Speed is the new playback speed, 1 being real time.
+	Speed float64 `json:"speed,omitempty"`
+}
+
+// ReplayStatus describes the playback of a replay lobby.
+type ReplayStatus struct {
+	// Position and Duration are in milliseconds since the start of the
+	// recording.
+	Position int64   `json:"position"`
+	Duration int64   `json:"duration"`
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+	// RoundEndTime is when the current turn ends at the current speed, as
+	// unix timestamp. It is zero while no turn is running.
+	RoundEndTime int64 `json:"roundEndTime"`
+}
+
+// replay plays back a recording. Besides sending the recorded events to the
+// viewers, it keeps track of what the players of the recording saw, so that
+// viewers joining or seeking can be sent a ready snapshot.
+type replay struct {
+	mu       sync.Mutex
+	entries  []*RecordingEntry
+	started  int64
+	duration int64
+
+	speed  float64
+	paused bool
+	// position is the playback position at since, it only moves on while
+	// playing.
+	position int64
+	since    time.Time
+	// next is the index of the next entry to play.
+	next int
+	// generation invalidates timers scheduled before the latest pause.
+	generation int
+	timer      *time.Timer
+
+	players      map[string]*Player
+	round        int
+	roundEndTime int64
+	hints        []*WordHint
+	drawing      []*Packet
+}
+
+// ErrTooManyReplays is returned by NewReplayLobby if MaxReplayLobbies are
+// already running.
+var ErrTooManyReplays = errors.New("too many replays are running, try again later")
+
+// NewReplayLobby creates a read-only lobby that plays back the given
+// recording to everyone joining it. The playback starts paused. Replays
+// aren't stored, they only exist on the server instance that loaded them,
+// until they are swept for being idle. At most MaxReplayLobbies run at the
+// same time.
+func NewReplayLobby(recording *Recording, broadcaster Broadcaster) (*Lobby, error) {
+	header := recording.Header()
+	if header.Settings == nil {
+		return nil, ErrInvalidRecording
+	}
+	settings := *header.Settings
+	// The limits were meant for the players of the recording, not for its
+	// viewers.
+	settings.Public = false
+	settings.MaxPlayers = int(LobbySettingBounds.MaxMaxPlayers)
+	settings.ClientsPerIPLimit = int(LobbySettingBounds.MaxClientsPerIPLimit)
+
+	entries := recording.Entries()
+	lobby := &Lobby{
+		ID: uuid.NewV4().String(),
+
+		Settings: &settings,
+		State: &LobbyState{
+			Players: map[string]*Player{},
+		},
+		CurrentDrawing: &LobbyDrawing{CurrentDrawing: []*Packet{}},
+		turnDone:       make(chan struct{}),
+		broadcaster:    broadcaster,
+		events:         NewEventLog(EventLogSize),
+		replay: &replay{
+			entries:  entries,
+			started:  header.Started,
+			duration: int64(recording.Duration() / time.Millisecond),
+			speed:    1,
+			paused:   true,
+			players:  map[string]*Player{},
+		},
+	}
+	lobby.touch()
+
+	lobbiesMu.Lock()
+	defer lobbiesMu.Unlock()
+	running := 0
+	for _, other := range lobbies {
+		if other.replay != nil {
+			running++
+		}
+	}
+	if running >= MaxReplayLobbies {
+		return nil, ErrTooManyReplays
+	}
+	lobbies = append(lobbies, lobby)
+
+	return lobby, nil
+}
+
+// IsReplay tells whether the lobby plays back a recording.
+func (l *Lobby) IsReplay() bool {
+	return l.replay != nil
+}
+
+// ReplayStatus describes the playback of a replay lobby, nil for other
+// lobbies.
+func (l *Lobby) ReplayStatus() *ReplayStatus {
+	if l.replay == nil {
+		return nil
+	}
+
+	l.replay.mu.Lock()
+	defer l.replay.mu.Unlock()
+	return l.replay.statusLocked()
+}
+
+func (l *Lobby) replayControl(p *Packet, bytes []byte, from *Player) error {
+	control := &ReplayControl{}
+	err := json.Unmarshal(p.Data, control)
+	if err != nil {
+		return newPacketError(ErrorInvalidData, p.Type, "error decoding replay control: %s", err)
+	}
+
+	r := l.replay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch control.Action {
+	case ReplayPlay:
+		if !r.paused || len(r.entries) == 0 {
+			return nil
+		}
+		// Playing a finished replay starts it over.
+		if r.next == len(r.entries) {
+			l.seekLocked(0)
+		}
+		r.paused = false
+		r.since = time.Now()
+		l.scheduleLocked()
+	case ReplayPause:
+		r.pauseLocked()
+	case ReplaySeek:
+		position := control.Position
+		if position < 0 {
+			position = 0
+		} else if position > r.duration {
+			position = r.duration
+		}
+		l.seekLocked(position)
+	case ReplaySpeed:
+		if control.Speed < MinReplaySpeed || control.Speed > MaxReplaySpeed {
+			return newPacketError(ErrorInvalidData, p.Type, "the speed has to be between %g and %g", float64(MinReplaySpeed), float64(MaxReplaySpeed))
+		}
+		r.position = r.positionLocked()
+		r.since = time.Now()
+		r.speed = control.Speed
+		if !r.paused {
+			l.scheduleLocked()
+		}
+	default:
+		return newPacketError(ErrorInvalidData, p.Type, "unknown replay action '%s'", control.Action)
+	}
+
+	l.broadcaster.TriggerComplexUpdateEvent(EventReplayStatus, r.statusLocked(), l)
+	return nil
+}
+
+// pauseReplay stops the playback, for example because nobody is watching
+// anymore.
+func (l *Lobby) pauseReplay() {
+	l.replay.mu.Lock()
+	defer l.replay.mu.Unlock()
+	l.replay.pauseLocked()
+}
+
+func (r *replay) pauseLocked() {
+	if r.paused {
+		return
+	}
+	r.position = r.positionLocked()
+	r.paused = true
+	r.generation++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// positionLocked is the current playback position.
+func (r *replay) positionLocked() int64 {
+	if r.paused {
+		return r.position
+	}
+	elapsed := float64(time.Since(r.since) / time.Millisecond)
+	position := r.position + int64(elapsed*r.speed)
+	if position > r.duration {
+		position = r.duration
+	}
+	return position
+}
+
+func (r *replay) statusLocked() *ReplayStatus {
+	position := r.positionLocked()
+	return &ReplayStatus{
+		Position:     position,
+		Duration:     r.duration,
+		Speed:        r.speed,
+		Paused:       r.paused,
+		RoundEndTime: r.roundEndTimeLocked(position),
+	}
+}
+
+// roundEndTimeLocked converts the recorded end of the current turn into the
+// time it ends in the replay, at the current speed.
+func (r *replay) roundEndTimeLocked(position int64) int64 {
+	if r.roundEndTime == 0 {
+		return 0
+	}
+	left := r.roundEndTime*1000 - (r.started + position)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	return (now + int64(float64(left)/r.speed)) / 1000
+}
+
+// scheduleLocked sets a timer for playing the next entry.
+func (l *Lobby) scheduleLocked() {
+	r := l.replay
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.generation++
+	generation := r.generation
+	wait := float64(r.entries[r.next].Time-r.positionLocked()) / r.speed
+	r.timer = time.AfterFunc(time.Duration(wait*float64(time.Millisecond)), func() {
+		l.playReplay(generation)
+	})
+}
+
+// playReplay plays all entries that are due and schedules the next one.
+func (l *Lobby) playReplay(generation int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.replay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.paused || r.generation != generation {
+		return
+	}
+	if !l.hasConnectedPlayers() {
+		r.pauseLocked()
+		return
+	}
+
+	position := r.positionLocked()
+	for r.next < len(r.entries) && r.entries[r.next].Time <= position {
+		l.playEntryLocked(r.entries[r.next], true)
+		r.next++
+	}
+	if r.next < len(r.entries) {
+		l.scheduleLocked()
+		return
+	}
+
+	r.pauseLocked()
+	r.position = r.duration
+	l.broadcaster.TriggerComplexUpdateEvent(EventReplayStatus, r.statusLocked(), l)
+}
+
+// seekLocked moves the playback to the given position. As recorded events
+// can't be undone, the state is rebuilt from the start of the recording and
+// sent to all viewers as a new ready snapshot.
+func (l *Lobby) seekLocked(position int64) {
+	r := l.replay
+	wasPaused := r.paused
+	r.pauseLocked()
+
+	r.players = map[string]*Player{}
+	r.round, r.roundEndTime = 0, 0
+	r.hints, r.drawing = nil, nil
+	r.next = 0
+	for r.next < len(r.entries) && r.entries[r.next].Time <= position {
+		l.playEntryLocked(r.entries[r.next], false)
+		r.next++
+	}
+	r.position = position
+
+	for _, viewer := range l.State.Players {
+		if viewer.Connected {
+			l.sendReplayReadyLocked(viewer)
+		}
+	}
+
+	if !wasPaused && r.next < len(r.entries) {
+		r.paused = false
+		r.since = time.Now()
+		l.scheduleLocked()
+	}
+}
+
+// playEntryLocked applies an entry of the recording to the state of the
+// replay and, if live, sends it to the viewers.
+func (l *Lobby) playEntryLocked(entry *RecordingEntry, live bool) {
+	if !replayedEntries[entry.Type] {
+		return
+	}
+
+	r := l.replay
+	switch entry.Type {
+	case RecordWordChoice:
+		// The viewers are shown the hints, like the guessing players were.
+		return
+	case RecordWordHints:
+		json.Unmarshal(entry.Data, &r.hints)
+		if live {
+			l.broadcaster.TriggerComplexUpdateEvent(EventUpdateWordHint, r.hints, l)
+		}
+		return
+	case RecordChat:
+		chat := &RecordedChat{}
+		if json.Unmarshal(entry.Data, chat) != nil || !live {
+			return
+		}
+		// The messages were escaped when they were recorded, but the
+		// recording might not come from this server. Unescaping first
+		// keeps honest recordings from being escaped twice.
+		chat.Author = html.EscapeString(html.UnescapeString(chat.Author))
+		chat.Content = html.EscapeString(html.UnescapeString(chat.Content))
+		eventType := EventMessage
+		if chat.NonGuessing {
+			eventType = EventNonGuessingPlayerMessage
+		}
+		l.broadcaster.TriggerComplexUpdateEvent(eventType, &chat.Message, l)
+		return
+	case EventSystemMessage:
+		text := ""
+		if json.Unmarshal(entry.Data, &text) == nil && live {
+			l.broadcaster.WritePublicSystemMessage(l, text)
+		}
+		return
+	case EventNextTurn:
+		next := &NextTurn{}
+		if json.Unmarshal(entry.Data, next) != nil {
+			return
+		}
+		r.players = next.Players
+		r.round = next.Round
+		r.roundEndTime = next.RoundEndTime
+		r.hints, r.drawing = nil, nil
+		if live {
+			next.RoundEndTime = r.roundEndTimeLocked(entry.Time)
+			l.broadcaster.TriggerComplexUpdateEvent(EventNextTurn, next, l)
+		}
+		return
+	case EventUpdatePlayers:
+		players := map[string]*Player{}
+		if json.Unmarshal(entry.Data, &players) == nil {
+			r.players = players
+		}
+	case EventLine, EventFill:
+		r.drawing = append(r.drawing, &Packet{Type: entry.Type, Data: entry.Data})
+	case EventDrawBatch, EventRedo:
+		ops := []*Packet{}
+		if json.Unmarshal(entry.Data, &ops) == nil {
+			r.drawing = append(r.drawing, ops...)
+		}
+	case EventUndo:
+		// The count refers to the stored drawing, whose lines might have
+		// been simplified, unlike the recorded ones.
+		r.drawing = r.drawing[:LastGestureStart(r.drawing)]
+	case EventClearDrawingBoard:
+		r.drawing = nil
+	}
+
+	if !live {
+		return
+	}
+	if len(entry.Data) == 0 {
+		l.broadcaster.TriggerSimpleUpdateEvent(entry.Type, l)
+	} else {
+		l.broadcaster.TriggerComplexUpdateEvent(entry.Type, entry.Data, l)
+	}
+}
+
+func (l *Lobby) sendReplayReady(player *Player) {
+	l.replay.mu.Lock()
+	defer l.replay.mu.Unlock()
+	l.sendReplayReadyLocked(player)
+}
+
+// sendReplayReadyLocked sends the viewer what the players of the recording
+// saw at the current position. Viewers aren't part of the players list.
+func (l *Lobby) sendReplayReadyLocked(player *Player) {
+	r := l.replay
+	players := []*Player{}
+	for _, p := range r.players {
+		players = append(players, p)
+	}
+	status := r.statusLocked()
+	snapshot, ops := l.snapshotDrawing(r.drawing)
+	readyBytes, err := json.Marshal(&Ready{
+		PlayerID: player.ID,
+
+		Round:          r.round,
+		MaxRound:       l.Settings.Rounds,
+		RoundEndTime:   status.RoundEndTime,
+		WordHints:      r.hints,
+		Players:        players,
+		CurrentDrawing: append([]*Packet{}, ops...),
+		Snapshot:       snapshot,
+		Replay:         status,
+		Epoch:          l.events.Epoch(),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	l.broadcaster.WriteAsJSON(player, l, Packet{Type: EventReady, Data: readyBytes})
+}
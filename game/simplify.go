@@ -0,0 +1,162 @@
+package game
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// simplifyFinishedGestures merges the segments of all line gestures that
+// have been finished by a later operation into polylines with as few points
+// as possible, see simplifyGesture. The drawing is expected to only contain
+// finished gestures already simplified, except for its latest one, which is
+// finished by the first new operation unless they share the gesture.
+//
+// The drawing without its latest gesture and the operations to append in its
+// place are returned, along with the number of operations removed from the
+// drawing. If nothing could be simplified, the drawing and the operations are
+// returned as they are.
+func simplifyFinishedGestures(drawing, ops []*Packet, tolerance float64) ([]*Packet, []*Packet, int) {
+	// Most of the time, the drawer is in the middle of a line.
+	if len(drawing) > 0 {
+		gesture, isLine := lineGesture(drawing[len(drawing)-1])
+		ongoing := isLine
+		for i := 0; ongoing && i < len(ops); i++ {
+			next, nextIsLine := lineGesture(ops[i])
+			ongoing = nextIsLine && next == gesture
+		}
+		if ongoing {
+			return drawing, ops, 0
+		}
+	}
+
+	start := LastGestureStart(drawing)
+	tail := drawing[start:]
+	all := make([]*Packet, 0, len(tail)+len(ops))
+	all = append(all, tail...)
+	all = append(all, ops...)
+
+	simplified := make([]*Packet, 0, len(all))
+	for begin := 0; begin < len(all); {
+		end := begin + 1
+		gesture, isLine := lineGesture(all[begin])
+		for isLine && end < len(all) {
+			next, nextIsLine := lineGesture(all[end])
+			if !nextIsLine || next != gesture {
+				break
+			}
+			end++
+		}
+		// The latest gesture might still be continued.
+		if isLine && end < len(all) {
+			simplified = append(simplified, simplifyGesture(all[begin:end], tolerance)...)
+		} else {
+			simplified = append(simplified, all[begin:end]...)
+		}
+		begin = end
+	}
+
+	// Unless the latest gesture of the drawing has changed, it stays stored
+	// as it is.
+	unchanged := len(simplified) >= len(tail)
+	for i := 0; unchanged && i < len(tail); i++ {
+		unchanged = simplified[i] == tail[i]
+	}
+	if unchanged {
+		return drawing, simplified[len(tail):], 0
+	}
+	return drawing[:start], simplified, len(tail)
+}
+
+// simplifyGesture replaces consecutive connected segments of the same color
+// and width by fewer segments, which don't deviate more than tolerance from
+// the original ones, using the Ramer-Douglas-Peucker algorithm. Segments
+// that are kept are returned as they are.
+func simplifyGesture(ops []*Packet, tolerance float64) []*Packet {
+	lines := make([]*Line, len(ops))
+	for i, op := range ops {
+		lines[i] = &Line{}
+		if err := json.Unmarshal(op.Data, lines[i]); err != nil {
+			return ops
+		}
+	}
+
+	simplified := make([]*Packet, 0, len(ops))
+	for begin := 0; begin < len(lines); {
+		end := begin + 1
+		for end < len(lines) && continues(lines[end-1], lines[end]) {
+			end++
+		}
+
+		points := make([]point, 0, end-begin+1)
+		points = append(points, point{lines[begin].FromX, lines[begin].FromY})
+		for _, line := range lines[begin:end] {
+			points = append(points, point{line.ToX, line.ToY})
+		}
+		kept := simplifyPolyline(points, tolerance)
+		if len(kept)-1 >= end-begin {
+			simplified = append(simplified, ops[begin:end]...)
+			begin = end
+			continue
+		}
+
+		for i := 1; i < len(kept); i++ {
+			line := *lines[begin]
+			line.FromX, line.FromY = kept[i-1].x, kept[i-1].y
+			line.ToX, line.ToY = kept[i].x, kept[i].y
+			data, err := json.Marshal(&line)
+			if err != nil {
+				panic(err)
+			}
+			simplified = append(simplified, &Packet{Type: PacketLine, Data: data})
+		}
+		begin = end
+	}
+	return simplified
+}
+
+// continues tells whether next carries on where line ends, looking the same.
+func continues(line, next *Line) bool {
+	return line.ToX == next.FromX && line.ToY == next.FromY &&
+		line.Color == next.Color && line.LineWidth == next.LineWidth
+}
+
+type point struct {
+	x, y float64
+}
+
+// simplifyPolyline returns the points of the polyline that have to be kept,
+// so that no point is further away than tolerance from the resulting
+// polyline. The first and the last point are always kept.
+func simplifyPolyline(points []point, tolerance float64) []point {
+	if len(points) < 3 {
+		return points
+	}
+
+	first, last := points[0], points[len(points)-1]
+	farthest, distance := 0, 0.0
+	for i := 1; i < len(points)-1; i++ {
+		if d := segmentDistance(points[i], first, last); d > distance {
+			farthest, distance = i, d
+		}
+	}
+	if distance <= tolerance {
+		return []point{first, last}
+	}
+
+	before := simplifyPolyline(points[:farthest+1], tolerance)
+	after := simplifyPolyline(points[farthest:], tolerance)
+	// The farthest point ends the first half and starts the second.
+	return append(before[:len(before)-1:len(before)-1], after...)
+}
+
+// segmentDistance is the distance of p to the segment from a to b.
+func segmentDistance(p, a, b point) float64 {
+	dx, dy := b.x-a.x, b.y-a.y
+	length := dx*dx + dy*dy
+	if length == 0 {
+		return math.Hypot(p.x-a.x, p.y-a.y)
+	}
+	t := ((p.x-a.x)*dx + (p.y-a.y)*dy) / length
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p.x-a.x-t*dx, p.y-a.y-t*dy)
+}
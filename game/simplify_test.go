@@ -0,0 +1,140 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func linePackets(t testing.TB, gesture int, points ...point) []*Packet {
+	ops := make([]*Packet, 0, len(points)-1)
+	for i := 1; i < len(points); i++ {
+		data, err := json.Marshal(&Line{
+			FromX: points[i-1].x, FromY: points[i-1].y,
+			ToX: points[i].x, ToY: points[i].y,
+			Color: "#000000", LineWidth: 5, GestureID: gesture,
+		})
+		require.Nil(t, err)
+		ops = append(ops, &Packet{Type: PacketLine, Data: data})
+	}
+	return ops
+}
+
+func linesOf(t *testing.T, ops []*Packet) []*Line {
+	lines := make([]*Line, 0, len(ops))
+	for _, op := range ops {
+		line := &Line{}
+		require.Nil(t, json.Unmarshal(op.Data, line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestSimplifyPolyline(t *testing.T) {
+	straight := []point{{0, 0}, {1, 0.2}, {2, -0.2}, {3, 0}, {4, 0}}
+	require.Equal(t, []point{{0, 0}, {4, 0}}, simplifyPolyline(straight, 0.5))
+	require.Equal(t, straight, simplifyPolyline(straight, 0.05))
+
+	corner := []point{{0, 0}, {5, 0}, {10, 0}, {10, 5}, {10, 10}}
+	require.Equal(t, []point{{0, 0}, {10, 0}, {10, 10}}, simplifyPolyline(corner, 1))
+
+	// Points beyond the end of the line are far away from it, even though
+	// they are on the same infinite line.
+	back := []point{{0, 0}, {10, 0}, {5, 0}}
+	require.Equal(t, []point{{0, 0}, {10, 0}, {5, 0}}, simplifyPolyline(back, 1))
+}
+
+func TestSimplifyGesture(t *testing.T) {
+	ops := linePackets(t, 1, point{0, 0}, point{1, 0}, point{2, 0}, point{3, 0})
+	// A gap starts a new polyline.
+	ops = append(ops, linePackets(t, 1, point{10, 10}, point{11, 11}, point{12, 12})...)
+
+	simplified := linesOf(t, simplifyGesture(ops, 1))
+	require.Equal(t, []*Line{
+		{FromX: 0, FromY: 0, ToX: 3, ToY: 0, Color: "#000000", LineWidth: 5, GestureID: 1},
+		{FromX: 10, FromY: 10, ToX: 12, ToY: 12, Color: "#000000", LineWidth: 5, GestureID: 1},
+	}, simplified)
+
+	// Nothing to merge, the packets are kept.
+	single := linePackets(t, 1, point{0, 0}, point{1, 0})
+	require.Equal(t, single, simplifyGesture(single, 1))
+}
+
+func TestSimplifyFinishedGestures(t *testing.T) {
+	first := linePackets(t, 1, point{0, 0}, point{1, 0}, point{2, 0})
+	second := linePackets(t, 2, point{0, 5}, point{1, 5}, point{2, 5})
+
+	// The drawer is still drawing the first line.
+	drawing, ops, removed := simplifyFinishedGestures(first[:1], first[1:], 1)
+	require.Equal(t, first[:1], drawing)
+	require.Equal(t, first[1:], ops)
+	require.Equal(t, 0, removed)
+
+	// The second line finishes the first one.
+	drawing, ops, removed = simplifyFinishedGestures(first, second[:1], 1)
+	require.Empty(t, drawing)
+	require.Equal(t, 2, removed)
+	require.Len(t, ops, 2)
+	require.Equal(t, second[0], ops[1])
+
+	// Lines finished within the new operations are simplified as well,
+	// while the latest one is kept as it is.
+	drawing, ops, removed = simplifyFinishedGestures(nil, append(append([]*Packet{}, first...), second...), 1)
+	require.Empty(t, drawing)
+	require.Equal(t, 0, removed)
+	require.Len(t, ops, 3)
+	require.Equal(t, second, ops[1:])
+}
+
+// benchmarkDrawing draws wobbly strokes the way a mouse produces them, a
+// segment every few pixels.
+func benchmarkDrawing(t testing.TB, gestures, segments int) []*Packet {
+	random := rand.New(rand.NewSource(1))
+	drawing := []*Packet{}
+	for gesture := 1; gesture <= gestures; gesture++ {
+		x, y := random.Float64()*DrawingBoardBaseWidth, random.Float64()*DrawingBoardBaseHeight
+		angle := random.Float64() * 2 * math.Pi
+		points := []point{{x, y}}
+		for i := 0; i < segments; i++ {
+			angle += (random.Float64() - 0.5) * 0.3
+			x, y = x+3*math.Cos(angle)+random.Float64()-0.5, y+3*math.Sin(angle)+random.Float64()-0.5
+			points = append(points, point{x, y})
+		}
+		drawing = append(drawing, linePackets(t, gesture, points...)...)
+	}
+	return drawing
+}
+
+func drawingSize(ops []*Packet) int {
+	size := 0
+	for _, op := range ops {
+		size += len(op.Data)
+	}
+	return size
+}
+
+// BenchmarkSimplifyFinishedGestures measures simplifying a drawing gesture by
+// gesture, as it happens while drawing, and logs how many operations and
+// bytes are left at different tolerances.
+func BenchmarkSimplifyFinishedGestures(b *testing.B) {
+	drawing := benchmarkDrawing(b, 50, 200)
+
+	for _, tolerance := range []float64{0.5, 1, 2} {
+		b.Run(fmt.Sprint(tolerance), func(b *testing.B) {
+			var simplified []*Packet
+			for i := 0; i < b.N; i++ {
+				simplified = nil
+				for _, op := range drawing {
+					kept, ops, _ := simplifyFinishedGestures(simplified, []*Packet{op}, tolerance)
+					simplified = append(kept, ops...)
+				}
+			}
+			b.Logf("%d operations of %d bytes simplified to %d operations of %d bytes",
+				len(drawing), drawingSize(drawing), len(simplified), drawingSize(simplified))
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package game
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+)
+
+// SnapshotRenderer renders draw operations as PNG. It is set by the server,
+// as drawings are rendered by package drawing, which depends on this
+// package. Without a renderer, no snapshots are sent.
+var SnapshotRenderer func(ops []*Packet) ([]byte, error)
+
+// drawingSnapshot is the latest image rendered of the beginning of a
+// drawing. It is kept, as all players connecting in the meantime can be sent
+// the same image.
+type drawingSnapshot struct {
+	mu sync.Mutex
+	// first and last are the first and the last operation in the image,
+	// which tell whether a drawing still begins with these operations.
+	first, last *Packet
+	count       int
+	dataURL     string
+}
+
+// covers tells whether the snapshot shows the first operations of the
+// drawing.
+func (s *drawingSnapshot) covers(drawing []*Packet) bool {
+	return s.count > 0 && s.count <= len(drawing) &&
+		drawing[0] == s.first && drawing[s.count-1] == s.last
+}
+
+// snapshotCut returns the number of operations at the beginning of the
+// drawing that go into a snapshot, zero if no snapshot should be sent. The
+// latest SnapshotKeepGestures gestures can still be undone, which clients can
+// only do with their operations.
+func snapshotCut(drawing []*Packet) int {
+	if SnapshotRenderer == nil || SnapshotThreshold <= 0 || len(drawing) < SnapshotThreshold {
+		return 0
+	}
+
+	cut := len(drawing)
+	for i := 0; i < SnapshotKeepGestures && cut > 0; i++ {
+		cut = LastGestureStart(drawing[:cut])
+	}
+	return cut
+}
+
+// usable tells whether the snapshot can be sent along with the rest of the
+// drawing. An image of fewer operations than cut is good enough, as long as
+// not too many have to be drawn on top of it.
+func (s *drawingSnapshot) usable(drawing []*Packet, cut int) bool {
+	return s.covers(drawing) && s.count <= cut && len(drawing)-s.count < SnapshotThreshold
+}
+
+// snapshotDrawing splits a large drawing for a player that connects, who
+// doesn't need every operation, just what the drawing looks like. All but
+// the latest SnapshotKeepGestures gestures are returned as PNG data URL, the
+// rest as operations, which are drawn on top of the image. Drawings with less
+// than SnapshotThreshold operations are returned as they are, just like
+// drawings without a usable image rendered by prepareSnapshot. It is called
+// while holding the lobby lock and therefore never renders.
+func (l *Lobby) snapshotDrawing(drawing []*Packet) (string, []*Packet) {
+	cut := snapshotCut(drawing)
+	if cut == 0 {
+		return "", drawing
+	}
+
+	snapshot := &l.snapshot
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+	if snapshot.usable(drawing, cut) {
+		return snapshot.dataURL, drawing[snapshot.count:]
+	}
+	return "", drawing
+}
+
+// prepareSnapshot renders the image snapshotDrawing sends to the connecting
+// player, unless the latest one is still usable. Rendering large drawings
+// takes a while, so it happens on a copy of the drawing, without holding
+// the lobby lock.
+func (l *Lobby) prepareSnapshot(player *Player) {
+	if SnapshotRenderer == nil || SnapshotThreshold <= 0 {
+		return
+	}
+
+	var drawing []*Packet
+	if l.replay != nil {
+		l.replay.mu.Lock()
+		drawing = append(drawing, l.replay.drawing...)
+		l.replay.mu.Unlock()
+	} else {
+		l.mu.Lock()
+		// The drawer is sent all operations anyway.
+		if player.State != PlayerStateDrawing {
+			drawing = append(drawing, l.CurrentDrawing.CurrentDrawing...)
+		}
+		l.mu.Unlock()
+	}
+
+	cut := snapshotCut(drawing)
+	if cut == 0 {
+		return
+	}
+
+	snapshot := &l.snapshot
+	snapshot.mu.Lock()
+	usable := snapshot.usable(drawing, cut)
+	snapshot.mu.Unlock()
+	if usable {
+		return
+	}
+
+	image, err := SnapshotRenderer(drawing[:cut])
+	if err != nil {
+		fmt.Println("snapshot render error:", err)
+		return
+	}
+	dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+	snapshot.first, snapshot.last = drawing[0], drawing[cut-1]
+	snapshot.count = cut
+	snapshot.dataURL = dataURL
+}
@@ -0,0 +1,353 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/vmihailenco/msgpack"
+)
+
+// MemStore keeps lobbies in process memory. Data is serialized the same way
+// as in RedisStore, so loaded lobbies never share memory with saved ones.
+// It is meant for tests and single instance setups without redis, lobbies
+// don't expire.
+type MemStore struct {
+	mu       sync.Mutex
+	order    []string
+	settings map[string][]byte
+	states   map[string][]byte
+	drawOps  map[string][][]byte
+	turns    map[string][][]byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		settings: make(map[string][]byte),
+		states:   make(map[string][]byte),
+		drawOps:  make(map[string][][]byte),
+		turns:    make(map[string][][]byte),
+	}
+}
+
+func (m *MemStore) SaveSettings(ctx context.Context, id string, s *game.LobbySettings) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.settings[id]; !ok {
+		m.order = append(m.order, id)
+	}
+	m.settings[id] = data
+	return nil
+}
+
+func (m *MemStore) SaveState(ctx context.Context, id string, s *game.LobbyState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.states[id] = data
+	return nil
+}
+
+func (m *MemStore) SaveDrawOp(ctx context.Context, id string, ops ...*game.Packet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	encoded, err := encodeDrawOps(ops)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.drawOps[id] = append(m.drawOps[id], encoded...)
+	return nil
+}
+
+func (m *MemStore) PopDrawOps(ctx context.Context, id string, count int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops := m.drawOps[id]
+	if count > len(ops) {
+		count = len(ops)
+	}
+	if count > 0 {
+		m.drawOps[id] = ops[:len(ops)-count]
+	}
+	return nil
+}
+
+func (m *MemStore) ClearDrawing(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.drawOps, id)
+	return nil
+}
+
+func (m *MemStore) SaveTurn(ctx context.Context, id string, turn *game.Turn) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(turn)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.turns[id] = append(m.turns[id], data)
+	return nil
+}
+
+func (m *MemStore) ClearTurns(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.turns, id)
+	return nil
+}
+
+func (m *MemStore) Save(ctx context.Context, l *game.Lobby) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	settings, err := msgpack.Marshal(l.Settings)
+	if err != nil {
+		return err
+	}
+	state, err := msgpack.Marshal(l.State)
+	if err != nil {
+		return err
+	}
+	drawOps, err := encodeDrawOps(l.CurrentDrawing.CurrentDrawing)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.settings[l.ID]; !ok {
+		m.order = append(m.order, l.ID)
+	}
+	m.settings[l.ID] = settings
+	m.states[l.ID] = state
+	m.drawOps[l.ID] = drawOps
+	return nil
+}
+
+func (m *MemStore) Load(ctx context.Context, id string) (*game.Lobby, error) {
+	settings, err := m.LoadSettings(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	state, err := m.LoadState(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	drawing, err := m.LoadDrawing(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &game.Lobby{
+		ID:             id,
+		Settings:       settings,
+		State:          state,
+		CurrentDrawing: drawing,
+	}, nil
+}
+
+func (m *MemStore) LoadSettings(ctx context.Context, id string) (*game.LobbySettings, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	data, ok := m.settings[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, game.ErrLobbyNotFound
+	}
+
+	settings := &game.LobbySettings{}
+	return settings, msgpack.Unmarshal(data, settings)
+}
+
+func (m *MemStore) LoadState(ctx context.Context, id string) (*game.LobbyState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	data, ok := m.states[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, game.ErrLobbyNotFound
+	}
+
+	state := &game.LobbyState{}
+	err := msgpack.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	prepareLoadedState(state)
+	return state, nil
+}
+
+func (m *MemStore) LoadDrawing(ctx context.Context, id string) (*game.LobbyDrawing, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	encoded := m.drawOps[id]
+	m.mu.Unlock()
+
+	drawing := &game.LobbyDrawing{CurrentDrawing: make([]*game.Packet, 0, len(encoded))}
+	for _, data := range encoded {
+		op := &game.Packet{}
+		err := msgpack.Unmarshal(data, op)
+		if err != nil {
+			return nil, err
+		}
+		drawing.CurrentDrawing = append(drawing.CurrentDrawing, op)
+	}
+	return drawing, nil
+}
+
+func (m *MemStore) LoadTurns(ctx context.Context, id string) ([]*game.Turn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	encoded := m.turns[id]
+	m.mu.Unlock()
+
+	turns := make([]*game.Turn, 0, len(encoded))
+	for _, data := range encoded {
+		turn := &game.Turn{}
+		err := msgpack.Unmarshal(data, turn)
+		if err != nil {
+			return nil, err
+		}
+		turns = append(turns, turn)
+	}
+	return turns, nil
+}
+
+func (m *MemStore) List(ctx context.Context, opts game.ListOptions) (*game.LobbyPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = game.DefaultListLimit
+	}
+
+	m.mu.Lock()
+	order := append([]string(nil), m.order...)
+	m.mu.Unlock()
+
+	page := &game.LobbyPage{Lobbies: []*game.LobbySummary{}}
+	for cursor := opts.Cursor; cursor < int64(len(order)); cursor++ {
+		id := order[cursor]
+		settings, err := m.LoadSettings(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		state, err := m.LoadState(ctx, id)
+		if err == game.ErrLobbyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		summary := game.NewLobbySummary(id, settings, state)
+		if !opts.Matches(summary) {
+			continue
+		}
+
+		page.Lobbies = append(page.Lobbies, summary)
+		if len(page.Lobbies) == limit {
+			if cursor+1 < int64(len(order)) {
+				page.Next = cursor + 1
+			}
+			break
+		}
+	}
+	return page, nil
+}
+
+func (m *MemStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.settings, id)
+	delete(m.states, id)
+	delete(m.drawOps, id)
+	delete(m.turns, id)
+	for i, other := range m.order {
+		if other == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func encodeDrawOps(ops []*game.Packet) ([][]byte, error) {
+	encoded := make([][]byte, 0, len(ops))
+	for _, op := range ops {
+		data, err := msgpack.Marshal(op)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, data)
+	}
+	return encoded, nil
+}
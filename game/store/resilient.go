@@ -0,0 +1,506 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// ErrStoreUnavailable is returned for reads while the backend of a
+// ResilientStore is considered down.
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// Health states reported by ResilientStore.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// Health describes the state of the persistence layer.
+type Health struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	BufferedWrites      int       `json:"bufferedWrites"`
+	RejectedWrites      int       `json:"rejectedWrites"`
+	DirtyLobbies        int       `json:"dirtyLobbies"`
+	LastError           string    `json:"lastError,omitempty"`
+	DegradedSince       time.Time `json:"degradedSince,omitempty"`
+}
+
+// bufferedWrite is a write that couldn't reach the backend yet. Its data has
+// been copied when it was buffered, so the game can keep mutating the lobby.
+type bufferedWrite func(ctx context.Context, backend game.LobbyStore) error
+
+// pendingWrite is a buffered write of a lobby.
+type pendingWrite struct {
+	lobbyID string
+	apply   bufferedWrite
+	// replaces is set for writes that replace everything stored before.
+	replaces bool
+	attempts int
+}
+
+// ResilientStore wraps another store. Reads are retried with exponential
+// backoff. Writes are issued while the game holds the lock of the lobby,
+// therefore they are tried only once and buffered if that fails. While the
+// circuit breaker is open, reads fail fast and writes are kept in a bounded
+// in-memory buffer, which RunRecovery replays once the backend works again.
+// If the buffer overflows, the lobby is marked dirty and all its buffered
+// writes are dropped, as replaying only some of them would leave the lobby
+// inconsistent. The same happens to writes that still fail after
+// MaxReplayAttempts replays, so that they can't block the buffer. Dirty
+// lobbies are saved in full once the rest of the buffer has been replayed.
+// Reads open the breaker after FailureThreshold consecutive failures. A
+// failed write opens it right away, as all following writes have to be
+// buffered to keep their order.
+type ResilientStore struct {
+	backend game.LobbyStore
+
+	MaxRetries        int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	FailureThreshold  int
+	BufferSize        int
+	MaxReplayAttempts int
+
+	mu             sync.Mutex
+	open           bool
+	failures       int
+	lastErr        error
+	degradedSince  time.Time
+	buffer         []*pendingWrite
+	rejectedWrites int
+	// dirty are the IDs of the lobbies whose writes have been dropped.
+	dirty map[string]bool
+}
+
+func NewResilientStore(backend game.LobbyStore) *ResilientStore {
+	return &ResilientStore{
+		backend:           backend,
+		MaxRetries:        2,
+		InitialBackoff:    50 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		FailureThreshold:  3,
+		BufferSize:        10000,
+		MaxReplayAttempts: 10,
+
+		dirty: map[string]bool{},
+	}
+}
+
+// Health returns a snapshot of the current state of the store.
+func (s *ResilientStore) Health() Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	health := Health{
+		State:               HealthOK,
+		ConsecutiveFailures: s.failures,
+		BufferedWrites:      len(s.buffer),
+		RejectedWrites:      s.rejectedWrites,
+		DirtyLobbies:        len(s.dirty),
+	}
+	if s.open {
+		health.State = HealthDegraded
+		health.DegradedSince = s.degradedSince
+	}
+	if s.lastErr != nil {
+		health.LastError = s.lastErr.Error()
+	}
+	return health
+}
+
+// RunRecovery tries replaying buffered writes every interval until stop is
+// closed. A successful replay closes the circuit breaker again.
+func (s *ResilientStore) RunRecovery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.replay()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// replay applies the buffered writes in order, stopping at the first failure.
+// Afterwards, the dirty lobbies are saved in full. The circuit breaker stays
+// open until that has worked as well. A write that has failed
+// MaxReplayAttempts times is dropped and its lobby marked dirty. Writes that
+// replace the lobby are dropped without marking it, as saving it in full
+// again would fail the same way.
+func (s *ResilientStore) replay() {
+	resaved := false
+	for {
+		s.mu.Lock()
+		if len(s.buffer) == 0 && len(s.dirty) > 0 {
+			dirty := make([]string, 0, len(s.dirty))
+			for id := range s.dirty {
+				dirty = append(dirty, id)
+			}
+			s.mu.Unlock()
+
+			// Saving might have overflowed the buffer again.
+			if resaved {
+				return
+			}
+			s.resave(dirty)
+			resaved = true
+			continue
+		}
+		if len(s.buffer) == 0 {
+			if s.open {
+				s.open = false
+				s.failures = 0
+				log.Println("store recovered, persistence is working again")
+			}
+			s.mu.Unlock()
+			return
+		}
+		next := s.buffer[0]
+		s.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), game.StoreTimeout)
+		err := next.apply(ctx, s.backend)
+		cancel()
+
+		s.mu.Lock()
+		// The write might have been dropped in the meantime, because its
+		// lobby has been marked dirty.
+		head := len(s.buffer) > 0 && s.buffer[0] == next
+		if err == nil {
+			if head {
+				s.buffer = s.buffer[1:]
+			}
+			s.mu.Unlock()
+			continue
+		}
+
+		s.recordFailure(err)
+		next.attempts++
+		if head && next.attempts >= s.MaxReplayAttempts {
+			log.Printf("Dropping write of lobby %s after %d failed attempts: %s\n", next.lobbyID, next.attempts, err)
+			if next.replaces {
+				s.buffer = s.buffer[1:]
+				s.rejectedWrites++
+			} else {
+				s.markDirty(next.lobbyID)
+			}
+		}
+		s.mu.Unlock()
+		return
+	}
+}
+
+// resave buffers full saves of the given dirty lobbies. Lobbies that aren't
+// running anymore can't be saved, their stored data is deleted instead.
+func (s *ResilientStore) resave(ids []string) {
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(context.Background(), game.StoreTimeout)
+		var err error
+		if lobby := game.GetLobby(id); lobby != nil {
+			err = lobby.SaveTo(ctx, s)
+		} else {
+			err = s.Delete(ctx, id)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Error saving dirty lobby %s: %s\n", id, err)
+		}
+	}
+}
+
+// recordFailure must be called while holding mu.
+func (s *ResilientStore) recordFailure(err error) {
+	s.failures++
+	s.lastErr = err
+	if s.failures >= s.FailureThreshold {
+		s.openBreaker()
+	}
+}
+
+// openBreaker must be called while holding mu.
+func (s *ResilientStore) openBreaker() {
+	if s.open {
+		return
+	}
+	s.open = true
+	s.degradedSince = time.Now()
+	log.Printf("store degraded after %d failures: %s\n", s.failures, s.lastErr)
+}
+
+// recordSuccess must be called while holding mu.
+func (s *ResilientStore) recordSuccess() {
+	if !s.open {
+		s.failures = 0
+	}
+}
+
+// retryable decides whether a failed call could succeed on a later attempt.
+func retryable(err error) bool {
+	return err != game.ErrLobbyNotFound &&
+		err != context.Canceled &&
+		err != context.DeadlineExceeded
+}
+
+// call runs fn with retries and exponential backoff. Failures that aren't
+// retryable don't count towards opening the circuit breaker. Only reads are
+// retried, as writes would stall the lobby that is being written.
+func (s *ResilientStore) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := s.InitialBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn(ctx)
+		if err == nil || !retryable(err) {
+			s.mu.Lock()
+			s.recordSuccess()
+			s.mu.Unlock()
+			return err
+		}
+		if attempt >= s.MaxRetries {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+
+	s.mu.Lock()
+	s.recordFailure(err)
+	s.mu.Unlock()
+	return err
+}
+
+func (s *ResilientStore) read(ctx context.Context, fn func(ctx context.Context) error) error {
+	s.mu.Lock()
+	open := s.open
+	s.mu.Unlock()
+	if open {
+		return ErrStoreUnavailable
+	}
+
+	return s.call(ctx, fn)
+}
+
+// write writes to the backend or buffers the write. Writes of dirty lobbies
+// are dropped, unless they replace everything that has been stored before,
+// which makes the lobby consistent again.
+func (s *ResilientStore) write(ctx context.Context, id string, replaces bool, w bufferedWrite) error {
+	s.mu.Lock()
+	if replaces {
+		delete(s.dirty, id)
+	}
+	if s.dirty[id] {
+		s.rejectedWrites++
+		s.mu.Unlock()
+		return nil
+	}
+	if s.open || len(s.buffer) > 0 {
+		defer s.mu.Unlock()
+		s.enqueue(id, replaces, w)
+		return nil
+	}
+	s.mu.Unlock()
+
+	err := w(ctx, s.backend)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.recordSuccess()
+		return nil
+	}
+	s.failures++
+	s.lastErr = err
+	s.openBreaker()
+	s.enqueue(id, replaces, w)
+	return nil
+}
+
+// enqueue buffers the write. If the buffer is full, the lobby is marked
+// dirty instead. enqueue must be called while holding mu.
+func (s *ResilientStore) enqueue(id string, replaces bool, w bufferedWrite) {
+	if len(s.buffer) < s.BufferSize {
+		s.buffer = append(s.buffer, &pendingWrite{lobbyID: id, apply: w, replaces: replaces})
+		return
+	}
+
+	log.Printf("store write buffer full, lobby %s will be saved in full on recovery\n", id)
+	s.markDirty(id)
+	s.rejectedWrites++
+}
+
+// markDirty drops the buffered writes of the lobby, it is saved in full on
+// recovery instead. markDirty must be called while holding mu.
+func (s *ResilientStore) markDirty(id string) {
+	s.dirty[id] = true
+	kept := make([]*pendingWrite, 0, len(s.buffer))
+	for _, pending := range s.buffer {
+		if pending.lobbyID == id {
+			s.rejectedWrites++
+		} else {
+			kept = append(kept, pending)
+		}
+	}
+	s.buffer = kept
+}
+
+func (s *ResilientStore) SaveSettings(ctx context.Context, id string, settings *game.LobbySettings) error {
+	settings, err := cloneSettings(settings)
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, id, false, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.SaveSettings(ctx, id, settings)
+	})
+}
+
+func (s *ResilientStore) SaveState(ctx context.Context, id string, state *game.LobbyState) error {
+	state, err := cloneState(state)
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, id, false, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.SaveState(ctx, id, state)
+	})
+}
+
+func (s *ResilientStore) SaveDrawOp(ctx context.Context, id string, ops ...*game.Packet) error {
+	ops = append([]*game.Packet(nil), ops...)
+	return s.write(ctx, id, false, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.SaveDrawOp(ctx, id, ops...)
+	})
+}
+
+func (s *ResilientStore) PopDrawOps(ctx context.Context, id string, count int) error {
+	return s.write(ctx, id, false, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.PopDrawOps(ctx, id, count)
+	})
+}
+
+func (s *ResilientStore) ClearDrawing(ctx context.Context, id string) error {
+	return s.write(ctx, id, false, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.ClearDrawing(ctx, id)
+	})
+}
+
+// SaveTurn doesn't copy the turn, as finished turns aren't changed anymore.
+func (s *ResilientStore) SaveTurn(ctx context.Context, id string, turn *game.Turn) error {
+	return s.write(ctx, id, false, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.SaveTurn(ctx, id, turn)
+	})
+}
+
+func (s *ResilientStore) ClearTurns(ctx context.Context, id string) error {
+	return s.write(ctx, id, false, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.ClearTurns(ctx, id)
+	})
+}
+
+func (s *ResilientStore) Save(ctx context.Context, l *game.Lobby) error {
+	settings, err := cloneSettings(l.Settings)
+	if err != nil {
+		return err
+	}
+	state, err := cloneState(l.State)
+	if err != nil {
+		return err
+	}
+	snapshot := &game.Lobby{
+		ID:       l.ID,
+		Settings: settings,
+		State:    state,
+		CurrentDrawing: &game.LobbyDrawing{
+			CurrentDrawing: append([]*game.Packet(nil), l.CurrentDrawing.CurrentDrawing...),
+		},
+	}
+	return s.write(ctx, l.ID, true, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.Save(ctx, snapshot)
+	})
+}
+
+func (s *ResilientStore) Delete(ctx context.Context, id string) error {
+	return s.write(ctx, id, true, func(ctx context.Context, backend game.LobbyStore) error {
+		return backend.Delete(ctx, id)
+	})
+}
+
+func (s *ResilientStore) Load(ctx context.Context, id string) (l *game.Lobby, err error) {
+	err = s.read(ctx, func(ctx context.Context) error {
+		l, err = s.backend.Load(ctx, id)
+		return err
+	})
+	return l, err
+}
+
+func (s *ResilientStore) LoadSettings(ctx context.Context, id string) (settings *game.LobbySettings, err error) {
+	err = s.read(ctx, func(ctx context.Context) error {
+		settings, err = s.backend.LoadSettings(ctx, id)
+		return err
+	})
+	return settings, err
+}
+
+func (s *ResilientStore) LoadState(ctx context.Context, id string) (state *game.LobbyState, err error) {
+	err = s.read(ctx, func(ctx context.Context) error {
+		state, err = s.backend.LoadState(ctx, id)
+		return err
+	})
+	return state, err
+}
+
+func (s *ResilientStore) LoadDrawing(ctx context.Context, id string) (drawing *game.LobbyDrawing, err error) {
+	err = s.read(ctx, func(ctx context.Context) error {
+		drawing, err = s.backend.LoadDrawing(ctx, id)
+		return err
+	})
+	return drawing, err
+}
+
+func (s *ResilientStore) LoadTurns(ctx context.Context, id string) (turns []*game.Turn, err error) {
+	err = s.read(ctx, func(ctx context.Context) error {
+		turns, err = s.backend.LoadTurns(ctx, id)
+		return err
+	})
+	return turns, err
+}
+
+func (s *ResilientStore) List(ctx context.Context, opts game.ListOptions) (page *game.LobbyPage, err error) {
+	err = s.read(ctx, func(ctx context.Context) error {
+		page, err = s.backend.List(ctx, opts)
+		return err
+	})
+	return page, err
+}
+
+func cloneSettings(settings *game.LobbySettings) (*game.LobbySettings, error) {
+	data, err := settings.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	clone := &game.LobbySettings{}
+	return clone, clone.UnmarshalBinary(data)
+}
+
+func cloneState(state *game.LobbyState) (*game.LobbyState, error) {
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	clone := &game.LobbyState{}
+	return clone, clone.UnmarshalBinary(data)
+}
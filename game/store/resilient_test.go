@@ -0,0 +1,246 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errBackendDown = errors.New("backend down")
+	errPoison      = errors.New("poisoned draw op")
+)
+
+// flakyStore fails every call while down is set. Draw ops of the type
+// "poison" can never be saved.
+type flakyStore struct {
+	*MemStore
+	down  int32
+	calls int32
+}
+
+func (f *flakyStore) check() error {
+	atomic.AddInt32(&f.calls, 1)
+	if atomic.LoadInt32(&f.down) == 1 {
+		return errBackendDown
+	}
+	return nil
+}
+
+func (f *flakyStore) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&f.down, 1)
+	} else {
+		atomic.StoreInt32(&f.down, 0)
+	}
+}
+
+func (f *flakyStore) SaveState(ctx context.Context, id string, s *game.LobbyState) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.MemStore.SaveState(ctx, id, s)
+}
+
+func (f *flakyStore) SaveDrawOp(ctx context.Context, id string, ops ...*game.Packet) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Type == "poison" {
+			return errPoison
+		}
+	}
+	return f.MemStore.SaveDrawOp(ctx, id, ops...)
+}
+
+func (f *flakyStore) Save(ctx context.Context, l *game.Lobby) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.MemStore.Save(ctx, l)
+}
+
+func (f *flakyStore) Load(ctx context.Context, id string) (*game.Lobby, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.MemStore.Load(ctx, id)
+}
+
+func newTestResilientStore() (*ResilientStore, *flakyStore) {
+	backend := &flakyStore{MemStore: NewMemStore()}
+	st := NewResilientStore(backend)
+	st.InitialBackoff = time.Millisecond
+	st.MaxBackoff = time.Millisecond
+	return st, backend
+}
+
+func TestResilientStoreRetries(t *testing.T) {
+	ctx := context.Background()
+	st, backend := newTestResilientStore()
+
+	l := NewTestLobby()
+	require.Nil(t, st.Save(ctx, l))
+
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "a"}))
+
+	backend.setDown(true)
+	go func() {
+		time.Sleep(time.Millisecond)
+		backend.setDown(false)
+	}()
+	st.InitialBackoff = 5 * time.Millisecond
+	st.MaxBackoff = 5 * time.Millisecond
+	st.MaxRetries = 10
+	_l, err := st.Load(ctx, l.ID)
+	require.Nil(t, err)
+	require.Len(t, _l.CurrentDrawing.CurrentDrawing, 1)
+	require.Equal(t, HealthOK, st.Health().State)
+
+	// Writes are tried only once, as the game holds the lock of the lobby
+	// while writing.
+	backend.setDown(true)
+	calls := atomic.LoadInt32(&backend.calls)
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "b"}))
+	require.Equal(t, calls+1, atomic.LoadInt32(&backend.calls))
+	require.Equal(t, 1, st.Health().BufferedWrites)
+	backend.setDown(false)
+	st.replay()
+
+	// Missing lobbies aren't worth retrying.
+	calls = atomic.LoadInt32(&backend.calls)
+	_, err = st.Load(ctx, "unknown")
+	require.Equal(t, game.ErrLobbyNotFound, err)
+	require.Equal(t, calls+1, atomic.LoadInt32(&backend.calls))
+}
+
+func TestResilientStoreBuffersWhileDegraded(t *testing.T) {
+	ctx := context.Background()
+	st, backend := newTestResilientStore()
+
+	l := NewTestLobby()
+	require.Nil(t, st.Save(ctx, l))
+
+	backend.setDown(true)
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "line"}))
+
+	health := st.Health()
+	require.Equal(t, HealthDegraded, health.State)
+	require.Equal(t, 1, health.BufferedWrites)
+	require.Equal(t, errBackendDown.Error(), health.LastError)
+
+	// Reads fail fast and writes don't reach the backend anymore.
+	calls := atomic.LoadInt32(&backend.calls)
+	_, err := st.Load(ctx, l.ID)
+	require.Equal(t, ErrStoreUnavailable, err)
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "line"}))
+	l.State.Round = 3
+	require.Nil(t, st.SaveState(ctx, l.ID, l.State))
+	l.State.Round = 4
+	require.Equal(t, calls, atomic.LoadInt32(&backend.calls))
+
+	// Replaying while the backend is still down keeps the buffer.
+	st.replay()
+	require.Equal(t, HealthDegraded, st.Health().State)
+	require.Equal(t, 3, st.Health().BufferedWrites)
+
+	backend.setDown(false)
+	st.replay()
+	health = st.Health()
+	require.Equal(t, HealthOK, health.State)
+	require.Zero(t, health.BufferedWrites)
+
+	_l, err := st.Load(ctx, l.ID)
+	require.Nil(t, err)
+	require.Len(t, _l.CurrentDrawing.CurrentDrawing, 2)
+	// The state as of the buffered write has been persisted.
+	require.Equal(t, 3, _l.State.Round)
+}
+
+func TestResilientStoreBufferLimit(t *testing.T) {
+	ctx := context.Background()
+	st, backend := newTestResilientStore()
+	st.BufferSize = 2
+
+	defaultStore := game.Store
+	game.Store = st
+	defer func() { game.Store = defaultStore }()
+	_, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime: 120,
+		Rounds:      2,
+		MaxPlayers:  4,
+	}, game.NewRecordingBroadcaster())
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	other := NewTestLobby()
+	require.Nil(t, st.Save(ctx, other))
+
+	backend.setDown(true)
+	require.Nil(t, st.SaveDrawOp(ctx, lobby.ID, &game.Packet{Type: "a"}))
+	require.Nil(t, st.SaveDrawOp(ctx, other.ID, &game.Packet{Type: "line"}))
+	// Instead of dropping the write, the lobby is saved in full later on.
+	require.Nil(t, st.SaveDrawOp(ctx, lobby.ID, &game.Packet{Type: "b"}))
+	require.Nil(t, st.SaveDrawOp(ctx, lobby.ID, &game.Packet{Type: "c"}))
+	health := st.Health()
+	require.Equal(t, 1, health.BufferedWrites)
+	require.Equal(t, 1, health.DirtyLobbies)
+	require.Equal(t, 3, health.RejectedWrites)
+
+	lobby.CurrentDrawing.CurrentDrawing = []*game.Packet{{Type: "a"}, {Type: "b"}, {Type: "c"}}
+	backend.setDown(false)
+	st.replay()
+	health = st.Health()
+	require.Equal(t, HealthOK, health.State)
+	require.Zero(t, health.BufferedWrites)
+	require.Zero(t, health.DirtyLobbies)
+
+	loaded, err := st.Load(ctx, lobby.ID)
+	require.Nil(t, err)
+	require.Equal(t, lobby.CurrentDrawing.CurrentDrawing, loaded.CurrentDrawing.CurrentDrawing)
+	loaded, err = st.Load(ctx, other.ID)
+	require.Nil(t, err)
+	require.Len(t, loaded.CurrentDrawing.CurrentDrawing, 1)
+}
+
+func TestResilientStoreDropsPoisonedWrites(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newTestResilientStore()
+	st.MaxReplayAttempts = 3
+
+	l := NewTestLobby()
+	require.Nil(t, st.Save(ctx, l))
+	other := NewTestLobby()
+	other.ID = "other-test-id"
+	require.Nil(t, st.Save(ctx, other))
+
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "poison"}))
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "a"}))
+	require.Nil(t, st.SaveDrawOp(ctx, other.ID, &game.Packet{Type: "b"}))
+	require.Equal(t, 3, st.Health().BufferedWrites)
+
+	// The write blocks the buffer only until it has failed often enough.
+	for i := 0; i < st.MaxReplayAttempts-1; i++ {
+		st.replay()
+		require.Equal(t, 3, st.Health().BufferedWrites)
+	}
+	st.replay()
+	health := st.Health()
+	require.Equal(t, 1, health.BufferedWrites)
+	require.Equal(t, 1, health.DirtyLobbies)
+	require.Equal(t, 2, health.RejectedWrites)
+
+	st.replay()
+	health = st.Health()
+	require.Equal(t, HealthOK, health.State)
+	require.Zero(t, health.BufferedWrites)
+	require.Zero(t, health.DirtyLobbies)
+	loaded, err := st.Load(ctx, other.ID)
+	require.Nil(t, err)
+	require.Len(t, loaded.CurrentDrawing.CurrentDrawing, 1)
+}
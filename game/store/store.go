@@ -1,80 +1,243 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/scribble-rs/scribble.rs/game"
 )
 
+// DefaultLobbyTTL is the time after which the keys of a lobby expire if
+// nothing has been written to it.
+const DefaultLobbyTTL = 24 * time.Hour
+
+// lobbyIndexKey references a sorted set of all lobby IDs, scored by their
+// creation time. It is used for listing lobbies.
+const lobbyIndexKey = "lobbies"
+
 type RedisStore struct {
 	client *redis.Client
+
+	// LobbyTTL is refreshed on every write to a lobby. Once a lobby has been
+	// idle for this long, all of its keys are removed by redis. A value of
+	// zero disables expiry.
+	LobbyTTL time.Duration
 }
 
 func NewRedisStore(options *redis.Options) *RedisStore {
 	client := redis.NewClient(options)
 	return &RedisStore{
-		client: client,
+		client:   client,
+		LobbyTTL: DefaultLobbyTTL,
 	}
 }
 
-func (m *RedisStore) SaveSettings(id string, l *game.LobbySettings) error {
-	cmd := m.client.Set(id+".settings", l, 0)
-	text, err := cmd.Result()
-	fmt.Println("redis-store SaveSettings result:", text)
+func lobbyKeys(id string) []string {
+	return []string{id + ".settings", id + ".state", id + ".draw-ops", id + ".turns"}
+}
 
+// withContext returns a client bound to the given context. go-redis v6
+// doesn't abort commands that are already running, therefore contexts that
+// are done are rejected upfront.
+func (m *RedisStore) withContext(ctx context.Context) (*redis.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.client.WithContext(ctx), nil
+}
+
+// touch queues commands refreshing the expiry of all keys of the lobby.
+func (m *RedisStore) touch(pipe redis.Pipeliner, id string) {
+	if m.LobbyTTL <= 0 {
+		return
+	}
+	for _, key := range lobbyKeys(id) {
+		pipe.Expire(key, m.LobbyTTL)
+	}
+}
+
+func (m *RedisStore) SaveSettings(ctx context.Context, id string, l *game.LobbySettings) error {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(id+".settings", l, 0)
+		pipe.ZAddNX(lobbyIndexKey, redis.Z{Score: float64(time.Now().UnixNano()), Member: id})
+		m.touch(pipe, id)
+		return nil
+	})
 	return err
 }
 
-func (m *RedisStore) SaveState(id string, l *game.LobbyState) error {
-	cmd := m.client.Set(id+".state", l, 0)
-	text, err := cmd.Result()
-	fmt.Println("redis-store SaveState result:", text)
+func (m *RedisStore) SaveState(ctx context.Context, id string, l *game.LobbyState) error {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return err
+	}
 
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(id+".state", l, 0)
+		pipe.ZAddNX(lobbyIndexKey, redis.Z{Score: float64(time.Now().UnixNano()), Member: id})
+		m.touch(pipe, id)
+		return nil
+	})
 	return err
 }
 
-func (m *RedisStore) SaveDrawOp(id string, l ...*game.Packet) error {
-	for _, v := range l {
-		cmd := m.client.RPush(id+".draw-ops", v)
-		text, err := cmd.Result()
-		if err != nil {
+// SaveDrawOp appends the given packets to the draw log of the lobby. All
+// packets are sent with a single RPUSH, so a batch costs one round trip no
+// matter how many line segments it contains.
+func (m *RedisStore) SaveDrawOp(ctx context.Context, id string, l ...*game.Packet) error {
+	if len(l) == 0 {
+		return nil
+	}
+
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(id+".draw-ops", drawOpValues(l)...)
+		m.touch(pipe, id)
+		return nil
+	})
+	return err
+}
+
+// PopDrawOps removes the given number of most recent operations from the
+// draw log of the lobby. Popping more operations than the log contains
+// empties it, which is not an error.
+func (m *RedisStore) PopDrawOps(ctx context.Context, id string, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Logs written before undos were compacted in the store still contain
+	// undo packets. They are compacted here, on the write path, while the log
+	// is watched, so that concurrent appends can't be lost.
+	key := id + ".draw-ops"
+	for {
+		err = client.Watch(func(tx *redis.Tx) error {
+			var ops []*game.Packet
+			err := tx.LRange(key, 0, -1).ScanSlice(&ops)
+			if err != nil {
+				return err
+			}
+
+			compacted := game.CompactDrawOps(ops)
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				if len(compacted) == len(ops) {
+					pipe.LTrim(key, 0, int64(-count-1))
+				} else {
+					pipe.Del(key)
+					if count < len(compacted) {
+						pipe.RPush(key, drawOpValues(compacted[:len(compacted)-count])...)
+					}
+				}
+				m.touch(pipe, id)
+				return nil
+			})
 			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
 		}
-		fmt.Println("redis-store LobbyDrawOp result:", text)
 	}
-	return nil
+	if err == redis.Nil {
+		return nil
+	}
+	return err
 }
 
-func (m *RedisStore) ClearDrawing(id string) error {
+func (m *RedisStore) ClearDrawing(ctx context.Context, id string) error {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return err
+	}
 
-	cmd := m.client.Del(id + ".draw-ops")
-	text, err := cmd.Result()
-	fmt.Println("redis-store ClearDrawing result:", text)
+	return client.Del(id + ".draw-ops").Err()
+}
 
+// SaveTurn appends the turn to the list of finished turns of the lobby.
+func (m *RedisStore) SaveTurn(ctx context.Context, id string, turn *game.Turn) error {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(id+".turns", turn)
+		m.touch(pipe, id)
+		return nil
+	})
 	return err
 }
 
-//https://github.com/go-redis/redis/blob/master/example_test.go
-func (m *RedisStore) Save(l *game.Lobby) (err error) {
-	err = m.SaveState(l.ID, l.State)
+func (m *RedisStore) ClearTurns(ctx context.Context, id string) error {
+	client, err := m.withContext(ctx)
 	if err != nil {
 		return err
 	}
-	err = m.SaveSettings(l.ID, l.Settings)
+
+	return client.Del(id + ".turns").Err()
+}
+
+// Delete removes all keys of the lobby and drops it from the lobby index.
+func (m *RedisStore) Delete(ctx context.Context, id string) error {
+	client, err := m.withContext(ctx)
 	if err != nil {
 		return err
 	}
-	err = m.SaveDrawOp(l.ID, l.CurrentDrawing.CurrentDrawing...)
+
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(lobbyKeys(id)...)
+		pipe.ZRem(lobbyIndexKey, id)
+		return nil
+	})
+	return err
+}
+
+// Save writes state, settings and the current drawing of the lobby inside a
+// single MULTI/EXEC transaction. Either all keys are updated or none, so a
+// crash can't leave a half written lobby behind. The draw log is replaced
+// instead of appended to, since the lobby holds the full drawing.
+func (m *RedisStore) Save(ctx context.Context, l *game.Lobby) error {
+	client, err := m.withContext(ctx)
 	if err != nil {
 		return err
 	}
-	return
+
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(l.ID+".state", l.State, 0)
+		pipe.Set(l.ID+".settings", l.Settings, 0)
+		pipe.Del(l.ID + ".draw-ops")
+		if len(l.CurrentDrawing.CurrentDrawing) > 0 {
+			pipe.RPush(l.ID+".draw-ops", drawOpValues(l.CurrentDrawing.CurrentDrawing)...)
+		}
+		pipe.ZAddNX(lobbyIndexKey, redis.Z{Score: float64(time.Now().UnixNano()), Member: l.ID})
+		m.touch(pipe, l.ID)
+		return nil
+	})
+	return err
 }
 
-//https://github.com/go-redis/redis/blob/master/example_test.go
-func (m *RedisStore) Load(id string) (l *game.Lobby, err error) {
+// Load reads all keys of a lobby in one pipelined round trip.
+func (m *RedisStore) Load(ctx context.Context, id string) (l *game.Lobby, err error) {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	l = &game.Lobby{
 		ID: id,
 		CurrentDrawing: &game.LobbyDrawing{
@@ -84,57 +247,220 @@ func (m *RedisStore) Load(id string) (l *game.Lobby, err error) {
 		State:    &game.LobbyState{},
 	}
 
-	cmd := m.client.Get(id + ".settings")
-	err = cmd.Scan(l.Settings)
+	var (
+		settingsCmd *redis.StringCmd
+		stateCmd    *redis.StringCmd
+		drawOpsCmd  *redis.StringSliceCmd
+	)
+	_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+		settingsCmd = pipe.Get(id + ".settings")
+		stateCmd = pipe.Get(id + ".state")
+		drawOpsCmd = pipe.LRange(id+".draw-ops", 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	err = settingsCmd.Scan(l.Settings)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	err = stateCmd.Scan(l.State)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	prepareLoadedState(l.State)
+
+	err = drawOpsCmd.ScanSlice(&l.CurrentDrawing.CurrentDrawing)
 	if err != nil {
 		return nil, err
 	}
+	l.CurrentDrawing.CurrentDrawing = game.CompactDrawOps(l.CurrentDrawing.CurrentDrawing)
+
+	fmt.Println("redis-store Loaded Lobby:", id)
 
-	cmd = m.client.Get(id + ".state")
-	err = cmd.Scan(l.State)
+	return
+}
+
+// LoadSettings reads only the settings of a lobby.
+func (m *RedisStore) LoadSettings(ctx context.Context, id string) (*game.LobbySettings, error) {
+	client, err := m.withContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, p := range l.State.Players {
-		p.SetWebsocketMutex(&sync.Mutex{})
-		p.Connected = false
+	settings := &game.LobbySettings{}
+	err = client.Get(id + ".settings").Scan(settings)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return settings, nil
+}
 
-		fmt.Println("Loaded Player {name, id, session}:", p.Name, p.ID, p.GetSession())
+// LoadState reads only the state of a lobby, including its players.
+func (m *RedisStore) LoadState(ctx context.Context, id string) (*game.LobbyState, error) {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	cmd2 := m.client.LRange(id+".draw-ops", 0, -1)
-	err = cmd2.ScanSlice(&l.CurrentDrawing.CurrentDrawing)
+	state := &game.LobbyState{}
+	err = client.Get(id + ".state").Scan(state)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	prepareLoadedState(state)
+	return state, nil
+}
+
+// LoadDrawing reads only the draw log of a lobby. Lobbies that don't exist
+// have an empty drawing. Undo packets of old logs are applied to the returned
+// drawing, the stored log is left untouched.
+func (m *RedisStore) LoadDrawing(ctx context.Context, id string) (*game.LobbyDrawing, error) {
+	client, err := m.withContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("redis-store Loaded Lobby:", id)
+	drawing := &game.LobbyDrawing{CurrentDrawing: []*game.Packet{}}
+	err = client.LRange(id+".draw-ops", 0, -1).ScanSlice(&drawing.CurrentDrawing)
+	if err != nil {
+		return nil, err
+	}
 
-	return
+	drawing.CurrentDrawing = game.CompactDrawOps(drawing.CurrentDrawing)
+	return drawing, nil
+}
+
+// LoadTurns reads the finished turns of a lobby. Lobbies that don't exist
+// have none.
+func (m *RedisStore) LoadTurns(ctx context.Context, id string) ([]*game.Turn, error) {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	turns := []*game.Turn{}
+	err = client.LRange(id+".turns", 0, -1).ScanSlice(&turns)
+	if err != nil {
+		return nil, err
+	}
+	return turns, nil
 }
 
-// type MemStore struct {
-// 	lobbies map[string]*game.Lobby
-// }
+// List walks the lobby index and returns the lobbies matching the given
+// filters. Index entries of lobbies whose keys have expired are removed on the
+// way. Entries are only removed if redis reports the keys as missing, other
+// errors are returned.
+func (m *RedisStore) List(ctx context.Context, opts game.ListOptions) (*game.LobbyPage, error) {
+	client, err := m.withContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-// func NewMemStore() *MemStore {
-// 	return &MemStore{
-// 		lobbies: make(map[string]*game.Lobby),
-// 	}
-// }
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = game.DefaultListLimit
+	}
 
-// func (m *MemStore) Save(l *game.Lobby) error {
-// 	m.lobbies[l.ID] = l
-// 	return nil
-// }
+	page := &game.LobbyPage{Lobbies: []*game.LobbySummary{}}
+	cursor := opts.Cursor
+	for {
+		ids, err := client.ZRange(lobbyIndexKey, cursor, cursor+int64(limit)-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return page, nil
+		}
 
-// func (m *MemStore) FindByID(id string) (l *game.Lobby, err error) {
+		settingsCmds := make([]*redis.StringCmd, len(ids))
+		stateCmds := make([]*redis.StringCmd, len(ids))
+		_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				settingsCmds[i] = pipe.Get(id + ".settings")
+				stateCmds[i] = pipe.Get(id + ".state")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
 
-// 	l, ok := m.lobbies[id]
-// 	if !ok {
-// 		return nil, fmt.Errorf("lobby %s not found", l.ID)
-// 	}
+		expired := []interface{}{}
+		for i, id := range ids {
+			cursor++
 
-// 	return l, nil
-// }
+			if settingsCmds[i].Err() == redis.Nil || stateCmds[i].Err() == redis.Nil {
+				expired = append(expired, id)
+				continue
+			}
+
+			settings := &game.LobbySettings{}
+			err = settingsCmds[i].Scan(settings)
+			if err != nil {
+				return nil, err
+			}
+			state := &game.LobbyState{}
+			err = stateCmds[i].Scan(state)
+			if err != nil {
+				return nil, err
+			}
+
+			summary := game.NewLobbySummary(id, settings, state)
+			if !opts.Matches(summary) {
+				continue
+			}
+
+			page.Lobbies = append(page.Lobbies, summary)
+			if len(page.Lobbies) == limit {
+				break
+			}
+		}
+
+		if len(expired) > 0 {
+			err = client.ZRem(lobbyIndexKey, expired...).Err()
+			if err != nil {
+				return nil, err
+			}
+			// All removed entries were located before the cursor.
+			cursor -= int64(len(expired))
+		}
+
+		if len(page.Lobbies) == limit {
+			page.Next = cursor
+			return page, nil
+		}
+	}
+}
+
+// prepareLoadedState restores the parts of the players that aren't
+// persisted. Nobody is connected to a freshly loaded lobby.
+func prepareLoadedState(state *game.LobbyState) {
+	for _, p := range state.Players {
+		p.SetWebsocketMutex(&sync.Mutex{})
+		p.Connected = false
+		p.Reconnecting = false
+
+		fmt.Println("Loaded Player {name, id, session}:", p.Name, p.ID, p.GetSession())
+	}
+}
+
+// notFound translates missing keys into game.ErrLobbyNotFound.
+func notFound(err error) error {
+	if err == redis.Nil {
+		return game.ErrLobbyNotFound
+	}
+	return err
+}
+
+// drawOpValues converts packets into the argument list expected by RPUSH.
+func drawOpValues(ops []*game.Packet) []interface{} {
+	values := make([]interface{}, 0, len(ops))
+	for _, op := range ops {
+		values = append(values, op)
+	}
+	return values
+}
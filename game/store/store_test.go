@@ -1,6 +1,8 @@
 package store
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -42,10 +44,11 @@ func requireLobbiesEqual(t *testing.T, expected, actual *game.Lobby) {
 }
 
 func TestSaveLobby(t *testing.T) {
-	stores := []*RedisStore{
-		// NewMemStore(),
+	ctx := context.Background()
+	stores := []game.LobbyStore{
+		NewMemStore(),
 		NewRedisStore(&redis.Options{
-			Addr: "127.0.01:6379",
+			Addr: "127.0.0.1:6379",
 		}),
 	}
 
@@ -53,10 +56,10 @@ func TestSaveLobby(t *testing.T) {
 		require.NotNil(t, st)
 
 		l := NewTestLobby()
-		err := st.Save(l)
+		err := st.Save(ctx, l)
 		require.Nil(t, err)
 
-		_l, err := st.Load(l.ID)
+		_l, err := st.Load(ctx, l.ID)
 		require.Nil(t, err)
 
 		requireLobbiesEqual(t, l, _l)
@@ -65,16 +68,267 @@ func TestSaveLobby(t *testing.T) {
 			ID: "asdf",
 		}
 
-		require.Nil(t, st.SaveState(l.ID, l.State))
-		require.Nil(t, st.SaveSettings(l.ID, l.Settings))
-		require.Nil(t, st.SaveDrawOp(l.ID, &game.Packet{Type: "a"}))
-		require.Nil(t, st.SaveDrawOp(l.ID, &game.Packet{Type: "b"}))
-		require.Nil(t, st.SaveDrawOp(l.ID, &game.Packet{Type: "C"}))
+		require.Nil(t, st.SaveState(ctx, l.ID, l.State))
+		require.Nil(t, st.SaveSettings(ctx, l.ID, l.Settings))
+		require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "a"}))
+		require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "b"}))
+		require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "C"}))
 
-		_l, err = st.Load(l.ID)
+		_l, err = st.Load(ctx, l.ID)
 		require.Nil(t, err)
 		require.Len(t, _l.State.Players, 1)
 		require.Len(t, _l.CurrentDrawing.CurrentDrawing, 3)
 
+		state, err := st.LoadState(ctx, l.ID)
+		require.Nil(t, err)
+		require.Len(t, state.Players, 1)
+
+		drawing, err := st.LoadDrawing(ctx, l.ID)
+		require.Nil(t, err)
+		require.Len(t, drawing.CurrentDrawing, 3)
+
+		require.Nil(t, st.Delete(ctx, l.ID))
+		_, err = st.LoadSettings(ctx, l.ID)
+		require.Equal(t, game.ErrLobbyNotFound, err)
+	}
+}
+
+func TestListLobbies(t *testing.T) {
+	ctx := context.Background()
+	redisStore := NewRedisStore(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+	require.Nil(t, redisStore.client.Del(lobbyIndexKey).Err())
+
+	stores := []game.LobbyStore{
+		NewMemStore(),
+		redisStore,
+	}
+
+	for _, st := range stores {
+		for i := 0; i < 5; i++ {
+			l := NewTestLobby()
+			l.ID = fmt.Sprintf("list-test-%d", i)
+			l.Settings.Language = "english"
+			if i%2 == 0 {
+				l.Settings.Language = "french"
+			}
+			l.Settings.Public = i < 3
+			require.Nil(t, st.Save(ctx, l))
+		}
+
+		page, err := st.List(ctx, game.ListOptions{Limit: 2})
+		require.Nil(t, err)
+		require.Len(t, page.Lobbies, 2)
+		require.Equal(t, "list-test-0", page.Lobbies[0].ID)
+		require.NotZero(t, page.Next)
+
+		page, err = st.List(ctx, game.ListOptions{Limit: 2, Cursor: page.Next})
+		require.Nil(t, err)
+		require.Len(t, page.Lobbies, 2)
+		require.Equal(t, "list-test-2", page.Lobbies[0].ID)
+
+		public := true
+		page, err = st.List(ctx, game.ListOptions{Language: "french", Public: &public})
+		require.Nil(t, err)
+		require.Len(t, page.Lobbies, 2)
+		require.Zero(t, page.Next)
+
+		// Deleted lobbies must not show up anymore.
+		require.Nil(t, st.Delete(ctx, "list-test-0"))
+		page, err = st.List(ctx, game.ListOptions{})
+		require.Nil(t, err)
+		require.Len(t, page.Lobbies, 4)
+		require.Equal(t, "list-test-1", page.Lobbies[0].ID)
+
+		// Saving the state adds lobbies that are missing from the index.
+		if st == redisStore {
+			require.Nil(t, redisStore.client.ZRem(lobbyIndexKey, "list-test-1").Err())
+			require.Nil(t, st.SaveState(ctx, "list-test-1", NewTestLobby().State))
+			page, err = st.List(ctx, game.ListOptions{})
+			require.Nil(t, err)
+			require.Len(t, page.Lobbies, 4)
+		}
+
+		for i := 1; i < 5; i++ {
+			require.Nil(t, st.Delete(ctx, fmt.Sprintf("list-test-%d", i)))
+		}
+	}
+}
+
+func TestUndoCompactsDrawOps(t *testing.T) {
+	ctx := context.Background()
+	st := NewRedisStore(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+
+	l := NewTestLobby()
+	require.Nil(t, st.Save(ctx, l))
+
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "a"}, &game.Packet{Type: "b"}, &game.Packet{Type: "c"}))
+	require.Nil(t, st.PopDrawOps(ctx, l.ID, 1))
+
+	_l, err := st.Load(ctx, l.ID)
+	require.Nil(t, err)
+	require.Len(t, _l.CurrentDrawing.CurrentDrawing, 2)
+	require.Equal(t, "b", _l.CurrentDrawing.CurrentDrawing[1].Type)
+
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "c"}, &game.Packet{Type: "d"}))
+	require.Nil(t, st.PopDrawOps(ctx, l.ID, 3))
+	_l, err = st.Load(ctx, l.ID)
+	require.Nil(t, err)
+	require.Len(t, _l.CurrentDrawing.CurrentDrawing, 1)
+	require.Equal(t, "a", _l.CurrentDrawing.CurrentDrawing[0].Type)
+
+	// Popping more than the log contains empties it.
+	require.Nil(t, st.PopDrawOps(ctx, l.ID, 5))
+	_l, err = st.Load(ctx, l.ID)
+	require.Nil(t, err)
+	require.Empty(t, _l.CurrentDrawing.CurrentDrawing)
+
+	// Popping an empty log must not fail.
+	require.Nil(t, st.ClearDrawing(ctx, l.ID))
+	require.Nil(t, st.PopDrawOps(ctx, l.ID, 1))
+
+	// Undo packets of old logs are applied on load, but only the next undo
+	// rewrites the stored log.
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "a"}, &game.Packet{Type: "undo"}, &game.Packet{Type: "b"}, &game.Packet{Type: "c"}, &game.Packet{Type: "undo"}))
+	_l, err = st.Load(ctx, l.ID)
+	require.Nil(t, err)
+	require.Len(t, _l.CurrentDrawing.CurrentDrawing, 1)
+	require.Equal(t, "b", _l.CurrentDrawing.CurrentDrawing[0].Type)
+	require.Equal(t, int64(5), st.client.LLen(l.ID+".draw-ops").Val())
+
+	require.Nil(t, st.SaveDrawOp(ctx, l.ID, &game.Packet{Type: "d"}, &game.Packet{Type: "e"}))
+	require.Nil(t, st.PopDrawOps(ctx, l.ID, 1))
+	require.Equal(t, int64(2), st.client.LLen(l.ID+".draw-ops").Val())
+	_l, err = st.Load(ctx, l.ID)
+	require.Nil(t, err)
+	require.Len(t, _l.CurrentDrawing.CurrentDrawing, 2)
+	require.Equal(t, "b", _l.CurrentDrawing.CurrentDrawing[0].Type)
+	require.Equal(t, "d", _l.CurrentDrawing.CurrentDrawing[1].Type)
+}
+
+func TestTurnArchive(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range map[string]game.LobbyStore{
+		"redis": NewRedisStore(&redis.Options{Addr: "127.0.0.1:6379"}),
+		"mem":   NewMemStore(),
+	} {
+		l := NewTestLobby()
+		require.Nil(t, st.Save(ctx, l), name)
+
+		turns, err := st.LoadTurns(ctx, l.ID)
+		require.Nil(t, err, name)
+		require.Empty(t, turns, name)
+
+		turn := &game.Turn{
+			TurnSummary: game.TurnSummary{
+				Number:   1,
+				Round:    1,
+				Drawer:   "drawer",
+				Word:     "word",
+				Guessers: []string{"first", "second"},
+			},
+			Drawing: []*game.Packet{{Type: game.PacketFill, Data: []byte(`{"x":1}`)}},
+			Ops:     []*game.TimedDrawOp{{Time: 1500, Op: &game.Packet{Type: game.PacketFill, Data: []byte(`{"x":1}`)}}},
+		}
+		require.Nil(t, st.SaveTurn(ctx, l.ID, turn), name)
+		require.Nil(t, st.SaveTurn(ctx, l.ID, &game.Turn{TurnSummary: game.TurnSummary{Number: 2}}), name)
+
+		turns, err = st.LoadTurns(ctx, l.ID)
+		require.Nil(t, err, name)
+		require.Len(t, turns, 2, name)
+		require.Equal(t, turn.TurnSummary, turns[0].TurnSummary, name)
+		require.Equal(t, turn.Drawing, turns[0].Drawing, name)
+		require.Equal(t, turn.Ops, turns[0].Ops, name)
+		require.Equal(t, 2, turns[1].Number, name)
+
+		require.Nil(t, st.ClearTurns(ctx, l.ID), name)
+		turns, err = st.LoadTurns(ctx, l.ID)
+		require.Nil(t, err, name)
+		require.Empty(t, turns, name)
+
+		require.Nil(t, st.SaveTurn(ctx, l.ID, turn), name)
+		require.Nil(t, st.Delete(ctx, l.ID), name)
+		turns, err = st.LoadTurns(ctx, l.ID)
+		require.Nil(t, err, name)
+		require.Empty(t, turns, name)
+	}
+}
+
+func TestLobbyExpiry(t *testing.T) {
+	ctx := context.Background()
+	st := NewRedisStore(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+	st.LobbyTTL = time.Minute
+
+	l := NewTestLobby()
+	l.CurrentDrawing.CurrentDrawing = []*game.Packet{{Type: "a"}}
+	require.Nil(t, st.Save(ctx, l))
+	require.Nil(t, st.SaveTurn(ctx, l.ID, &game.Turn{}))
+
+	for _, key := range lobbyKeys(l.ID) {
+		ttl, err := st.client.TTL(key).Result()
+		require.Nil(t, err)
+		require.True(t, ttl > 0 && ttl <= time.Minute, key)
+	}
+
+	require.Nil(t, st.Delete(ctx, l.ID))
+	_, err := st.Load(ctx, l.ID)
+	require.Equal(t, game.ErrLobbyNotFound, err)
+}
+
+func newBenchmarkDrawOps(count int) []*game.Packet {
+	ops := make([]*game.Packet, 0, count)
+	for i := 0; i < count; i++ {
+		ops = append(ops, &game.Packet{
+			Type: "line",
+			Data: []byte(fmt.Sprintf(`{"fromX":%d,"fromY":%d,"toX":%d,"toY":%d,"color":"#000000","lineWidth":5,"gestureId":1}`, i, i, i+1, i+1)),
+		})
+	}
+	return ops
+}
+
+// BenchmarkSaveDrawOp compares persisting a stroke one segment at a time,
+// which costs a round trip per segment, against a single batched call.
+func BenchmarkSaveDrawOp(b *testing.B) {
+	st := NewRedisStore(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+	ops := newBenchmarkDrawOps(100)
+	ctx := context.Background()
+
+	b.Run("PerOp", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, op := range ops {
+				require.Nil(b, st.SaveDrawOp(ctx, "bench-id", op))
+			}
+			require.Nil(b, st.ClearDrawing(ctx, "bench-id"))
+		}
+	})
+
+	b.Run("Batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			require.Nil(b, st.SaveDrawOp(ctx, "bench-id", ops...))
+			require.Nil(b, st.ClearDrawing(ctx, "bench-id"))
+		}
+	})
+}
+
+// BenchmarkSave measures writing a whole lobby, including its drawing, in one
+// transaction.
+func BenchmarkSave(b *testing.B) {
+	st := NewRedisStore(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+	l := NewTestLobby()
+	l.ID = "bench-id"
+	l.CurrentDrawing.CurrentDrawing = newBenchmarkDrawOps(100)
+
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		require.Nil(b, st.Save(ctx, l))
 	}
 }
@@ -0,0 +1,162 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// TimedDrawOp is a change of the drawing made during a turn. Besides line
+// and fill packets, the log of a turn contains undo packets, which remove the
+// latest gesture, and clear-drawing-board packets. The data of an undo packet
+// is the number of operations removed from the stored drawing, which can be
+// less than the logged ones, if its lines have been simplified.
+type TimedDrawOp struct {
+	// Time is the number of milliseconds since the turn started.
+	Time int64   `json:"time"`
+	Op   *Packet `json:"op"`
+}
+
+// Turn is a finished turn of the current game, kept so it can be looked at
+// again once it is over. Turns are persisted by the Store, so the gallery of
+// a game survives restarts.
+type Turn struct {
+	TurnSummary
+	// Drawing is the drawing as it was when the turn ended.
+	Drawing []*Packet `json:"drawing"`
+	// Ops are all changes of the drawing in the order they were made.
+	Ops []*TimedDrawOp `json:"ops"`
+}
+
+func (m *Turn) MarshalBinary() ([]byte, error) {
+	return msgpack.Marshal(&m)
+}
+
+func (m *Turn) UnmarshalBinary(data []byte) error {
+	return msgpack.Unmarshal(data, &m)
+}
+
+// TurnSummary describes a finished turn without its drawing.
+type TurnSummary struct {
+	// Number counts the turns of the game, starting at 1.
+	Number int    `json:"number"`
+	Round  int    `json:"round"`
+	Drawer string `json:"drawer"`
+	Word   string `json:"word"`
+	// Guessers are the names of the players that guessed the word, in the
+	// order they did.
+	Guessers []string `json:"guessers"`
+}
+
+// startTurnLog starts recording the changes of the drawing for a new turn.
+func (l *Lobby) startTurnLog() {
+	l.turnStart = time.Now()
+	l.turnOps = nil
+	l.turnGuessers = nil
+}
+
+// logDrawOps adds changes of the drawing to the log of the current turn.
+func (l *Lobby) logDrawOps(ops ...*Packet) {
+	now := int64(time.Since(l.turnStart) / time.Millisecond)
+	for _, op := range ops {
+		l.turnOps = append(l.turnOps, &TimedDrawOp{Time: now, Op: op})
+	}
+}
+
+// logUndo adds the removal of the given number of operations to the log of
+// the current turn.
+func (l *Lobby) logUndo(count int) {
+	data, err := json.Marshal(count)
+	if err != nil {
+		panic(err)
+	}
+	l.logDrawOps(&Packet{Type: PacketUndo, Data: data})
+}
+
+// archiveTurn keeps the turn that is ending, unless no word has been chosen,
+// in which case nothing could have been drawn. The archived turn is
+// announced to all players.
+func (l *Lobby) archiveTurn() {
+	if l.State.CurrentWord == "" {
+		return
+	}
+
+	turn := &Turn{
+		TurnSummary: TurnSummary{
+			Round:    l.State.Round,
+			Word:     l.State.CurrentWord,
+			Guessers: append([]string{}, l.turnGuessers...),
+		},
+		// Copied, as the drawing is cleared for the next turn.
+		Drawing: append([]*Packet{}, l.CurrentDrawing.CurrentDrawing...),
+		Ops:     l.turnOps,
+	}
+	if drawer, ok := l.State.Players[l.State.Drawer]; ok {
+		turn.Drawer = drawer.Name
+	}
+	l.turnOps = nil
+	l.turnGuessers = nil
+
+	l.turnsMu.Lock()
+	turn.Number = len(l.turns) + 1
+	l.turns = append(l.turns, turn)
+	l.turnsMu.Unlock()
+
+	ctx, cancel := storeContext()
+	err := Store.SaveTurn(ctx, l.ID, turn)
+	cancel()
+	if err != nil {
+		fmt.Println("store SaveTurn error:", err)
+	}
+
+	l.broadcaster.TriggerComplexUpdateEvent(EventTurnOver, &turn.TurnSummary, l)
+}
+
+// resetTurns forgets the turns of the previous game.
+func (l *Lobby) resetTurns() {
+	l.turnsMu.Lock()
+	l.turns = nil
+	l.turnsMu.Unlock()
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	err := Store.ClearTurns(ctx, l.ID)
+	if err != nil {
+		fmt.Println("store ClearTurns error:", err)
+	}
+}
+
+// Turn returns the finished turn with the given number, or nil if there is
+// none.
+func (l *Lobby) Turn(number int) *Turn {
+	l.turnsMu.Lock()
+	defer l.turnsMu.Unlock()
+
+	if number < 1 || number > len(l.turns) {
+		return nil
+	}
+	return l.turns[number-1]
+}
+
+// Turns returns all finished turns of the current game, in the order they
+// were played.
+func (l *Lobby) Turns() []*Turn {
+	l.turnsMu.Lock()
+	defer l.turnsMu.Unlock()
+
+	return append([]*Turn(nil), l.turns...)
+}
+
+// TurnSummaries describes all finished turns of the current game, in the
+// order they were played.
+func (l *Lobby) TurnSummaries() []*TurnSummary {
+	turns := l.Turns()
+	summaries := make([]*TurnSummary, 0, len(turns))
+	for _, turn := range turns {
+		summaries = append(summaries, &turn.TurnSummary)
+	}
+	return summaries
+}
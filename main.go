@@ -15,15 +15,61 @@ import (
 )
 
 var (
-	portHTTP  *int
-	redisHost = os.Getenv("REDIS_HOST")
-	redisPort = os.Getenv("REDIS_PORT")
+	portHTTP        *int
+	lobbyTTL        *time.Duration
+	idleTimeout     *time.Duration
+	sweepInterval   *time.Duration
+	gracePeriod     *time.Duration
+	drawBatchWindow *time.Duration
+	clusterMode     *bool
+	nodeID          *string
+	sendQueueSize   *int
+	pingInterval    *time.Duration
+	pongTimeout     *time.Duration
+	writeTimeout    *time.Duration
+	timelapseFPS    *int
+	timelapseLength *time.Duration
+	timelapseRender *int
+	snapshotOps     *int
+	snapshotKeep    *int
+	simplify        *float64
+	maxReplays      *int
+	redisHost       = os.Getenv("REDIS_HOST")
+	redisPort       = os.Getenv("REDIS_PORT")
 )
 
 func main() {
 	portHTTP = flag.Int("portHTTP", 8080, "defines the port to be used for http mode")
+	lobbyTTL = flag.Duration("lobbyTTL", store.DefaultLobbyTTL, "time after which stored lobbies without any activity expire, 0 disables expiry")
+	idleTimeout = flag.Duration("lobbyIdleTimeout", game.LobbyIdleTimeout, "time after which lobbies without connected players are removed")
+	sweepInterval = flag.Duration("lobbySweepInterval", 5*time.Minute, "interval in which abandoned lobbies are looked for")
+	gracePeriod = flag.Duration("reconnectGracePeriod", game.ReconnectGracePeriod, "time a disconnected drawer has to reconnect before their turn ends")
+	drawBatchWindow = flag.Duration("drawBatchWindow", game.DrawBatchWindow, "time drawing packets are collected before they are sent as one batch, 0 disables batching")
+	clusterMode = flag.Bool("cluster", false, "run as one of several instances sharing the same redis")
+	nodeID = flag.String("nodeID", "", "unique name of this instance in cluster mode, random if empty")
+	sendQueueSize = flag.Int("sendQueueSize", server.SendQueueSize, "number of outgoing messages buffered per client before it is disconnected as too slow")
+	pingInterval = flag.Duration("pingInterval", server.PingInterval, "interval in which clients are pinged")
+	pongTimeout = flag.Duration("pongTimeout", server.PongTimeout, "time after which clients that don't answer pings are disconnected, has to be longer than pingInterval")
+	writeTimeout = flag.Duration("writeTimeout", server.WriteTimeout, "time a single write to a client may take")
+	timelapseFPS = flag.Int("timelapseFrameRate", server.TimelapseFrameRate, "frames per second of the timelapses of finished turns")
+	timelapseLength = flag.Duration("timelapseLength", server.TimelapseLength, "longest duration of a timelapse, longer turns are sped up")
+	timelapseRender = flag.Int("timelapseRenders", server.TimelapseRenders, "number of timelapses rendered at the same time, further requests wait")
+	snapshotOps = flag.Int("snapshotThreshold", game.SnapshotThreshold, "number of draw operations from which on connecting players are sent an image of the drawing instead, 0 disables snapshots")
+	snapshotKeep = flag.Int("snapshotKeepGestures", game.SnapshotKeepGestures, "number of latest gestures sent as operations along with a snapshot")
+	simplify = flag.Float64("simplifyTolerance", game.SimplifyTolerance, "pixels by which stored lines may deviate from what has been drawn when their segments are merged, 0 keeps all segments")
+	maxReplays = flag.Int("maxReplays", game.MaxReplayLobbies, "number of replay lobbies that can run at the same time")
 	flag.Parse()
 
+	if *sweepInterval <= 0 {
+		log.Fatal("lobbySweepInterval has to be positive")
+	}
+	if *pingInterval <= 0 {
+		log.Fatal("pingInterval has to be positive")
+	}
+	if *pongTimeout <= *pingInterval {
+		log.Fatal("pongTimeout has to be longer than pingInterval")
+	}
+
 	//Setting the seed in order for the petnames to be random.
 	rand.Seed(time.Now().UnixNano())
 
@@ -36,9 +82,38 @@ func main() {
 		redisPort = "6379"
 	}
 
-	game.Store = store.NewRedisStore(&redis.Options{
+	redisOptions := &redis.Options{
 		Addr: fmt.Sprintf("%s:%s", redisHost, redisPort),
-	})
+	}
+	redisStore := store.NewRedisStore(redisOptions)
+	redisStore.LobbyTTL = *lobbyTTL
+	resilientStore := store.NewResilientStore(redisStore)
+	go resilientStore.RunRecovery(5*time.Second, nil)
+	game.Store = resilientStore
+
+	game.LobbyIdleTimeout = *idleTimeout
+	game.ReconnectGracePeriod = *gracePeriod
+	game.DrawBatchWindow = *drawBatchWindow
+	game.SnapshotThreshold = *snapshotOps
+	game.SnapshotKeepGestures = *snapshotKeep
+	game.SimplifyTolerance = *simplify
+	game.MaxReplayLobbies = *maxReplays
+	go game.RunLobbySweeper(*sweepInterval, nil)
+
+	server.SendQueueSize = *sendQueueSize
+	server.PingInterval = *pingInterval
+	server.PongTimeout = *pongTimeout
+	server.WriteTimeout = *writeTimeout
+	server.TimelapseFrameRate = *timelapseFPS
+	server.TimelapseLength = *timelapseLength
+	server.TimelapseRenders = *timelapseRender
+
+	if *clusterMode {
+		err := server.JoinCluster(redis.NewClient(redisOptions), *nodeID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	//If this ever fails, it will return and print a fatal logger message
 	log.Fatal(server.Serve(*portHTTP))
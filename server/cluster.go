@@ -0,0 +1,691 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// Multi node mode
+//
+// Several server instances can share one redis. Every lobby is owned by
+// exactly one node, which holds a lease in redis and is the only one running
+// the game logic for it. Players connecting to any other node have their
+// websocket relayed to the owner via redis pub/sub: incoming packets are
+// forwarded to the owner and the owner publishes outgoing events back to the
+// node holding the websocket. Each node listens on its own channel.
+
+// localNode is the cluster node of this process, nil if the server runs as a
+// single instance.
+var localNode *clusterNode
+
+const (
+	clusterLeaseTTL       = 15 * time.Second
+	clusterRequestTimeout = 5 * time.Second
+)
+
+// Kinds of messages exchanged between nodes.
+const (
+	// relay to owner
+	clusterConnect    = "connect"
+	clusterPacket     = "packet"
+	clusterDisconnect = "disconnect"
+	clusterJoin       = "join"
+	// owner to relay
+	clusterJoinReply = "join-reply"
+	clusterDeliver   = "deliver"
+	clusterClose     = "close"
+)
+
+var (
+	// extendLeaseScript prolongs a lease, but only if it is still held by
+	// the given node.
+	extendLeaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+	// releaseLeaseScript removes a lease, but only if it is still held by
+	// the given node.
+	releaseLeaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+)
+
+type clusterMessage struct {
+	Kind       string `json:"kind"`
+	Node       string `json:"node"`
+	LobbyID    string `json:"lobbyId"`
+	PlayerID   string `json:"playerId,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// CloseCode and the Error as reason are sent to the client when closing
+	// a relayed websocket, if set.
+	CloseCode int `json:"closeCode,omitempty"`
+	// Epoch and LastSeq identify the last event a reconnecting client has
+	// received.
+	Epoch   string `json:"epoch,omitempty"`
+	LastSeq uint64 `json:"lastSeq,omitempty"`
+}
+
+type clusterJoinRequest struct {
+	Name     string `json:"name"`
+	AvatarID int    `json:"avatarId"`
+}
+
+type clusterNode struct {
+	id     string
+	client *redis.Client
+
+	mu      sync.Mutex
+	owned   map[string]bool                 // lobbies this node holds the lease for
+	relayed map[string]*queuedSocket        // relayed websockets by player ID
+	pending map[string]chan *clusterMessage // join requests awaiting a reply
+}
+
+// JoinCluster enables multi node mode for this process. The nodeID has to be
+// unique among all nodes, a random one is chosen if it is empty.
+func JoinCluster(client *redis.Client, nodeID string) error {
+	node, err := newClusterNode(client, nodeID)
+	if err != nil {
+		return err
+	}
+
+	localNode = node
+	return nil
+}
+
+func newClusterNode(client *redis.Client, nodeID string) (*clusterNode, error) {
+	if nodeID == "" {
+		nodeID = uuid.NewV4().String()
+	}
+
+	node := &clusterNode{
+		id:      nodeID,
+		client:  client,
+		owned:   make(map[string]bool),
+		relayed: make(map[string]*queuedSocket),
+		pending: make(map[string]chan *clusterMessage),
+	}
+
+	pubsub := client.Subscribe(nodeChannel(nodeID))
+	// Wait for the subscription to be confirmed, otherwise messages sent
+	// right after joining could get lost.
+	_, err := pubsub.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	go node.listen(pubsub)
+	go node.renewLeases()
+
+	log.Printf("Joined cluster as node %s\n", nodeID)
+	return node, nil
+}
+
+type clusterNodeKey struct{}
+
+// nodeFromRequest returns the cluster node handling the request, nil if the
+// server runs as a single instance.
+func nodeFromRequest(r *http.Request) *clusterNode {
+	node, _ := r.Context().Value(clusterNodeKey{}).(*clusterNode)
+	return node
+}
+
+func nodeChannel(nodeID string) string {
+	return "scribble.node." + nodeID
+}
+
+func ownerKey(lobbyID string) string {
+	return lobbyID + ".owner"
+}
+
+// claim returns the node owning the lobby. If the lobby has no owner yet,
+// this node becomes the owner.
+func (c *clusterNode) claim(lobbyID string) (string, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		claimed, err := c.client.SetNX(ownerKey(lobbyID), c.id, clusterLeaseTTL).Result()
+		if err != nil {
+			return "", err
+		}
+
+		owner := c.id
+		if !claimed {
+			owner, err = c.client.Get(ownerKey(lobbyID)).Result()
+			if err == redis.Nil {
+				// The lease expired in the meantime.
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if owner == c.id {
+			c.mu.Lock()
+			c.owned[lobbyID] = true
+			c.mu.Unlock()
+		}
+		return owner, nil
+	}
+
+	return "", errors.New("couldn't determine lobby owner")
+}
+
+// renewLeases keeps the leases of all lobbies this node is running. Leases
+// of lobbies that have been removed are released, so that the lobby can be
+// picked up by any node again.
+func (c *clusterNode) renewLeases() {
+	ticker := time.NewTicker(clusterLeaseTTL / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		owned := make([]string, 0, len(c.owned))
+		for lobbyID := range c.owned {
+			owned = append(owned, lobbyID)
+		}
+		c.mu.Unlock()
+
+		for _, lobbyID := range owned {
+			if game.GetLobby(lobbyID) == nil {
+				c.release(lobbyID)
+				continue
+			}
+
+			renewed, err := extendLeaseScript.Run(c.client, []string{ownerKey(lobbyID)}, c.id, int64(clusterLeaseTTL/time.Millisecond)).Int64()
+			if err != nil {
+				log.Printf("Error renewing lease for lobby %s: %s\n", lobbyID, err)
+				continue
+			}
+			if renewed == 0 {
+				log.Printf("Lost lease for lobby %s, dropping it.\n", lobbyID)
+				c.mu.Lock()
+				delete(c.owned, lobbyID)
+				c.mu.Unlock()
+				game.RemoveLobby(lobbyID)
+			}
+		}
+	}
+}
+
+func (c *clusterNode) release(lobbyID string) {
+	c.mu.Lock()
+	delete(c.owned, lobbyID)
+	c.mu.Unlock()
+
+	err := releaseLeaseScript.Run(c.client, []string{ownerKey(lobbyID)}, c.id).Err()
+	if err != nil {
+		log.Printf("Error releasing lease for lobby %s: %s\n", lobbyID, err)
+	}
+}
+
+// send publishes a message to the given node and returns the number of nodes
+// that received it. Zero means that the node is gone.
+func (c *clusterNode) send(nodeID string, msg *clusterMessage) (int64, error) {
+	msg.Node = c.id
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	return c.client.Publish(nodeChannel(nodeID), data).Result()
+}
+
+func (c *clusterNode) listen(pubsub *redis.PubSub) {
+	for redisMsg := range pubsub.Channel() {
+		msg := &clusterMessage{}
+		err := json.Unmarshal([]byte(redisMsg.Payload), msg)
+		if err != nil {
+			log.Printf("Error decoding cluster message: %s\n", err)
+			continue
+		}
+
+		c.handle(msg)
+	}
+}
+
+func (c *clusterNode) handle(msg *clusterMessage) {
+	//Workaround to prevent crash, same as in wsListen
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Println("Error occurred handling cluster message: ", err)
+		}
+	}()
+
+	switch msg.Kind {
+	case clusterConnect:
+		c.handleConnect(msg)
+	case clusterPacket:
+		c.handlePacket(msg)
+	case clusterDisconnect:
+		c.handleDisconnect(msg)
+	case clusterJoin:
+		c.handleJoin(msg)
+	case clusterJoinReply:
+		c.mu.Lock()
+		reply, ok := c.pending[msg.RequestID]
+		c.mu.Unlock()
+		if ok {
+			reply <- msg
+		}
+	case clusterDeliver:
+		c.mu.Lock()
+		socket, ok := c.relayed[msg.PlayerID]
+		c.mu.Unlock()
+		if ok {
+			socket.writeRaw(msg.Data)
+		}
+	case clusterClose:
+		c.mu.Lock()
+		socket, ok := c.relayed[msg.PlayerID]
+		c.mu.Unlock()
+		if !ok {
+			break
+		}
+		if msg.CloseCode != 0 {
+			socket.closeAfterPending(msg.CloseCode, msg.Error)
+		} else {
+			socket.Close()
+		}
+	default:
+		log.Printf("Unknown cluster message kind: %s\n", msg.Kind)
+	}
+}
+
+// ownedLobby returns the lobby if it is owned by this node, loading it if
+// necessary.
+func (c *clusterNode) ownedLobby(lobbyID string) *game.Lobby {
+	c.mu.Lock()
+	owned := c.owned[lobbyID]
+	c.mu.Unlock()
+	if !owned {
+		return nil
+	}
+
+	lobby, err := game.GetLoadLobby(lobbyID, broadcaster)
+	if err != nil {
+		log.Printf("Error loading owned lobby %s: %s\n", lobbyID, err)
+		return nil
+	}
+	return lobby
+}
+
+// relayedPlayer looks up the player a relayed message refers to and their
+// socket. Messages from nodes that don't hold the players current socket are
+// dropped.
+func (c *clusterNode) relayedPlayer(msg *clusterMessage) (*game.Lobby, *game.Player, *remoteSocket) {
+	lobby := c.ownedLobby(msg.LobbyID)
+	if lobby == nil {
+		return nil, nil, nil
+	}
+	player := lobby.GetPlayerById(msg.PlayerID)
+	if player == nil {
+		return nil, nil, nil
+	}
+	socket, ok := currentSocket(player).(*remoteSocket)
+	if !ok || socket.target != msg.Node {
+		return nil, nil, nil
+	}
+	return lobby, player, socket
+}
+
+func (c *clusterNode) handleConnect(msg *clusterMessage) {
+	lobby := c.ownedLobby(msg.LobbyID)
+	var player *game.Player
+	if lobby != nil {
+		player = lobby.GetPlayerById(msg.PlayerID)
+	}
+	if player == nil {
+		// Let the relay close the socket, the client will reconnect and
+		// find the new owner.
+		c.send(msg.Node, &clusterMessage{Kind: clusterClose, LobbyID: msg.LobbyID, PlayerID: msg.PlayerID})
+		return
+	}
+
+	log.Println(player.Name + " has connected via node " + msg.Node)
+
+	socket := newRemoteSocket(c, msg.Node, lobby, player, relayAddr(msg.RemoteAddr))
+	previous := lobby.ConnectSocket(player, socket, msg.Epoch, msg.LastSeq)
+	// The relaying node has already replaced the old connection, only the
+	// writer of its socket is left.
+	if remote, ok := previous.(*remoteSocket); ok && remote.target == msg.Node {
+		remote.stop()
+	} else {
+		closeReplaced(previous)
+	}
+}
+
+func (c *clusterNode) handlePacket(msg *clusterMessage) {
+	lobby, player, _ := c.relayedPlayer(msg)
+	if player == nil {
+		return
+	}
+
+	err := lobby.HandlePacket(msg.Data, player)
+	if err != nil {
+		log.Printf("Error handling event: %s\n", err)
+	}
+}
+
+func (c *clusterNode) handleDisconnect(msg *clusterMessage) {
+	lobby, player, socket := c.relayedPlayer(msg)
+	if player == nil {
+		return
+	}
+
+	lobby.DisconnectSocket(player, socket)
+	socket.stop()
+	log.Println(player.Name + " disconnected from node " + msg.Node)
+}
+
+func (c *clusterNode) handleJoin(msg *clusterMessage) {
+	reply := &clusterMessage{Kind: clusterJoinReply, LobbyID: msg.LobbyID, RequestID: msg.RequestID}
+	defer c.send(msg.Node, reply)
+
+	request := &clusterJoinRequest{}
+	err := json.Unmarshal(msg.Data, request)
+	if err != nil {
+		reply.Error = err.Error()
+		return
+	}
+
+	lobby := c.ownedLobby(msg.LobbyID)
+	if lobby == nil {
+		reply.Error = "the requested lobby doesn't exist"
+		return
+	}
+	if lobby.IsFull() {
+		reply.Error = "Sorry, but the lobby is full."
+		return
+	}
+
+	player := lobby.JoinPlayer(request.Name, "", request.AvatarID)
+	reply.Data = []byte(player.GetSession())
+}
+
+// joinRemote asks the owner of a lobby to add a new player and returns the
+// players session.
+func (c *clusterNode) joinRemote(owner, lobbyID, name string, avatarID int) (string, error) {
+	data, err := json.Marshal(&clusterJoinRequest{Name: name, AvatarID: avatarID})
+	if err != nil {
+		return "", err
+	}
+
+	requestID := uuid.NewV4().String()
+	replies := make(chan *clusterMessage, 1)
+	c.mu.Lock()
+	c.pending[requestID] = replies
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, requestID)
+		c.mu.Unlock()
+	}()
+
+	receivers, err := c.send(owner, &clusterMessage{Kind: clusterJoin, LobbyID: lobbyID, RequestID: requestID, Data: data})
+	if err != nil {
+		return "", err
+	}
+	if receivers == 0 {
+		return "", errors.New("the lobby is currently unavailable, please try again")
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.Error != "" {
+			return "", errors.New(reply.Error)
+		}
+		return string(reply.Data), nil
+	case <-time.After(clusterRequestTimeout):
+		return "", errors.New("the lobby didn't respond, please try again")
+	}
+}
+
+// relay forwards everything the player sends to the owner of the lobby until
+// either side goes away.
+func (c *clusterNode) relay(owner, lobbyID string, player *game.Player, socket *queuedSocket, epoch string, lastSeq uint64) {
+	c.mu.Lock()
+	previous, replaced := c.relayed[player.ID]
+	c.relayed[player.ID] = socket
+	c.mu.Unlock()
+
+	if replaced {
+		previous.sessionReplaced()
+	}
+
+	defer socket.Close()
+
+	receivers, err := c.send(owner, &clusterMessage{
+		Kind:       clusterConnect,
+		LobbyID:    lobbyID,
+		PlayerID:   player.ID,
+		RemoteAddr: socket.RemoteAddr().String(),
+		Epoch:      epoch,
+		LastSeq:    lastSeq,
+	})
+	for err == nil && receivers > 0 {
+		var data []byte
+		data, err = socket.readMessage()
+		if err != nil {
+			break
+		}
+
+		c.mu.Lock()
+		current := c.relayed[player.ID] == socket
+		c.mu.Unlock()
+		// Replaced connections are closed once their pending messages have
+		// been written, until then their packets are dropped.
+		if !current {
+			continue
+		}
+
+		receivers, err = c.send(owner, &clusterMessage{Kind: clusterPacket, LobbyID: lobbyID, PlayerID: player.ID, Data: data})
+	}
+
+	c.mu.Lock()
+	current := c.relayed[player.ID] == socket
+	if current {
+		delete(c.relayed, player.ID)
+	}
+	c.mu.Unlock()
+
+	// A newer connection of the same player has taken over, the owner
+	// mustn't disconnect it.
+	if current {
+		c.send(owner, &clusterMessage{Kind: clusterDisconnect, LobbyID: lobbyID, PlayerID: player.ID})
+	}
+	log.Println(player.Name + " disconnected from relay.")
+}
+
+// remoteSocket is the socket of a player whose websocket is held by another
+// node. Like queuedSocket, it puts messages into a bounded queue, which a
+// dedicated writer goroutine publishes to the relaying node, so a slow redis
+// can't block the lobby. If the queue overflows, the player is disconnected.
+type remoteSocket struct {
+	node   *clusterNode
+	target string
+	lobby  *game.Lobby
+	player *game.Player
+	addr   relayAddr
+
+	queue     chan *clusterMessage
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newRemoteSocket(node *clusterNode, target string, lobby *game.Lobby, player *game.Player, addr relayAddr) *remoteSocket {
+	socket := &remoteSocket{
+		node:   node,
+		target: target,
+		lobby:  lobby,
+		player: player,
+		addr:   addr,
+
+		queue: make(chan *clusterMessage, SendQueueSize),
+		done:  make(chan struct{}),
+	}
+	go socket.writeLoop()
+	return socket
+}
+
+func (s *remoteSocket) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.writeRaw(data)
+}
+
+// writeEvent forwards the JSON encoding of the event, the relaying node
+// converts it if its client has negotiated msgpack.
+func (s *remoteSocket) writeEvent(event *encodedEvent) error {
+	return s.writeRaw(event.json)
+}
+
+func (s *remoteSocket) writeRaw(data []byte) error {
+	return s.enqueue(s.message(clusterDeliver, data))
+}
+
+// message creates a message about the player for the relaying node.
+func (s *remoteSocket) message(kind string, data []byte) *clusterMessage {
+	return &clusterMessage{Kind: kind, LobbyID: s.lobby.ID, PlayerID: s.player.ID, Data: data}
+}
+
+// enqueue queues a message for the relaying node.
+func (s *remoteSocket) enqueue(msg *clusterMessage) error {
+	select {
+	case <-s.done:
+		return errSocketClosed
+	default:
+	}
+
+	select {
+	case s.queue <- msg:
+		return nil
+	case <-s.done:
+		return errSocketClosed
+	default:
+		log.Printf("Evicting slow relayed client %s\n", s.addr)
+		s.closeWithReason(websocket.ClosePolicyViolation, "client too slow, too many pending messages")
+		// The relaying node might not be able to tell us about the player
+		// leaving.
+		go s.lobby.DisconnectSocket(s.player, s)
+		return errSlowConsumer
+	}
+}
+
+func (s *remoteSocket) writeLoop() {
+	for {
+		select {
+		case msg := <-s.queue:
+			receivers, err := s.node.send(s.target, msg)
+			if err != nil {
+				log.Printf("Error relaying to node %s: %s\n", s.target, err)
+				continue
+			}
+			if receivers == 0 {
+				// The node holding the websocket is gone, nobody else will
+				// tell us about the player leaving.
+				s.stop()
+				s.lobby.DisconnectSocket(s.player, s)
+				return
+			}
+			if msg.Kind == clusterClose {
+				s.stop()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// closeWithReason stops accepting messages and lets the relaying node close
+// the connection, telling the client why. This happens without waiting for
+// redis.
+func (s *remoteSocket) closeWithReason(code int, reason string) {
+	if !s.stop() {
+		return
+	}
+	msg := s.message(clusterClose, nil)
+	msg.CloseCode = code
+	msg.Error = reason
+	go s.node.send(s.target, msg)
+}
+
+// closeAfterPending lets the relaying node close the connection once the
+// messages queued so far have been relayed.
+func (s *remoteSocket) closeAfterPending(code int, reason string) {
+	msg := s.message(clusterClose, nil)
+	msg.CloseCode = code
+	msg.Error = reason
+	select {
+	case s.queue <- msg:
+	case <-s.done:
+	default:
+		s.closeWithReason(code, reason)
+	}
+}
+
+// sessionReplaced tells the client that its session has been opened in
+// another tab and lets the relaying node close the connection.
+func (s *remoteSocket) sessionReplaced() {
+	s.WriteJSON(sessionReplacedEvent)
+	s.closeAfterPending(closeSessionReplaced, "session replaced")
+}
+
+// Close stops the writer and lets the relaying node close the connection.
+func (s *remoteSocket) Close() error {
+	if !s.stop() {
+		return nil
+	}
+	go s.node.send(s.target, s.message(clusterClose, nil))
+	return nil
+}
+
+// stop makes further writes fail and ends the writer. It returns false if
+// the socket had already been stopped.
+func (s *remoteSocket) stop() bool {
+	stopped := false
+	s.closeOnce.Do(func() {
+		close(s.done)
+		stopped = true
+	})
+	return stopped
+}
+
+func (s *remoteSocket) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+// relayAddr is the address of a client connected to another node.
+type relayAddr string
+
+func (a relayAddr) Network() string { return "tcp" }
+func (a relayAddr) String() string  { return string(a) }
+
+// loadLobbySnapshot loads a lobby owned by another node from the store. The
+// snapshot mustn't be modified, it serves for validating requests and for
+// the resources that the store holds, such as finished turns.
+func loadLobbySnapshot(r *http.Request, lobbyID string) (*game.Lobby, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), game.StoreTimeout)
+	defer cancel()
+
+	return game.LoadLobbySnapshot(ctx, lobbyID)
+}
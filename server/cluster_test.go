@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNode starts a node with a unique ID, as nodes of earlier test runs
+// in the same process are still subscribed to their channels.
+func newTestNode(t *testing.T, name string) (*clusterNode, *httptest.Server) {
+	node, err := newClusterNode(redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	}), name+"-"+uuid.NewV4().String())
+	require.Nil(t, err)
+
+	return node, httptest.NewServer(makeServeMux(node))
+}
+
+// currentVersion announces the protocol version of the server when dialing.
+var currentVersion = "&v=" + strconv.Itoa(game.ProtocolVersion)
+
+func dialLobby(t *testing.T, server *httptest.Server, lobbyID, session string) *websocket.Conn {
+	return dialLobbyWithQuery(t, server, lobbyID, session, currentVersion)
+}
+
+func dialLobbyWithQuery(t *testing.T, server *httptest.Server, lobbyID, session, query string) *websocket.Conn {
+	header := http.Header{}
+	header.Set("Cookie", "X-UserSession="+session)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/ws?lobby_id=" + lobbyID + query
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.Nil(t, err)
+	return ws
+}
+
+// readEvent reads from the socket until an event of the given type arrives.
+func readEvent(t *testing.T, ws *websocket.Conn, eventType string) json.RawMessage {
+	require.Nil(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		event := &game.Packet{}
+		require.Nil(t, ws.ReadJSON(event))
+		if event.Type == eventType {
+			return event.Data
+		}
+	}
+}
+
+// requireClosed reads from the socket until the server closes it with the
+// given code.
+func requireClosed(t *testing.T, ws *websocket.Conn, code int) {
+	require.Nil(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err != nil {
+			require.True(t, websocket.IsCloseError(err, code), err.Error())
+			return
+		}
+	}
+}
+
+func TestClusterRelaysLobbyAcrossNodes(t *testing.T) {
+	game.Store = store.NewRedisStore(&redis.Options{
+		Addr: "127.0.0.1:6379",
+	})
+
+	clusterNodeA, nodeA := newTestNode(t, "test-node-a")
+	defer nodeA.Close()
+	_, nodeB := newTestNode(t, "test-node-b")
+	defer nodeB.Close()
+
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	claimedBy, err := clusterNodeA.claim(lobby.ID)
+	require.Nil(t, err)
+	require.Equal(t, clusterNodeA.id, claimedBy)
+
+	// Joining via node B has to add the player to the lobby on node A.
+	request, err := http.NewRequest(http.MethodGet, nodeB.URL+"/ssrEnterLobby?lobby_id="+lobby.ID, nil)
+	require.Nil(t, err)
+	request.Header.Set("User-Agent", "Mozilla/5.0 Gecko/20100101 Firefox/81.0")
+	request.AddCookie(&http.Cookie{Name: "X-Username", Value: "guest"})
+	request.AddCookie(&http.Cookie{Name: "X-Avatar", Value: "1"})
+	response, err := http.DefaultClient.Do(request)
+	require.Nil(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var guestSession string
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == "X-UserSession" {
+			guestSession = cookie.Value
+		}
+	}
+	require.NotEmpty(t, guestSession)
+	guest := lobby.GetPlayerBySession(guestSession)
+	require.NotNil(t, guest)
+
+	// Recordings are only kept by the owner, other nodes can't serve them.
+	request, err = http.NewRequest(http.MethodGet, nodeB.URL+"/v1/lobby/"+lobby.ID+"/recording.scribble", nil)
+	require.Nil(t, err)
+	request.AddCookie(&http.Cookie{Name: "X-UserSession", Value: guestSession})
+	response, err = http.DefaultClient.Do(request)
+	require.Nil(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+
+	ownerWs := dialLobby(t, nodeA, lobby.ID, owner.GetSession())
+	defer ownerWs.Close()
+	readEvent(t, ownerWs, "ready")
+
+	guestWs := dialLobby(t, nodeB, lobby.ID, guestSession)
+	defer guestWs.Close()
+	ready := &game.Ready{}
+	require.Nil(t, json.Unmarshal(readEvent(t, guestWs, "ready"), ready))
+	require.Equal(t, guest.ID, ready.PlayerID)
+	require.Equal(t, owner.ID, ready.OwnerID)
+
+	// Packets sent to node B are handled by node A and reach both players.
+	require.Nil(t, guestWs.WriteJSON(map[string]interface{}{"type": "message", "data": "hello from b"}))
+	for _, ws := range []*websocket.Conn{ownerWs, guestWs} {
+		message := &game.Message{}
+		require.Nil(t, json.Unmarshal(readEvent(t, ws, "message"), message))
+		require.Equal(t, "hello from b", message.Content)
+	}
+
+	// Opening the lobby in a second tab on the owning node replaces the
+	// relayed connection.
+	secondTabWs := dialLobby(t, nodeA, lobby.ID, guestSession)
+	defer secondTabWs.Close()
+	readEvent(t, secondTabWs, "ready")
+	readEvent(t, guestWs, "session-replaced")
+	requireClosed(t, guestWs, closeSessionReplaced)
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, guest.IsConnected())
+
+	// Closing the current socket disconnects the player on the owner.
+	secondTabWs.Close()
+	require.Eventually(t, func() bool {
+		return !guest.IsConnected()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSlowRedisDoesNotBlockRelayedWrites(t *testing.T) {
+	// A redis that accepts connections, but never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	defaultQueueSize := SendQueueSize
+	SendQueueSize = 2
+	defer func() { SendQueueSize = defaultQueueSize }()
+
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime: 120,
+		Rounds:      2,
+		MaxPlayers:  4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), ReadTimeout: time.Minute})
+	defer client.Close()
+	node := &clusterNode{id: "slow-node", client: client}
+	socket := newRemoteSocket(node, "relay-node", lobby, owner, relayAddr("127.0.0.1:1234"))
+
+	// The writer is stuck publishing the first message, the others are
+	// queued until the player is evicted.
+	start := time.Now()
+	for i := 0; i <= SendQueueSize; i++ {
+		require.Nil(t, socket.writeRaw([]byte("{}")))
+		// Lets the writer pick up the first message.
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, errSlowConsumer, socket.writeRaw([]byte("{}")))
+	require.Equal(t, errSocketClosed, socket.writeRaw([]byte("{}")))
+	require.True(t, time.Since(start) < time.Second)
+}
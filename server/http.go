@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -8,7 +9,7 @@ import (
 	"github.com/markbates/pkger"
 )
 
-func makeServeMux() *http.ServeMux {
+func makeServeMux(node *clusterNode) http.Handler {
 	mux := http.NewServeMux()
 	//Endpoints for official webclient
 	mux.Handle("/resources/", http.StripPrefix("/resources/", http.FileServer(pkger.Dir("/resources"))))
@@ -19,12 +20,25 @@ func makeServeMux() *http.ServeMux {
 	//The websocket is shared between the public API and the official client
 	mux.HandleFunc("/v1/ws", wsEndpoint)
 
-	return mux
+	mux.HandleFunc("/v1/health", healthHandler)
+	mux.HandleFunc("/v1/protocol", protocolHandler)
+	mux.HandleFunc("/v1/lobby/", lobbyResourceEndpoint)
+	mux.HandleFunc("/v1/replay", replayEndpoint)
+
+	if node == nil {
+		return mux
+	}
+
+	// Handlers find the node via the request, so that several nodes can
+	// run in the same process.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clusterNodeKey{}, node)))
+	})
 }
 
 // Serve runs http server on the port
 func Serve(port int) error {
-	mux := makeServeMux()
+	mux := makeServeMux(localNode)
 	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
 }
 
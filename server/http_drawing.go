@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/scribble-rs/scribble.rs/drawing"
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+var (
+	// TimelapseFrameRate is the number of frames per second of timelapses.
+	TimelapseFrameRate = 10
+	// TimelapseLength is the longest a timelapse may take. Turns that took
+	// longer are sped up to fit.
+	TimelapseLength = 15 * time.Second
+	// TimelapseRenders is the number of timelapses rendered at the same
+	// time, further requests wait for one of them to finish.
+	TimelapseRenders = 2
+	// TimelapseCacheSize is the number of rendered timelapses kept.
+	TimelapseCacheSize = 32
+)
+
+var (
+	timelapses     *drawing.TimelapseCache
+	timelapsesOnce sync.Once
+)
+
+// timelapseCache returns the cache of rendered timelapses, which is created
+// on first use, once the settings are final.
+func timelapseCache() *drawing.TimelapseCache {
+	timelapsesOnce.Do(func() {
+		timelapses = drawing.NewTimelapseCache(TimelapseCacheSize, TimelapseRenders)
+	})
+	return timelapses
+}
+
+func init() {
+	// Package game can't render drawings itself, as package drawing depends
+	// on it.
+	game.SnapshotRenderer = renderSnapshot
+}
+
+// renderSnapshot renders the image of a drawing sent to players connecting
+// to a lobby, instead of all of its operations.
+func renderSnapshot(ops []*game.Packet) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := drawing.EncodePNG(&buffer, ops)
+	return buffer.Bytes(), err
+}
+
+// timelapseWidth is half the base size, which is plenty for an animation
+// and keeps rendering it cheap.
+const timelapseWidth = game.DrawingBoardBaseWidth / 2
+
+// requestedTurn returns the finished turn given by the "turn" query
+// parameter. Without the parameter, the turn with the number fallback is
+// returned, which may be nil. If the parameter is invalid or the turn
+// doesn't exist, an error has been written and false is returned.
+func requestedTurn(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, fallback int) (*game.Turn, bool) {
+	number := fallback
+	if value := r.URL.Query().Get("turn"); value != "" {
+		var err error
+		number, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "the turn has to be a number", http.StatusBadRequest)
+			return nil, false
+		}
+	} else if fallback == 0 {
+		return nil, true
+	}
+
+	turn := lobby.Turn(number)
+	if turn == nil {
+		http.Error(w, "there is no such finished turn", http.StatusNotFound)
+		return nil, false
+	}
+	return turn, true
+}
+
+// requestedDrawing returns the drawing of the finished turn given by the
+// "turn" query parameter, or the current drawing if there is none, together
+// with the file name to offer it under.
+func requestedDrawing(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, extension string) ([]*game.Packet, string, bool) {
+	turn, ok := requestedTurn(w, r, lobby, 0)
+	if !ok {
+		return nil, "", false
+	}
+	if turn == nil {
+		return lobby.Drawing(), "drawing" + extension, true
+	}
+	return turn.Drawing, turnFileName(turn, extension), true
+}
+
+// turnFileName names the files of a finished turn after its number and word.
+// Only ASCII letters and digits of the word are kept, so the name can be used
+// in headers as is.
+func turnFileName(turn *game.Turn, extension string) string {
+	word := strings.Map(func(r rune) rune {
+		if r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, turn.Word)
+	return fmt.Sprintf("turn-%d-%s%s", turn.Number, word, extension)
+}
+
+// drawingPNGHandler renders the current drawing of the lobby, or that of a
+// finished turn, as PNG.
+func drawingPNGHandler(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, player *game.Player) {
+	ops, _, ok := requestedDrawing(w, r, lobby, ".png")
+	if !ok {
+		return
+	}
+
+	// Encoded into a buffer first, so that errors can still be reported.
+	var buffer bytes.Buffer
+	err := drawing.EncodePNG(&buffer, ops)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	// The drawing changes all the time.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buffer.Bytes())
+}
+
+// drawingSVGHandler offers the current drawing of the lobby, or that of a
+// finished turn, for download as SVG, which can be printed at any size.
+func drawingSVGHandler(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, player *game.Player) {
+	ops, name, ok := requestedDrawing(w, r, lobby, ".svg")
+	if !ok {
+		return
+	}
+
+	var buffer bytes.Buffer
+	err := drawing.EncodeSVG(&buffer, ops)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buffer.Bytes())
+}
+
+// timelapseHandler offers an animated GIF of how the drawing of a finished
+// turn came together. The turn is given by the "turn" query parameter, the
+// latest finished turn is used if there is none.
+func timelapseHandler(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, player *game.Player) {
+	turn, ok := requestedTurn(w, r, lobby, len(lobby.TurnSummaries()))
+	if !ok {
+		return
+	}
+	if turn == nil {
+		http.Error(w, "there is no such finished turn", http.StatusNotFound)
+		return
+	}
+
+	timelapse := &drawing.Timelapse{
+		FrameRate: TimelapseFrameRate,
+		Length:    TimelapseLength,
+		Width:     timelapseWidth,
+	}
+	data, err := timelapseCache().Get(turn, timelapse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, turnFileName(turn, ".gif")))
+	// Turn numbers start over with every game.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+// getAsPlayer requests the path with the given session, no session is sent
+// if it is empty.
+func getAsPlayer(t *testing.T, server *httptest.Server, path, session string) *http.Response {
+	request, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	require.Nil(t, err)
+	if session != "" {
+		request.Header.Set("Cookie", "X-UserSession="+session)
+	}
+	response, err := http.DefaultClient.Do(request)
+	require.Nil(t, err)
+	return response
+}
+
+func TestDrawingPNG(t *testing.T) {
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.AppendFill(&game.Packet{Type: game.PacketFill, Data: []byte(`{"x":10,"y":10,"color":"#00ff00"}`)})
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	response := getAsPlayer(t, server, "/v1/lobby/"+lobby.ID+"/drawing.png", owner.GetSession())
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "image/png", response.Header.Get("Content-Type"))
+	image, err := png.Decode(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, game.DrawingBoardBaseWidth, image.Bounds().Dx())
+	_, g, _, _ := image.At(500, 500).RGBA()
+	require.Equal(t, uint32(0xffff), g)
+
+	for path, status := range map[string]int{
+		"/v1/lobby/" + lobby.ID + "/drawing.png": http.StatusUnauthorized,
+		"/v1/lobby/" + lobby.ID + "/unknown":     http.StatusNotFound,
+		"/v1/lobby/does-not-exist/drawing.png":   http.StatusNotFound,
+	} {
+		response := getAsPlayer(t, server, path, "not-a-player")
+		response.Body.Close()
+		require.Equal(t, status, response.StatusCode, path)
+	}
+	response = getAsPlayer(t, server, "/v1/lobby/"+lobby.ID+"/drawing.png", "")
+	response.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode)
+}
+
+func TestDrawingSVG(t *testing.T) {
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	lobby.AppendLine(&game.Packet{Type: game.PacketLine, Data: []byte(`{"fromX":1,"fromY":2,"toX":3,"toY":4,"color":"#123456","lineWidth":5,"gestureId":1}`)})
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	response := getAsPlayer(t, server, "/v1/lobby/"+lobby.ID+"/drawing.svg", owner.GetSession())
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "image/svg+xml", response.Header.Get("Content-Type"))
+	require.Contains(t, response.Header.Get("Content-Disposition"), "attachment")
+	body, err := ioutil.ReadAll(response.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(body), `stroke="#123456"`)
+
+	response = getAsPlayer(t, server, "/v1/lobby/"+lobby.ID+"/drawing.svg", "not-a-player")
+	response.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode)
+}
+
+// playTurn lets the drawer choose a word and send the given packets. The
+// turn is then ended by everyone else guessing the word.
+func playTurn(t *testing.T, lobby *game.Lobby, packets ...string) {
+	drawer := lobby.GetPlayerById(lobby.State.Drawer)
+	require.NotNil(t, drawer)
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word","data":0}`), drawer))
+	for _, packet := range packets {
+		require.Nil(t, lobby.HandlePacket([]byte(packet), drawer), packet)
+	}
+
+	word := lobby.State.CurrentWord
+	guess, err := json.Marshal(word)
+	require.Nil(t, err)
+	guessers := []*game.Player{}
+	for _, player := range lobby.State.Players {
+		if player != drawer {
+			guessers = append(guessers, player)
+		}
+	}
+	for _, guesser := range guessers {
+		require.Nil(t, lobby.HandlePacket([]byte(`{"type":"message","data":`+string(guess)+`}`), guesser))
+	}
+	require.NotEqual(t, drawer.ID, lobby.State.Drawer)
+}
+
+func TestTimelapse(t *testing.T) {
+	game.Store = store.NewMemStore()
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 0
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	guest := lobby.JoinPlayer("guest", "", 0)
+	lobby.Connect(owner)
+	lobby.Connect(guest)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+	timelapse := "/v1/lobby/" + lobby.ID + "/timelapse.gif"
+
+	// Nothing has been drawn yet.
+	response := getAsPlayer(t, server, timelapse, owner.GetSession())
+	response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	playTurn(t, lobby, `{"type":"fill","data":{"x":10,"y":10,"color":"#00ff00"}}`)
+
+	for _, path := range []string{timelapse, timelapse + "?turn=1"} {
+		response = getAsPlayer(t, server, path, guest.GetSession())
+		require.Equal(t, http.StatusOK, response.StatusCode, path)
+		require.Equal(t, "image/gif", response.Header.Get("Content-Type"))
+		require.Contains(t, response.Header.Get("Content-Disposition"), `filename="turn-1-`)
+		animation, err := gif.DecodeAll(response.Body)
+		response.Body.Close()
+		require.Nil(t, err)
+		require.NotEmpty(t, animation.Image)
+	}
+
+	for query, status := range map[string]int{
+		"?turn=2":   http.StatusNotFound,
+		"?turn=one": http.StatusBadRequest,
+	} {
+		response = getAsPlayer(t, server, timelapse+query, guest.GetSession())
+		response.Body.Close()
+		require.Equal(t, status, response.StatusCode, query)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+
+	"github.com/scribble-rs/scribble.rs/drawing"
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// galleryPageData is the data used for rendering the gallery page.
+type galleryPageData struct {
+	LobbyID string
+	Turns   []*game.TurnSummary
+}
+
+// galleryHandler shows the drawings of all finished turns of the current
+// game, together with who drew and guessed them.
+func galleryHandler(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, player *game.Player) {
+	pageData := &galleryPageData{
+		LobbyID: lobby.ID,
+		Turns:   lobby.TurnSummaries(),
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	templateError := galleryPage.ExecuteTemplate(w, "gallery.html", pageData)
+	if templateError != nil {
+		panic(templateError)
+	}
+}
+
+// galleryZipHandler offers the drawings of all finished turns of the current
+// game for download as a single zip, each as PNG and SVG.
+func galleryZipHandler(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, player *game.Player) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for _, turn := range lobby.Turns() {
+		file, err := archive.Create(turnFileName(turn, ".png"))
+		if err == nil {
+			err = drawing.EncodePNG(file, turn.Drawing)
+		}
+		if err == nil {
+			file, err = archive.Create(turnFileName(turn, ".svg"))
+		}
+		if err == nil {
+			err = drawing.EncodeSVG(file, turn.Drawing)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="gallery.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buffer.Bytes())
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGallery(t *testing.T) {
+	game.Store = store.NewMemStore()
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 0
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	guest := lobby.JoinPlayer("guest", "", 0)
+	lobby.Connect(owner)
+	lobby.Connect(guest)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+	prefix := "/v1/lobby/" + lobby.ID
+
+	read := func(path string) (*http.Response, []byte) {
+		response := getAsPlayer(t, server, prefix+path, guest.GetSession())
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode, path)
+		return response, body
+	}
+
+	_, page := read("/gallery")
+	require.Contains(t, string(page), "No turn of this game has finished yet.")
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer := lobby.GetPlayerById(lobby.State.Drawer)
+	playTurn(t, lobby, `{"type":"fill","data":{"x":10,"y":10,"color":"#00ff00"}}`)
+	turn := lobby.Turn(1)
+	require.NotNil(t, turn)
+
+	_, page = read("/gallery")
+	require.Contains(t, string(page), turn.Word)
+	require.Contains(t, string(page), "drawn by "+drawer.Name)
+	require.Contains(t, string(page), "gallery.zip")
+	require.Contains(t, string(page), "drawing.png?turn=1")
+
+	// The archived drawing is served, even though the board has been
+	// cleared for the next turn.
+	require.Empty(t, lobby.CurrentDrawing.CurrentDrawing)
+	_, body := read("/drawing.png?turn=1")
+	image, err := png.Decode(bytes.NewReader(body))
+	require.Nil(t, err)
+	_, g, _, _ := image.At(500, 500).RGBA()
+	require.Equal(t, uint32(0xffff), g)
+
+	response, _ := read("/drawing.svg?turn=1")
+	require.Contains(t, response.Header.Get("Content-Disposition"), `filename="turn-1-`)
+
+	response, body = read("/gallery.zip")
+	require.Equal(t, "application/zip", response.Header.Get("Content-Type"))
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.Nil(t, err)
+	names := []string{}
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	require.Equal(t, []string{turnFileName(turn, ".png"), turnFileName(turn, ".svg")}, names)
+
+	response = getAsPlayer(t, server, prefix+"/drawing.png?turn=2", guest.GetSession())
+	response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestTurnFileName(t *testing.T) {
+	turn := &game.Turn{TurnSummary: game.TurnSummary{Number: 3, Word: "Ice Cream/Ü"}}
+	require.Equal(t, "turn-3-ice-cream--.svg", turnFileName(turn, ".svg"))
+}
@@ -13,24 +13,56 @@ import (
 )
 
 func getLobbyHandler(r *http.Request) (*game.Lobby, error) {
+	lobby, _, err := getLobbyAndOwner(r)
+	return lobby, err
+}
+
+// getLobbyAndOwner additionally returns the node owning the lobby, if it is
+// run by another node of the cluster. In that case the returned lobby is a
+// read-only snapshot.
+func getLobbyAndOwner(r *http.Request) (*game.Lobby, string, error) {
 	lobbyID := r.URL.Query().Get("lobby_id")
 	if lobbyID == "" {
 
 		lobbyCookie, err := r.Cookie("X-LobbyId")
 		if err != nil || lobbyCookie.Value == "" {
-			return nil, errors.New("the requested lobby doesn't exist")
+			return nil, "", errors.New("the requested lobby doesn't exist")
 		}
 		lobbyID = lobbyCookie.Value
 	}
 
-	lobby, err := game.GetLoadLobby(lobbyID)
+	return getLobbyAndOwnerByID(r, lobbyID)
+}
+
+// getLobbyAndOwnerByID is getLobbyAndOwner for a lobby ID that isn't part of
+// the query or cookies.
+func getLobbyAndOwnerByID(r *http.Request, lobbyID string) (*game.Lobby, string, error) {
+	var remoteOwner string
+	if node := nodeFromRequest(r); node != nil {
+		owner, err := node.claim(lobbyID)
+		if err != nil {
+			fmt.Println(err)
+			return nil, "", errors.New("the requested lobby is currently unavailable")
+		}
+		if owner != node.id {
+			remoteOwner = owner
+		}
+	}
+
+	var lobby *game.Lobby
+	var err error
+	if remoteOwner != "" {
+		lobby, err = loadLobbySnapshot(r, lobbyID)
+	} else {
+		lobby, err = game.GetLoadLobby(lobbyID, broadcaster)
+	}
 
 	if err != nil {
 		fmt.Println(err)
-		return nil, errors.New("the requested lobby doesn't exist")
+		return nil, "", errors.New("the requested lobby doesn't exist")
 	}
 
-	return lobby, nil
+	return lobby, remoteOwner, nil
 }
 
 func userSession(r *http.Request) string {
@@ -171,7 +203,7 @@ func enoughIPs(r *http.Request, l *game.Lobby) bool {
 	matches := 0
 
 	for _, p := range l.State.Players {
-		socket := p.GetWebsocket()
+		socket := currentSocket(p)
 		if socket != nil && remoteAddressToSimpleIP(socket.RemoteAddr().String()) == remoteAddressToSimpleIP(r.RemoteAddr) {
 			matches++
 		}
@@ -183,9 +215,11 @@ func enoughIPs(r *http.Request, l *game.Lobby) bool {
 	return true
 }
 
+// The size of the drawing board all coordinates refer to, clients scale
+// them to the size of their canvas.
 const (
-	DrawingBoardBaseWidth  = 1600
-	DrawingBoardBaseHeight = 900
+	DrawingBoardBaseWidth  = game.DrawingBoardBaseWidth
+	DrawingBoardBaseHeight = game.DrawingBoardBaseHeight
 )
 
 // LobbyData is the data necessary for initially displaying all data of
@@ -201,7 +235,7 @@ type LobbyData struct {
 
 // ssrEnterLobbyHandler opens a lobby, either opening it directly or asking for a lobby.
 func ssrEnterLobbyHandler(w http.ResponseWriter, r *http.Request) {
-	lobby, err := getLobbyHandler(r)
+	lobby, remoteOwner, err := getLobbyAndOwner(r)
 	if err != nil {
 		userFacingError(w, err.Error())
 		return
@@ -265,15 +299,23 @@ func ssrEnterLobbyHandler(w http.ResponseWriter, r *http.Request) {
 		DrawingBoardBaseHeight: DrawingBoardBaseHeight,
 	}
 
-	lobbyPlayer := getPlayer(lobby, r)
-	if lobbyPlayer == nil {
-		lobbyPlayer = lobby.JoinPlayer(playerName, "", playerAvatar)
+	session := userSession(r)
+	if getPlayer(lobby, r) == nil {
+		if remoteOwner == "" {
+			session = lobby.JoinPlayer(playerName, "", playerAvatar).GetSession()
+		} else {
+			session, err = nodeFromRequest(r).joinRemote(remoteOwner, lobby.ID, playerName, playerAvatar)
+			if err != nil {
+				userFacingError(w, err.Error())
+				return
+			}
+		}
 	}
 
 	// Use the players generated usersession and pass it as a cookie.
 	http.SetCookie(w, &http.Cookie{
 		Name:     "X-UserSession",
-		Value:    lobbyPlayer.GetSession(),
+		Value:    session,
 		Path:     "/",
 		SameSite: http.SameSiteLaxMode,
 	})
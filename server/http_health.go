@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+)
+
+// healthReporter is implemented by stores that can tell whether persistence
+// currently works, such as store.ResilientStore.
+type healthReporter interface {
+	Health() store.Health
+}
+
+// healthHandler reports the state of the persistence layer. While the store
+// is degraded it responds with 503, so that monitoring picks it up.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := store.Health{State: store.HealthOK}
+	if reporter, ok := game.Store.(healthReporter); ok {
+		health = reporter.Health()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.State != store.HealthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(health)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -45,6 +45,7 @@ func parseCreateLobbyData(r *http.Request) (params game.LobbySettings, language
 	params.CustomWordsChance = 0
 	params.ClientsPerIPLimit = 32
 	params.EnableVotekick = true
+	params.Public = r.Form.Get("public") == "true"
 	return
 }
 func parseCreatePageData(r *http.Request) CreatePageData {
@@ -114,6 +115,7 @@ func ssrCreateLobbyHandler(w http.ResponseWriter, r *http.Request) {
 			language,
 			avatarId,
 			lobbyParams,
+			broadcaster,
 		)
 		if createError != nil {
 			pageData.Errors = append(pageData.Errors, createError.Error())
@@ -126,6 +128,13 @@ func ssrCreateLobbyHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		lobbyID = lobby.ID
 
+		if node := nodeFromRequest(r); node != nil {
+			_, err := node.claim(lobbyID)
+			if err != nil {
+				fmt.Println("could not claim new lobby", err)
+			}
+		}
+
 		// Use the players generated usersession and pass it as a cookie.
 		http.SetCookie(w, &http.Cookie{
 			Name:     "X-UserSession",
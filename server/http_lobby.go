@@ -0,0 +1,69 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// lobbyResourceHandler serves a resource of a lobby to one of its players.
+type lobbyResourceHandler func(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, player *game.Player)
+
+// lobbyResources are the resources served below /v1/lobby/{id}/ by name.
+var lobbyResources = map[string]lobbyResourceHandler{
+	"drawing.png":        drawingPNGHandler,
+	"drawing.svg":        drawingSVGHandler,
+	"timelapse.gif":      timelapseHandler,
+	"gallery":            galleryHandler,
+	"gallery.zip":        galleryZipHandler,
+	"recording.scribble": recordingHandler,
+}
+
+// lobbyResourceEndpoint serves the resources of lobbies, such as the current
+// drawing, at /v1/lobby/{id}/{resource}. They are only available to the
+// players of the lobby.
+func lobbyResourceEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/lobby/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	handler, ok := lobbyResources[parts[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	lobby, remoteOwner, err := getLobbyAndOwnerByID(r, parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	session := userSession(r)
+	if session == "" {
+		http.Error(w, "you don't have access to this lobby;usersession not set", http.StatusUnauthorized)
+		return
+	}
+	player := lobby.GetPlayerBySession(session)
+	if player == nil {
+		log.Println("player for session not found", session)
+		http.Error(w, "you don't have access to this lobby;usersession invalid", http.StatusUnauthorized)
+		return
+	}
+
+	// Recordings are only kept in memory by the node running the lobby.
+	if remoteOwner != "" && parts[1] == "recording.scribble" {
+		http.Error(w, "the recording is only available from the server running the lobby", http.StatusServiceUnavailable)
+		return
+	}
+
+	handler(w, r, lobby, player)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// closeUnsupportedProtocol is sent to clients speaking a protocol version
+// that isn't supported anymore.
+const closeUnsupportedProtocol = 4001
+
+// protocolHandler serves the JSON schema of the websocket protocol.
+func protocolHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(game.ProtocolSchema())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// clientProtocolVersion returns the protocol version announced by the client
+// via the v parameter. Clients that don't announce one predate versioning
+// and speak the legacy version, as do clients with an invalid parameter.
+func clientProtocolVersion(r *http.Request) int {
+	param := r.URL.Query().Get("v")
+	if param == "" {
+		return game.LegacyProtocolVersion
+	}
+	version, err := strconv.Atoi(param)
+	if err != nil || version < 0 {
+		return game.LegacyProtocolVersion
+	}
+	return version
+}
+
+// handshake greets the client with the protocol version used for the
+// connection, which is the newest version both sides support, and remembers
+// it for the socket. Clients speaking a version the server doesn't support
+// anymore are told so and disconnected, in which case false is returned.
+func handshake(socket *queuedSocket, clientVersion int) bool {
+	if clientVersion < game.MinProtocolVersion {
+		socket.WriteJSON(&jsEvent{Type: game.EventError, Data: &game.PacketError{
+			Code:    game.ErrorUnsupportedProtocolVersion,
+			Message: fmt.Sprintf("Protocol version %d isn't supported anymore, at least version %d is required. Please reload the page.", clientVersion, game.MinProtocolVersion),
+		}})
+		socket.closeAfterPending(closeUnsupportedProtocol, "unsupported protocol version")
+		return false
+	}
+
+	version := clientVersion
+	if version > game.ProtocolVersion {
+		version = game.ProtocolVersion
+	}
+	socket.version = version
+	socket.WriteJSON(&jsEvent{Type: game.EventHello, Data: &game.Hello{
+		Version:    version,
+		MinVersion: game.MinProtocolVersion,
+	}})
+	return true
+}
+
+// drawBatchPrefix starts all encoded draw-batch events.
+var drawBatchPrefix = []byte(`{"type":"` + game.EventDrawBatch + `"`)
+
+// splitDrawBatch turns an encoded draw-batch event into its line and fill
+// events, for clients speaking a protocol version without batches. Only the
+// last one carries the sequence number of the batch, as clients drop events
+// with a number they've already seen. False is returned for other events.
+func splitDrawBatch(data []byte) ([][]byte, bool) {
+	if !bytes.HasPrefix(data, drawBatchPrefix) {
+		return nil, false
+	}
+	batch := struct {
+		Data []*game.Packet `json:"data"`
+		Seq  uint64         `json:"seq"`
+	}{}
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, false
+	}
+
+	events := make([][]byte, 0, len(batch.Data))
+	for index, op := range batch.Data {
+		event := &jsEvent{Type: op.Type, Data: op.Data}
+		if index == len(batch.Data)-1 {
+			event.Seq = batch.Seq
+		}
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return nil, false
+		}
+		events = append(events, encoded)
+	}
+	return events, true
+}
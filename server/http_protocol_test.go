@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	game.Store = store.NewMemStore()
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	// Every client gets a lobby of its own, as closing the connection of
+	// its only player removes a lobby.
+	dial := func(query string) (*websocket.Conn, string) {
+		owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+			DrawingTime:       120,
+			Rounds:            2,
+			MaxPlayers:        4,
+			ClientsPerIPLimit: 4,
+		}, broadcaster)
+		require.Nil(t, err)
+		return dialLobbyWithQuery(t, server, lobby.ID, owner.GetSession(), query), lobby.ID
+	}
+
+	versions := map[string]int{
+		"&v=1":  1,
+		"&v=2":  game.ProtocolVersion,
+		"&v=99": game.ProtocolVersion,
+	}
+	for query, version := range versions {
+		ws, lobbyID := dial(query)
+		defer game.RemoveLobby(lobbyID)
+		hello := &game.Hello{}
+		require.Nil(t, json.Unmarshal(readEvent(t, ws, game.EventHello), hello))
+		require.Equal(t, version, hello.Version)
+		require.Equal(t, game.MinProtocolVersion, hello.MinVersion)
+		readEvent(t, ws, game.EventReady)
+		ws.Close()
+	}
+
+	// Clients from before the handshake don't announce a version and
+	// can't handle the events of newer ones.
+	for _, query := range []string{"", "&v=0", "&v=x"} {
+		ws, lobbyID := dial(query)
+		defer game.RemoveLobby(lobbyID)
+		packetErr := &game.PacketError{}
+		require.Nil(t, json.Unmarshal(readEvent(t, ws, game.EventError), packetErr))
+		require.Equal(t, game.ErrorUnsupportedProtocolVersion, packetErr.Code)
+		requireClosed(t, ws, closeUnsupportedProtocol)
+		ws.Close()
+	}
+}
+
+func TestProtocolEndpoint(t *testing.T) {
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/v1/protocol")
+	require.Nil(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	schema := map[string]interface{}{}
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&schema))
+	require.Equal(t, float64(game.ProtocolVersion), schema["protocolVersion"])
+	require.Contains(t, schema["serverMessages"], game.EventHello)
+}
+
+func TestDrawBatchesAreSplitForOlderClients(t *testing.T) {
+	game.Store = store.NewMemStore()
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 50 * time.Millisecond
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	// As the drawer is chosen randomly, there are two players of each
+	// version, so that at least one of each is guessing.
+	versions := map[*game.Player]int{
+		owner: game.ProtocolVersion,
+		lobby.JoinPlayer("new", "new-session", 0):     game.ProtocolVersion,
+		lobby.JoinPlayer("old", "old-session", 0):     1,
+		lobby.JoinPlayer("older", "older-session", 0): 1,
+	}
+	sockets := map[*game.Player]*websocket.Conn{}
+	for player, version := range versions {
+		ws := dialLobbyWithQuery(t, server, lobby.ID, player.GetSession(), "&v="+strconv.Itoa(version))
+		defer ws.Close()
+		readEvent(t, ws, game.EventReady)
+		sockets[player] = ws
+	}
+
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	drawer := lobby.GetPlayerById(lobby.State.Drawer)
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word","data":0}`), drawer))
+	for i := 0; i < 3; i++ {
+		line := fmt.Sprintf(`{"type":"line","data":{"fromX":%d,"fromY":0,"toX":10,"toY":10,"color":"#000000","lineWidth":5,"gestureId":1}}`, i)
+		require.Nil(t, lobby.HandlePacket([]byte(line), drawer))
+	}
+
+	for player, ws := range sockets {
+		if player == drawer {
+			continue
+		}
+		if versions[player] >= game.DrawBatchProtocolVersion {
+			batch := []*game.Packet{}
+			require.Nil(t, json.Unmarshal(readEvent(t, ws, game.EventDrawBatch), &batch))
+			require.Len(t, batch, 3)
+			continue
+		}
+
+		// Only the last line carries the sequence number of the batch.
+		lines := []*jsEvent{}
+		for len(lines) < 3 {
+			event := readSequenced(t, ws)
+			require.NotEqual(t, game.EventDrawBatch, event.Type)
+			if event.Type == game.EventLine {
+				lines = append(lines, event)
+			}
+		}
+		require.Zero(t, lines[0].Seq)
+		require.Zero(t, lines[1].Seq)
+		require.NotZero(t, lines[2].Seq)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+// MaxRecordingSize is the largest recording that can be uploaded for replay.
+var MaxRecordingSize int64 = 32 << 20
+
+// recordingHandler offers the recording of the lobby for download as
+// .scribble file, which can be replayed later on. The turn that is still
+// running is left out, so the file can't be used to look up the word.
+func recordingHandler(w http.ResponseWriter, r *http.Request, lobby *game.Lobby, player *game.Player) {
+	recording := lobby.Recording()
+	if recording == nil {
+		http.Error(w, "replays aren't recorded", http.StatusNotFound)
+		return
+	}
+	recording = recording.WithoutRunningTurn()
+
+	var buffer bytes.Buffer
+	err := recording.Encode(&buffer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.scribble"`, lobby.ID))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buffer.Bytes())
+}
+
+// replayEndpoint loads an uploaded recording into a new read-only lobby and
+// sends the uploader there. The recording is either the request body or the
+// "recording" field of a multipart form. Replays only run on the server
+// instance they have been uploaded to.
+func replayEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxRecordingSize)
+	var upload io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("recording")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		upload = file
+	}
+
+	recording, err := game.DecodeRecording(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lobby, err := game.NewReplayLobby(recording, broadcaster)
+	if err == game.ErrTooManyReplays {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if node := nodeFromRequest(r); node != nil {
+		_, err := node.claim(lobby.ID)
+		if err != nil {
+			fmt.Println("could not claim replay lobby", err)
+		}
+	}
+
+	http.Redirect(w, r, "/ssrEnterLobby?lobby_id="+lobby.ID, http.StatusSeeOther)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingCanBeReplayed(t *testing.T) {
+	game.Store = store.NewMemStore()
+	defaultWindow := game.DrawBatchWindow
+	game.DrawBatchWindow = 0
+	defer func() { game.DrawBatchWindow = defaultWindow }()
+
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	guest := lobby.JoinPlayer("guest", "", 0)
+	lobby.Connect(owner)
+	lobby.Connect(guest)
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	playTurn(t, lobby, `{"type":"fill","data":{"x":10,"y":10,"color":"#00ff00"}}`)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	response := getAsPlayer(t, server, "/v1/lobby/"+lobby.ID+"/recording.scribble", guest.GetSession())
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, `attachment; filename="`+lobby.ID+`.scribble"`, response.Header.Get("Content-Disposition"))
+	file, err := ioutil.ReadAll(response.Body)
+	require.Nil(t, err)
+	recording, err := game.DecodeRecording(bytes.NewReader(file))
+	require.Nil(t, err)
+	require.Equal(t, lobby.ID, recording.Header().LobbyID)
+
+	// Uploading the recording with the form of the start page creates a
+	// replay and redirects there.
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, err := writer.CreateFormFile("recording", "game.scribble")
+	require.Nil(t, err)
+	part.Write(file)
+	require.Nil(t, writer.Close())
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err = client.Post(server.URL+"/v1/replay", writer.FormDataContentType(), bytes.NewReader(form.Bytes()))
+	require.Nil(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusSeeOther, response.StatusCode)
+	location, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, "/ssrEnterLobby", location.Path)
+
+	replay := game.GetLobby(location.Query().Get("lobby_id"))
+	require.NotNil(t, replay)
+	defer game.RemoveLobby(replay.ID)
+	require.True(t, replay.IsReplay())
+	require.Equal(t, int64(recording.Duration()/time.Millisecond), replay.ReplayStatus().Duration)
+
+	// Replays aren't recorded themselves.
+	viewer := replay.JoinPlayer("viewer", "", 0)
+	response = getAsPlayer(t, server, "/v1/lobby/"+replay.ID+"/recording.scribble", viewer.GetSession())
+	response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, err = client.Post(server.URL+"/v1/replay", "application/octet-stream", bytes.NewBufferString("not a recording"))
+	require.Nil(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// Only so many replays run at the same time.
+	defaultReplays := game.MaxReplayLobbies
+	game.MaxReplayLobbies = 1
+	defer func() { game.MaxReplayLobbies = defaultReplays }()
+	response, err = client.Post(server.URL+"/v1/replay", writer.FormDataContentType(), bytes.NewReader(form.Bytes()))
+	require.Nil(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+}
+
+// wordsOfRecording returns the chosen words and the chat messages of the
+// recording that can be downloaded from the lobby.
+func wordsOfRecording(t *testing.T, server *httptest.Server, lobbyID, session string) ([]string, []string) {
+	response := getAsPlayer(t, server, "/v1/lobby/"+lobbyID+"/recording.scribble", session)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	recording, err := game.DecodeRecording(response.Body)
+	require.Nil(t, err)
+
+	words, chat := []string{}, []string{}
+	for _, entry := range recording.Entries() {
+		switch entry.Type {
+		case game.RecordWordChoice:
+			choice := &game.RecordedWordChoice{}
+			require.Nil(t, json.Unmarshal(entry.Data, choice))
+			words = append(words, choice.Word)
+		case game.RecordChat:
+			message := &game.RecordedChat{}
+			require.Nil(t, json.Unmarshal(entry.Data, message))
+			chat = append(chat, message.Content)
+		}
+	}
+	return words, chat
+}
+
+func TestRecordingLeavesOutRunningTurn(t *testing.T) {
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+	guest := lobby.JoinPlayer("guest", "", 0)
+	lobby.Connect(owner)
+	lobby.Connect(guest)
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"start"}`), owner))
+	playTurn(t, lobby)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	// The drawer gives the word away to the players that aren't guessing.
+	drawer, guesser := owner, guest
+	if lobby.State.Drawer == guest.ID {
+		drawer, guesser = guest, owner
+	}
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"choose-word","data":0}`), drawer))
+	word := lobby.State.CurrentWord
+	message, err := json.Marshal(word)
+	require.Nil(t, err)
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"message","data":`+string(message)+`}`), drawer))
+
+	// Mid-turn, the recording ends before the turn.
+	words, chat := wordsOfRecording(t, server, lobby.ID, guesser.GetSession())
+	require.Len(t, words, 1)
+	require.NotContains(t, words, word)
+	require.NotContains(t, chat, word)
+
+	// Once the turn is over, it is part of the recording.
+	require.Nil(t, lobby.HandlePacket([]byte(`{"type":"message","data":`+string(message)+`}`), guesser))
+	words, chat = wordsOfRecording(t, server, lobby.ID, guesser.GetSession())
+	require.Len(t, words, 2)
+	require.Contains(t, words, word)
+	require.Contains(t, chat, word)
+}
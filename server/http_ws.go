@@ -1,11 +1,14 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/websocket"
@@ -16,6 +19,7 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{msgpackSubprotocol},
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
@@ -23,19 +27,19 @@ var upgrader = websocket.Upgrader{
 type jsEvent struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+	// Seq numbers the events of a lobby, it is omitted for events that
+	// aren't part of a lobby, such as session-replaced.
+	Seq uint64 `json:"seq,omitempty"`
 }
 
-func init() {
-	game.TriggerComplexUpdateEvent = TriggerComplexUpdateEvent
-	game.TriggerSimpleUpdateEvent = TriggerSimpleUpdateEvent
-	game.SendDataToOtherPlayers = SendDataToOtherPlayers
-	game.WriteAsJSON = WriteAsJSON
-	game.WritePublicSystemMessage = WritePublicSystemMessage
-	game.TriggerComplexUpdatePerPlayerEvent = TriggerComplexUpdatePerPlayerEvent
-}
+// socketBroadcaster is the game.Broadcaster used for all lobbies run by
+// the server. It writes to the players sockets.
+type socketBroadcaster struct{}
+
+var broadcaster game.Broadcaster = socketBroadcaster{}
 
 func wsEndpoint(w http.ResponseWriter, r *http.Request) {
-	lobby, err := getLobbyHandler(r)
+	lobby, remoteOwner, err := getLobbyAndOwner(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -68,25 +72,92 @@ func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	socket := newQueuedSocket(ws)
+	if !handshake(socket, clientProtocolVersion(r)) {
+		return
+	}
+	epoch, lastSeq := lastSeenEvent(r)
+
+	if remoteOwner != "" {
+		log.Println(player.Name + " has connected, relaying to node " + remoteOwner)
+		go nodeFromRequest(r).relay(remoteOwner, lobby.ID, player, socket, epoch, lastSeq)
+		return
+	}
+
 	log.Println(player.Name + " has connected")
 
-	player.SetWebsocket(ws)
-	lobby.Connect(player)
+	connectSocket(lobby, player, socket, epoch, lastSeq)
 
 	ws.SetCloseHandler(func(code int, text string) error {
-		lobby.Disconnect(player)
+		lobby.DisconnectSocket(player, socket)
 		return nil
 	})
 
-	go wsListen(lobby, player, ws)
+	go wsListen(lobby, player, socket)
+}
+
+// lastSeenEvent returns the epoch and sequence number of the last event a
+// reconnecting client has received. A sequence number of zero means that the
+// client has no state yet.
+func lastSeenEvent(r *http.Request) (string, uint64) {
+	query := r.URL.Query()
+	seq, err := strconv.ParseUint(query.Get("seq"), 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return query.Get("epoch"), seq
+}
+
+var sessionReplacedEvent = &jsEvent{
+	Type: game.EventSessionReplaced,
+	Data: "This lobby has been opened in another tab or window.",
+}
+
+// replaceableSocket is a connection that can be notified about being
+// superseded by a newer connection of the same session.
+type replaceableSocket interface {
+	sessionReplaced()
+}
+
+// connectSocket makes the socket the players connection and connects the
+// player to the lobby. Clients that have already seen parts of the lobby
+// only get the events they have missed. There's only one connection per
+// session, if the player is already connected, for example in another tab,
+// the newest connection wins. The old one is told why and closed. Since it
+// isn't the players connection anymore, closing it doesn't disconnect the
+// player.
+func connectSocket(lobby *game.Lobby, player *game.Player, socket game.Socket, epoch string, lastSeq uint64) {
+	closeReplaced(lobby.ConnectSocket(player, socket, epoch, lastSeq))
 }
 
-func wsListen(l *game.Lobby, player *game.Player, socket *websocket.Conn) {
+// closeReplaced tells a connection that has been replaced by a newer one why
+// and closes it.
+func closeReplaced(previous game.Socket) {
+	if previous == nil {
+		return
+	}
+	if replaceable, ok := previous.(replaceableSocket); ok {
+		replaceable.sessionReplaced()
+	} else {
+		previous.Close()
+	}
+}
+
+// currentSocket returns the players connection. It is read while holding the
+// socket lock, as it is replaced and removed while the lobby is running.
+func currentSocket(player *game.Player) game.Socket {
+	mutex := player.GetWebsocketMutex()
+	mutex.Lock()
+	defer mutex.Unlock()
+	return player.GetWebsocket()
+}
+
+func wsListen(l *game.Lobby, player *game.Player, socket *queuedSocket) {
 	//Workaround to prevent crash
 	defer func() {
 		err := recover()
 		if err != nil {
-			l.Disconnect(player)
+			l.DisconnectSocket(player, socket)
 			log.Println("Error occurred in wsListen: ", err)
 		}
 	}()
@@ -94,20 +165,22 @@ func wsListen(l *game.Lobby, player *game.Player, socket *websocket.Conn) {
 	defer socket.Close()
 
 	for {
-		_, bytes, err := socket.ReadMessage()
+		bytes, err := socket.readMessage()
 		if err != nil {
 			if websocket.IsCloseError(err) ||
 				websocket.IsUnexpectedCloseError(err) ||
+				// The client stopped answering pings.
+				isTimeout(err) ||
 				// This happens when the server closes the connection. It will cause 1000 retries followed by a panic.
 				strings.Contains(err.Error(), "use of closed network connection") {
 				// Make sure that the sockethandler is called
-				l.Disconnect(player)
+				l.DisconnectSocket(player, socket)
 				log.Println(player.Name + " disconnected.")
 				return
 			}
 
 			log.Printf("Error reading from socket: %s\n", err)
-			err := WriteAsJSON(player, jsEvent{Type: "system-message", Data: fmt.Sprintf("An error occured trying to read your request, please report the error via GitHub: %s!", err)})
+			err := broadcaster.WriteAsJSON(player, l, jsEvent{Type: game.EventSystemMessage, Data: fmt.Sprintf("An error occured trying to read your request, please report the error via GitHub: %s!", err)})
 			if err != nil {
 				log.Printf("Error sending errormessage: %s\n", err)
 			}
@@ -115,6 +188,12 @@ func wsListen(l *game.Lobby, player *game.Player, socket *websocket.Conn) {
 			continue
 		}
 
+		// A newer connection of the same session has taken over, this one
+		// is closed as soon as the pending messages have been written.
+		if currentSocket(player) != game.Socket(socket) {
+			continue
+		}
+
 		err = l.HandlePacket(bytes, player)
 		if err != nil {
 			log.Printf("Error handling event: %s\n", err)
@@ -123,42 +202,109 @@ func wsListen(l *game.Lobby, player *game.Player, socket *websocket.Conn) {
 	}
 }
 
-// TODO: correct this cross-package callback voodoo.
-func SendDataToOtherPlayers(sender *game.Player, lobby *game.Lobby, data interface{}) {
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (socketBroadcaster) SendDataToOtherPlayers(sender *game.Player, lobby *game.Lobby, data interface{}) {
+	event, err := encodeEvent(lobby, "", sender.ID, data)
+	if err != nil {
+		log.Printf("Error encoding event: %s\n", err)
+		return
+	}
 	for _, player := range lobby.State.Players {
 		if player != sender {
-			WriteAsJSON(player, data)
+			writeEncoded(player, event)
 		}
 	}
 }
 
-func TriggerSimpleUpdateEvent(eventType string, lobby *game.Lobby) {
-	event := &jsEvent{Type: eventType}
+func (b socketBroadcaster) TriggerSimpleUpdateEvent(eventType string, lobby *game.Lobby) {
+	b.writeToAll(lobby, &jsEvent{Type: eventType})
+}
+
+func (b socketBroadcaster) TriggerComplexUpdateEvent(eventType string, data interface{}, lobby *game.Lobby) {
+	b.writeToAll(lobby, &jsEvent{Type: eventType, Data: data})
+}
+
+func (socketBroadcaster) TriggerComplexUpdatePerPlayerEvent(eventType string, data func(*game.Player) interface{}, lobby *game.Lobby) {
 	for _, player := range lobby.State.Players {
-		//FIXME Why did i use a goroutine here but not anywhere else?
+		event, err := encodeEvent(lobby, player.ID, "", &jsEvent{Type: eventType, Data: data(player)})
+		if err != nil {
+			log.Printf("Error encoding event: %s\n", err)
+			continue
+		}
+		writeEncoded(player, event)
+	}
+}
 
-		go func(player *game.Player) {
-			WriteAsJSON(player, event)
-		}(player)
+// WriteAsJSON marshals the given input into a JSON string and sends it to the
+// player using the currently established websocket connection.
+func (socketBroadcaster) WriteAsJSON(player *game.Player, lobby *game.Lobby, object interface{}) error {
+	event, err := encodeEvent(lobby, player.ID, "", object)
+	if err != nil {
+		return err
 	}
+	return writeEncoded(player, event)
+}
+
+func (b socketBroadcaster) WritePublicSystemMessage(lobby *game.Lobby, text string) {
+	b.writeToAll(lobby, &jsEvent{Type: game.EventSystemMessage, Data: html.EscapeString(text)})
 }
 
-func TriggerComplexUpdateEvent(eventType string, data interface{}, lobby *game.Lobby) {
-	event := &jsEvent{Type: eventType, Data: data}
+// writeToAll sends the same event to all players, encoding it only once.
+func (socketBroadcaster) writeToAll(lobby *game.Lobby, object interface{}) {
+	event, err := encodeEvent(lobby, "", "", object)
+	if err != nil {
+		log.Printf("Error encoding event: %s\n", err)
+		return
+	}
 	for _, player := range lobby.State.Players {
-		WriteAsJSON(player, event)
+		writeEncoded(player, event)
 	}
 }
 
-func TriggerComplexUpdatePerPlayerEvent(eventType string, data func(*game.Player) interface{}, lobby *game.Lobby) {
-	for _, player := range lobby.State.Players {
-		WriteAsJSON(player, &jsEvent{Type: eventType, Data: data(player)})
+// encodeEvent numbers the event and records it in the lobbies event log, so
+// that it can be sent again to players who missed it. Events are logged even
+// if the players they are meant for aren't connected right now.
+func encodeEvent(lobby *game.Lobby, target, exclude string, object interface{}) (*encodedEvent, error) {
+	data, err := lobby.Events().Append(target, exclude, func(seq uint64) ([]byte, error) {
+		return json.Marshal(withSeq(object, seq))
+	})
+	if err != nil {
+		return nil, err
 	}
+	return newEncodedEvent(data), nil
 }
 
-// WriteAsJSON marshals the given input into a JSON string and sends it to the
-// player using the currently established websocket connection.
-func WriteAsJSON(player *game.Player, object interface{}) error {
+// withSeq returns the event with the given sequence number attached.
+func withSeq(object interface{}, seq uint64) interface{} {
+	switch event := object.(type) {
+	case *jsEvent:
+		sequenced := *event
+		sequenced.Seq = seq
+		return &sequenced
+	case jsEvent:
+		event.Seq = seq
+		return &event
+	case *game.Packet:
+		return &jsEvent{Type: event.Type, Data: event.Data, Seq: seq}
+	case game.Packet:
+		return &jsEvent{Type: event.Type, Data: event.Data, Seq: seq}
+	}
+	return object
+}
+
+// eventWriter is implemented by sockets that can send already encoded
+// events, which saves encoding events once per player.
+type eventWriter interface {
+	writeEvent(event *encodedEvent) error
+}
+
+// writeEncoded sends an encoded event to the player using the currently
+// established connection.
+func writeEncoded(player *game.Player, event *encodedEvent) error {
 	player.GetWebsocketMutex().Lock()
 	defer player.GetWebsocketMutex().Unlock()
 
@@ -167,25 +313,8 @@ func WriteAsJSON(player *game.Player, object interface{}) error {
 		return errors.New("player not connected")
 	}
 
-	p, ok := object.(*jsEvent)
-	if ok {
-		fmt.Printf("sending packet type: %s to %s\n", p.Type, player.Name)
-	} else {
-		pc, ok := object.(*game.Packet)
-		if ok {
-			fmt.Printf("sending packet type: %s to %s\n", pc.Type, player.Name)
-		} else {
-
-		}
-	}
-
-	return socket.WriteJSON(object)
-}
-
-func WritePublicSystemMessage(lobby *game.Lobby, text string) {
-	playerHasBeenKickedMsg := &jsEvent{Type: "system-message", Data: html.EscapeString(text)}
-	for _, otherPlayer := range lobby.State.Players {
-
-		WriteAsJSON(otherPlayer, playerHasBeenKickedMsg)
+	if writer, ok := socket.(eventWriter); ok {
+		return writer.writeEvent(event)
 	}
+	return socket.WriteJSON(json.RawMessage(event.json))
 }
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewestTabReplacesOlderOne(t *testing.T) {
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	firstTab := dialLobby(t, server, lobby.ID, owner.GetSession())
+	defer firstTab.Close()
+	readEvent(t, firstTab, "ready")
+	player := game.GetLobby(lobby.ID).GetPlayerBySession(owner.GetSession())
+
+	secondTab := dialLobby(t, server, lobby.ID, owner.GetSession())
+	defer secondTab.Close()
+	readEvent(t, secondTab, "ready")
+
+	readEvent(t, firstTab, "session-replaced")
+	requireClosed(t, firstTab, closeSessionReplaced)
+
+	// Closing the old tab mustn't disconnect the new one.
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, player.IsConnected())
+
+	require.Nil(t, secondTab.WriteJSON(map[string]interface{}{"type": "message", "data": "still here"}))
+	message := &game.Message{}
+	require.Nil(t, json.Unmarshal(readEvent(t, secondTab, "message"), message))
+	require.Equal(t, "still here", message.Content)
+
+	secondTab.Close()
+	require.Eventually(t, func() bool {
+		return !player.IsConnected()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// readSequenced reads the next event of the lobby from the socket, including
+// its sequence number. The hello of the handshake is skipped.
+func readSequenced(t *testing.T, ws *websocket.Conn) *jsEvent {
+	require.Nil(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		event := &jsEvent{}
+		require.Nil(t, ws.ReadJSON(event))
+		if event.Type != game.EventHello {
+			return event
+		}
+	}
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	ownerWs := dialLobby(t, server, lobby.ID, owner.GetSession())
+	defer ownerWs.Close()
+	readEvent(t, ownerWs, "ready")
+
+	loaded := game.GetLobby(lobby.ID)
+	guest := loaded.JoinPlayer("guest", "guest-session", 0)
+
+	guestWs := dialLobby(t, server, lobby.ID, guest.GetSession())
+	ready := readSequenced(t, guestWs)
+	require.Equal(t, "ready", ready.Type)
+	require.NotZero(t, ready.Seq)
+	epoch := ready.Data.(map[string]interface{})["epoch"].(string)
+	require.Equal(t, loaded.Events().Epoch(), epoch)
+	lastSeq := ready.Seq
+	for lastSeq < loaded.Events().Seq() {
+		lastSeq = readSequenced(t, guestWs).Seq
+	}
+
+	// The guest loses the connection while the owner keeps chatting.
+	guestWs.Close()
+	require.Eventually(t, func() bool {
+		return !guest.IsConnected()
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, text := range []string{"first", "second"} {
+		require.Nil(t, ownerWs.WriteJSON(map[string]interface{}{"type": "message", "data": text}))
+	}
+	require.Eventually(t, func() bool {
+		return loaded.Events().Seq() >= lastSeq+2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resumeQuery := func(epoch string, seq uint64) string {
+		return currentVersion + "&epoch=" + epoch + "&seq=" + strconv.FormatUint(seq, 10)
+	}
+	guestWs = dialLobbyWithQuery(t, server, lobby.ID, guest.GetSession(), resumeQuery(epoch, lastSeq))
+	defer guestWs.Close()
+	messages := []string{}
+	for len(messages) < 2 {
+		event := readSequenced(t, guestWs)
+		require.NotEqual(t, "ready", event.Type)
+		require.True(t, event.Seq > lastSeq)
+		lastSeq = event.Seq
+		if event.Type == "message" {
+			messages = append(messages, event.Data.(map[string]interface{})["content"].(string))
+		}
+	}
+	require.Equal(t, []string{"first", "second"}, messages)
+
+	// Unknown sequence numbers fall back to a full snapshot.
+	guestWs.Close()
+	staleWs := dialLobbyWithQuery(t, server, lobby.ID, guest.GetSession(), resumeQuery(epoch, 999999))
+	readEvent(t, staleWs, "ready")
+	staleWs.Close()
+
+	// So do known sequence numbers of another epoch, for example from before
+	// the lobby was loaded again.
+	otherWs := dialLobbyWithQuery(t, server, lobby.ID, guest.GetSession(), resumeQuery("other-epoch", lastSeq-1))
+	defer otherWs.Close()
+	readEvent(t, otherWs, "ready")
+}
@@ -11,6 +11,7 @@ var (
 	errorPage       *template.Template
 	lobbyCreatePage *template.Template
 	lobbyPage       *template.Template
+	galleryPage     *template.Template
 )
 
 //In this init hook we initialize all templates that could at some point be
@@ -48,6 +49,16 @@ func init() {
 		panic(parseError)
 	}
 
+	// Gallery of finished turns
+	galleryPage, parseError = template.New("gallery.html").Parse(readTemplateFile("gallery.html"))
+	if parseError != nil {
+		panic(parseError)
+	}
+	galleryPage, parseError = galleryPage.New("header.html").Parse(readTemplateFile("header.html"))
+	if parseError != nil {
+		panic(parseError)
+	}
+
 }
 
 func readTemplateFile(name string) string {
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// msgpackSubprotocol is the websocket subprotocol clients request to talk
+// msgpack instead of JSON. The messages have the same structure either way,
+// msgpack just saves bandwidth, mostly for drawing traffic.
+const msgpackSubprotocol = "msgpack"
+
+// encodedEvent is an event encoded for all of its recipients. The msgpack
+// encoding is only created once a recipient asks for it, and then reused for
+// every other one.
+type encodedEvent struct {
+	json []byte
+
+	msgpackOnce sync.Once
+	msgpack     []byte
+	msgpackErr  error
+}
+
+func newEncodedEvent(data []byte) *encodedEvent {
+	return &encodedEvent{json: data}
+}
+
+func (e *encodedEvent) msgpackData() ([]byte, error) {
+	e.msgpackOnce.Do(func() {
+		e.msgpack, e.msgpackErr = jsonToMsgpack(e.json)
+	})
+	return e.msgpack, e.msgpackErr
+}
+
+// jsonToMsgpack converts a JSON document to msgpack. Going through JSON
+// makes sure that the messages look the same in both encodings, including
+// field names and custom marshallers.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer).UseCompactEncoding(true)
+	if err := encoder.Encode(withMsgpackNumbers(value)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// withMsgpackNumbers replaces the JSON numbers in the value with integers
+// where possible, as msgpack encodes those more compactly than floats.
+func withMsgpackNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		return float
+	case map[string]interface{}:
+		for key, element := range value {
+			value[key] = withMsgpackNumbers(element)
+		}
+	case []interface{}:
+		for index, element := range value {
+			value[index] = withMsgpackNumbers(element)
+		}
+	}
+	return value
+}
+
+// msgpackToJSON converts a msgpack message sent by a client to JSON, which
+// is what the lobby expects packets to be.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestJSONToMsgpack(t *testing.T) {
+	data, err := jsonToMsgpack([]byte(`{"type":"line","seq":7,"data":{"fromX":1.5,"toX":2,"color":"#000000"}}`))
+	require.Nil(t, err)
+
+	event := map[string]interface{}{}
+	require.Nil(t, msgpack.Unmarshal(data, &event))
+	require.Equal(t, "line", event["type"])
+	require.EqualValues(t, 7, event["seq"])
+	line := event["data"].(map[string]interface{})
+	require.Equal(t, 1.5, line["fromX"])
+	require.EqualValues(t, 2, line["toX"])
+	require.Equal(t, "#000000", line["color"])
+
+	converted, err := msgpackToJSON(data)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"type":"line","seq":7,"data":{"fromX":1.5,"toX":2,"color":"#000000"}}`, string(converted))
+}
+
+func TestEncodedEventConvertsOnce(t *testing.T) {
+	event := newEncodedEvent([]byte(`{"type":"undo"}`))
+	first, err := event.msgpackData()
+	require.Nil(t, err)
+	second, err := event.msgpackData()
+	require.Nil(t, err)
+	require.True(t, &first[0] == &second[0])
+}
+
+func dialMsgpack(t *testing.T, server *httptest.Server, lobbyID, session string) *websocket.Conn {
+	header := http.Header{}
+	header.Set("Cookie", "X-UserSession="+session)
+	dialer := websocket.Dialer{Subprotocols: []string{msgpackSubprotocol}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/ws?lobby_id=" + lobbyID + currentVersion
+	ws, _, err := dialer.Dial(url, header)
+	require.Nil(t, err)
+	require.Equal(t, msgpackSubprotocol, ws.Subprotocol())
+	return ws
+}
+
+// readMsgpackEvent reads from the socket until an event of the given type
+// arrives. All messages have to be binary.
+func readMsgpackEvent(t *testing.T, ws *websocket.Conn, eventType string) map[string]interface{} {
+	require.Nil(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		messageType, data, err := ws.ReadMessage()
+		require.Nil(t, err)
+		require.Equal(t, websocket.BinaryMessage, messageType)
+		event := map[string]interface{}{}
+		require.Nil(t, msgpack.Unmarshal(data, &event))
+		if event["type"] == eventType {
+			return event
+		}
+	}
+}
+
+func TestMsgpackSubprotocol(t *testing.T) {
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	binaryWs := dialMsgpack(t, server, lobby.ID, owner.GetSession())
+	defer binaryWs.Close()
+	readMsgpackEvent(t, binaryWs, game.EventHello)
+	readMsgpackEvent(t, binaryWs, game.EventReady)
+
+	guest := game.GetLobby(lobby.ID).JoinPlayer("guest", "guest-session", 0)
+	jsonWs := dialLobby(t, server, lobby.ID, guest.GetSession())
+	defer jsonWs.Close()
+	readEvent(t, jsonWs, game.EventReady)
+
+	packet, err := msgpack.Marshal(map[string]interface{}{"type": game.PacketMessage, "data": "binary hello"})
+	require.Nil(t, err)
+	require.Nil(t, binaryWs.WriteMessage(websocket.BinaryMessage, packet))
+
+	// Both encodings of the same broadcast reach their clients.
+	message := readMsgpackEvent(t, binaryWs, game.EventMessage)
+	require.Equal(t, "binary hello", message["data"].(map[string]interface{})["content"])
+	require.Contains(t, string(readEvent(t, jsonWs, game.EventMessage)), "binary hello")
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/scribble-rs/scribble.rs/game"
+)
+
+var (
+	// SendQueueSize is the number of outgoing messages that may be waiting
+	// for a client. Clients falling further behind are disconnected.
+	SendQueueSize = 256
+	// WriteTimeout is the time a single write to a client may take.
+	WriteTimeout = 10 * time.Second
+	// PingInterval is the interval in which clients are pinged.
+	PingInterval = 30 * time.Second
+	// PongTimeout is the time after which a client that hasn't answered a
+	// ping or sent anything else is considered dead. It has to be longer
+	// than PingInterval.
+	PongTimeout = 60 * time.Second
+)
+
+// closeSessionReplaced is sent to connections that have been replaced by a
+// newer connection of the same session.
+const closeSessionReplaced = 4000
+
+var (
+	errSocketClosed = errors.New("socket closed")
+	errSlowConsumer = errors.New("client too slow, send queue full")
+)
+
+// queuedSocket decouples the game logic from the network. Messages are put
+// into a bounded queue, which is drained by a dedicated writer goroutine, so
+// a stalled client can't block the lobby. If the queue overflows, the client
+// is disconnected. The writer also pings the client, reads fail once the
+// client stops answering.
+type queuedSocket struct {
+	ws    *websocket.Conn
+	queue chan outgoing
+	done  chan struct{}
+	// binary is set if the client has negotiated the msgpack subprotocol.
+	binary bool
+	// version is the protocol version negotiated in the handshake.
+	version int
+
+	closeOnce sync.Once
+}
+
+// outgoing is a queued message, either data or a final close frame.
+type outgoing struct {
+	messageType int
+	data        []byte
+}
+
+func newQueuedSocket(ws *websocket.Conn) *queuedSocket {
+	socket := &queuedSocket{
+		ws:    ws,
+		queue: make(chan outgoing, SendQueueSize),
+		done:  make(chan struct{}),
+
+		binary: ws.Subprotocol() == msgpackSubprotocol,
+	}
+	socket.extendReadDeadline()
+	ws.SetPongHandler(func(string) error {
+		socket.extendReadDeadline()
+		return nil
+	})
+	go socket.writeLoop()
+	return socket
+}
+
+func (s *queuedSocket) extendReadDeadline() {
+	s.ws.SetReadDeadline(time.Now().Add(PongTimeout))
+}
+
+// readMessage reads the next message from the client. Any message proves
+// that the client is still alive. Binary messages are msgpack and returned
+// as JSON.
+func (s *queuedSocket) readMessage() ([]byte, error) {
+	messageType, data, err := s.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	s.extendReadDeadline()
+
+	if messageType == websocket.BinaryMessage {
+		converted, err := msgpackToJSON(data)
+		if err != nil {
+			// Passed on as is, so it is rejected as an invalid packet.
+			return data, nil
+		}
+		return converted, nil
+	}
+	return data, nil
+}
+
+func (s *queuedSocket) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.writeRaw(data)
+}
+
+// writeRaw sends a message that has already been encoded as JSON.
+func (s *queuedSocket) writeRaw(data []byte) error {
+	if events, ok := s.unbatch(data); ok {
+		return s.writeEach(events)
+	}
+	if !s.binary {
+		return s.enqueue(websocket.TextMessage, data)
+	}
+	data, err := jsonToMsgpack(data)
+	if err != nil {
+		return err
+	}
+	return s.enqueue(websocket.BinaryMessage, data)
+}
+
+// writeEvent sends an event in the encoding the client has negotiated.
+func (s *queuedSocket) writeEvent(event *encodedEvent) error {
+	if events, ok := s.unbatch(event.json); ok {
+		return s.writeEach(events)
+	}
+	if !s.binary {
+		return s.enqueue(websocket.TextMessage, event.json)
+	}
+	data, err := event.msgpackData()
+	if err != nil {
+		return err
+	}
+	return s.enqueue(websocket.BinaryMessage, data)
+}
+
+// unbatch splits draw-batch events for clients that don't know them yet.
+func (s *queuedSocket) unbatch(data []byte) ([][]byte, bool) {
+	if s.version >= game.DrawBatchProtocolVersion {
+		return nil, false
+	}
+	return splitDrawBatch(data)
+}
+
+// writeEach sends several messages encoded as JSON, stopping at the first
+// error.
+func (s *queuedSocket) writeEach(events [][]byte) error {
+	for _, data := range events {
+		if err := s.writeRaw(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue queues an already encoded message.
+func (s *queuedSocket) enqueue(messageType int, data []byte) error {
+	select {
+	case <-s.done:
+		return errSocketClosed
+	default:
+	}
+
+	select {
+	case s.queue <- outgoing{messageType: messageType, data: data}:
+		return nil
+	case <-s.done:
+		return errSocketClosed
+	default:
+		log.Printf("Evicting slow client %s\n", s.ws.RemoteAddr())
+		s.closeWithReason(websocket.ClosePolicyViolation, "client too slow, too many pending messages")
+		return errSlowConsumer
+	}
+}
+
+func (s *queuedSocket) writeLoop() {
+	ping := time.NewTicker(PingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ping.C:
+			s.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			err := s.ws.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				log.Printf("Error pinging socket %s: %s\n", s.ws.RemoteAddr(), err)
+				s.Close()
+				return
+			}
+		case message := <-s.queue:
+			s.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			err := s.ws.WriteMessage(message.messageType, message.data)
+			if err != nil {
+				log.Printf("Error writing to socket %s: %s\n", s.ws.RemoteAddr(), err)
+				s.Close()
+				return
+			}
+			if message.messageType == websocket.CloseMessage {
+				s.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// closeWithReason stops accepting messages and closes the connection, telling
+// the client why. Delivering the reason is best effort, as the writer may be
+// stuck on the network, so it happens without blocking the caller.
+func (s *queuedSocket) closeWithReason(code int, reason string) {
+	if !s.stop() {
+		return
+	}
+	go func() {
+		s.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WriteTimeout))
+		s.ws.Close()
+	}()
+}
+
+// closeAfterPending closes the connection once the messages queued so far
+// have been written, ending with a close frame carrying the reason.
+func (s *queuedSocket) closeAfterPending(code int, reason string) {
+	closeFrame := outgoing{
+		messageType: websocket.CloseMessage,
+		data:        websocket.FormatCloseMessage(code, reason),
+	}
+	select {
+	case s.queue <- closeFrame:
+	case <-s.done:
+	default:
+		s.closeWithReason(code, reason)
+	}
+}
+
+// sessionReplaced tells the client that its session has been opened in
+// another tab and closes the connection.
+func (s *queuedSocket) sessionReplaced() {
+	s.WriteJSON(sessionReplacedEvent)
+	s.closeAfterPending(closeSessionReplaced, "session replaced")
+}
+
+// Close stops the writer and closes the connection, which also ends the
+// goroutine reading from it.
+func (s *queuedSocket) Close() error {
+	if !s.stop() {
+		return nil
+	}
+	return s.ws.Close()
+}
+
+// stop makes further writes fail and ends the writer. It returns false if
+// the socket had already been stopped.
+func (s *queuedSocket) stop() bool {
+	stopped := false
+	s.closeOnce.Do(func() {
+		close(s.done)
+		stopped = true
+	})
+	return stopped
+}
+
+func (s *queuedSocket) RemoteAddr() net.Addr {
+	return s.ws.RemoteAddr()
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/scribble-rs/scribble.rs/game"
+	"github.com/scribble-rs/scribble.rs/game/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueuedSocketEvictsSlowConsumer(t *testing.T) {
+	defaultQueueSize := SendQueueSize
+	SendQueueSize = 4
+	defer func() { SendQueueSize = defaultQueueSize }()
+
+	sockets := make(chan *queuedSocket, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		sockets <- newQueuedSocket(ws)
+	}))
+	defer server.Close()
+
+	// The client never reads, so the writer eventually blocks on the
+	// network and the queue fills up.
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.Nil(t, err)
+	defer client.Close()
+
+	socket := <-sockets
+	payload := strings.Repeat("x", 1<<20)
+	var writeErr error
+	for i := 0; i < 1000 && writeErr == nil; i++ {
+		writeErr = socket.WriteJSON(payload)
+	}
+	require.Equal(t, errSlowConsumer, writeErr)
+	require.Equal(t, errSocketClosed, socket.WriteJSON("after eviction"))
+
+	// Once the client catches up, it finds the connection closed.
+	require.Nil(t, client.SetReadDeadline(time.Now().Add(15*time.Second)))
+	for {
+		_, _, err = client.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	require.True(t, websocket.IsUnexpectedCloseError(err) || websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
+
+func TestQueuedSocketSendsEvictionReason(t *testing.T) {
+	sockets := make(chan *queuedSocket, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		sockets <- newQueuedSocket(ws)
+	}))
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.Nil(t, err)
+	defer client.Close()
+
+	socket := <-sockets
+	socket.closeWithReason(websocket.ClosePolicyViolation, "client too slow")
+
+	require.Nil(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err = client.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	require.Contains(t, err.Error(), "client too slow")
+}
+
+func TestDeadClientIsDisconnected(t *testing.T) {
+	defaultPingInterval, defaultPongTimeout := PingInterval, PongTimeout
+	PingInterval, PongTimeout = 20*time.Millisecond, 200*time.Millisecond
+	defer func() { PingInterval, PongTimeout = defaultPingInterval, defaultPongTimeout }()
+
+	game.Store = store.NewMemStore()
+	owner, lobby, err := game.NewLobby("owner", "", "english", 0, game.LobbySettings{
+		DrawingTime:       120,
+		Rounds:            2,
+		MaxPlayers:        4,
+		ClientsPerIPLimit: 4,
+	}, broadcaster)
+	require.Nil(t, err)
+	defer game.RemoveLobby(lobby.ID)
+
+	server := httptest.NewServer(makeServeMux(nil))
+	defer server.Close()
+
+	ws := dialLobby(t, server, lobby.ID, owner.GetSession())
+	defer ws.Close()
+	readEvent(t, ws, "ready")
+	player := game.GetLobby(lobby.ID).GetPlayerBySession(owner.GetSession())
+	require.True(t, player.IsConnected())
+
+	// The client stops reading, so pings go unanswered, as if the peer
+	// vanished without closing the connection.
+	require.Eventually(t, func() bool {
+		return !player.IsConnected()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestQueuedSocketKeepsAnsweringClientAlive(t *testing.T) {
+	defaultPingInterval, defaultPongTimeout := PingInterval, PongTimeout
+	PingInterval, PongTimeout = 20*time.Millisecond, 200*time.Millisecond
+	defer func() { PingInterval, PongTimeout = defaultPingInterval, defaultPongTimeout }()
+
+	readErrors := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		socket := newQueuedSocket(ws)
+		_, err = socket.readMessage()
+		readErrors <- err
+	}))
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.Nil(t, err)
+	// Reading makes the client answer pings.
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-readErrors:
+		t.Fatalf("connection of responsive client failed: %s", err)
+	case <-time.After(4 * PongTimeout):
+	}
+
+	client.Close()
+	require.NotNil(t, <-readErrors)
+}
@@ -79,6 +79,11 @@ export function drawAction(x1, y1, x2, y2) {
         _color = localColor
     }
 
+    // Touches can move beyond the board, the line is drawn along its edge
+    // instead, like the server does for the other players.
+    [x1, y1] = elements.clampToBoard(x1, y1);
+    [x2, y2] = elements.clampToBoard(x2, y2);
+
     canvas.drawLine(x1, y1, x2, y2, _color, localLineWidth);
 
     let _x1 = x1 * elements.scaleUpFactor()
@@ -107,5 +112,11 @@ export function undoAction() {
     
     socket.sendUndo()
 
+    canvas.clear()
     canvas.applyDrawData(gameState.state.currentDrawing)
 }
+
+export function redoAction() {
+    // The server sends the restored gesture back, it is drawn then.
+    socket.sendRedo()
+}
@@ -9,6 +9,12 @@ import gameState from './lib/game-state.js';
 
 var context = drawingBoard.getContext("2d")
 
+// snapshot is an image of the beginning of the drawing, which the server
+// sends to players connecting late instead of all operations. The operations
+// of the game state are drawn on top of it.
+let snapshot = null
+let pendingSnapshot = null
+
 function handleCanvasResize(e) {
     drawingBoard.width = drawingBoard.clientWidth;
     drawingBoard.height = drawingBoard.clientHeight;
@@ -25,9 +31,38 @@ handleCanvasResize();
 window.addEventListener("resize", handleCanvasResize, true);
 
 
+// applySnapshot puts the image at the given URL below the drawing, once it
+// has been loaded.
+export function applySnapshot(url) {
+    let image = new Image()
+    pendingSnapshot = image
+    image.onload = () => {
+        // Replaced or dropped in the meantime.
+        if (pendingSnapshot !== image) {
+            return
+        }
+        pendingSnapshot = null
+        snapshot = image
+        applyDrawData(gameState.state.currentDrawing)
+    }
+    image.src = url
+}
+
+// dropSnapshot forgets the snapshot, for example as the drawing has been
+// cleared.
+export function dropSnapshot() {
+    snapshot = null
+    pendingSnapshot = null
+}
+
+export const hasSnapshot = () => snapshot !== null || pendingSnapshot !== null
+
 export function applyDrawData(drawElements) {
     clear();
-    
+    if (snapshot) {
+        context.drawImage(snapshot, 0, 0, drawingBoard.width, drawingBoard.height)
+    }
+
     drawElements.forEach(function (drawElement) {
         let drawData = drawElement.data;
         if (drawElement.type === "fill") {
@@ -0,0 +1,45 @@
+import * as elements from '../elements'
+
+import gameState from '../lib/game-state'
+import socket from '../lib/socket'
+
+// status is the latest playback status sent by the server, receivedAt the
+// time it arrived, which is needed to move the position along while playing.
+let status = null
+let receivedAt = 0
+
+const currentPosition = () => {
+    if (status.paused) {
+        return status.position
+    }
+    return Math.min(status.duration, status.position + (Date.now() - receivedAt) * status.speed)
+}
+
+// applyReplayStatus shows the playback status of the replay the player is
+// watching.
+export function applyReplayStatus(replay) {
+    status = replay
+    receivedAt = Date.now()
+    gameState.setState({ roundEndTime: replay.roundEndTime })
+    elements.applyReplayStatus(status, status.position)
+}
+
+// registerReplayControls lets viewers of a replay pause, seek and change the
+// speed of the playback. The playback is the same for all viewers.
+export function registerReplayControls() {
+    elements.replayPlay.addEventListener("click", () => {
+        socket.sendReplayControl({ action: status && !status.paused ? "pause" : "play" })
+    })
+    elements.replayPosition.addEventListener("change", () => {
+        socket.sendReplayControl({ action: "seek", position: parseInt(elements.replayPosition.value) })
+    })
+    elements.replaySpeed.addEventListener("change", () => {
+        socket.sendReplayControl({ action: "speed", speed: parseFloat(elements.replaySpeed.value) })
+    })
+
+    window.setInterval(() => {
+        if (status && !status.paused) {
+            elements.applyReplayStatus(status, currentPosition())
+        }
+    }, 500)
+}
@@ -1,6 +1,6 @@
 import * as actions from '../actions'
 import gameState from '../lib/game-state'
-import { smallCircle, mediumCircle, hugeCircle, drawTool, fillTool, selectCircle, selectTool, colorPicker, eraseTool, clearTool, scaleUpFactor, drawingBoard, undoTool } from '../elements';
+import { smallCircle, mediumCircle, hugeCircle, drawTool, fillTool, selectCircle, selectTool, colorPicker, eraseTool, clearTool, scaleUpFactor, drawingBoard, undoTool, redoTool } from '../elements';
 import { hexToRgbStr, contrastShade, hexToRgb } from '../lib/util';
 import { RUBBER, FILL_BUCKET, PEN, SMALL_CIRCLE, MEDIUM_CIRCLE, HUGE_CIRCLE } from '../constants';
 
@@ -27,6 +27,7 @@ export function registerTools() {
     eraseTool.onclick = e => actions.chooseToolAction(RUBBER)
     clearTool.onclick = e => actions.clearAction()
     undoTool.onclick = e => actions.undoAction()
+    redoTool.onclick = e => actions.redoAction()
 
     gameState.registerHandler((state, prevState) => {
         const { localTool } = state
@@ -22,11 +22,28 @@ export const scoreDialog = document.getElementById("score-dialog");
 export const scaleUpFactor = () => window.baseWidth / drawingBoard.clientWidth;
 export const scaleDownFactor = () => drawingBoard.clientWidth / window.baseWidth;
 export const scaleDown = (...vars) => vars.map(x => x * scaleDownFactor())
+// clampToBoard moves a point beyond the drawing board onto its edge.
+export const clampToBoard = (x, y) => [
+    Math.min(Math.max(x, 0), drawingBoard.clientWidth),
+    Math.min(Math.max(y, 0), drawingBoard.clientHeight),
+]
 
 export const messageContainer = document.getElementById("message-container");
 export const messageInput = document.getElementById("message-input");
 export const messageForm = document.getElementById('message-form')
 
+export const turnReveal = document.getElementById("turn-reveal");
+export const gameOver = document.getElementById("game-over");
+export const gameOverTimelapses = document.getElementById("game-over-timelapses");
+export const galleryLink = document.getElementById("gallery-link");
+export const recordingLink = document.getElementById("recording-link");
+
+export const replayControls = document.getElementById("replay-controls");
+export const replayPlay = document.getElementById("replay-play");
+export const replayPosition = document.getElementById("replay-position");
+export const replayTime = document.getElementById("replay-time");
+export const replaySpeed = document.getElementById("replay-speed");
+
 export const colorPicker = document.getElementById("color-picker");
 export const centerDialog = document.getElementById("center-dialog");
 export const chat = document.getElementById("chat");
@@ -37,6 +54,7 @@ export const clearTool = document.getElementById('clear-tool')
 export const drawTool = document.getElementById('draw-tool')
 export const fillTool = document.getElementById('fill-tool')
 export const undoTool = document.getElementById('undo-tool')
+export const redoTool = document.getElementById('redo-tool')
 
 export const smallCircle = document.getElementById('small-circle')
 export const mediumCircle = document.getElementById('medium-circle')
@@ -95,7 +113,7 @@ export function applyPlayers(players, ownID) {
     playerContainer.innerHTML = "";
     Object.keys(players).forEach(function (key) {
         let player = players[key]
-        if (!player.connected) {
+        if (!player.connected && !player.reconnecting) {
             return;
         }
 
@@ -113,6 +131,9 @@ export function applyPlayers(players, ownID) {
         //     newPlayerElement += ' playername-self';
         // }
         newPlayerElement += '">' + player.name + '</div>';
+        if (player.reconnecting) {
+            newPlayerElement += '<span class="reconnecting" title="Waiting for this player to reconnect">(reconnecting…)</span>';
+        }
         if (player.id !== ownID) {
             newPlayerElement +=
                 '<button class="kick-button" id="kick-button" type="button" title="Vote to kick this player" alt="Vote to kick this player" onclick="onClickKickButton(' + player.id + ')">👋</button>';
@@ -157,4 +178,55 @@ export function applyWordHints(wordHints) {
 
 export function applyMessage(styleClass, author, message) {
     console.log("message", author, message)
-}
\ No newline at end of file
+}
+const escapeHTML = text => text.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/"/g, "&quot;")
+
+export const timelapseURL = number => "/v1/lobby/" + window.lobbyId + "/timelapse.gif?turn=" + number
+
+// Links the gallery of all finished turns of the game on the game over
+// screen.
+export function applyGalleryLink() {
+    galleryLink.href = "/v1/lobby/" + window.lobbyId + "/gallery"
+}
+
+const timelapseLink = turn =>
+    '<a href="' + timelapseURL(turn.number) + '" download>Timelapse of turn ' + turn.number +
+    ': ' + escapeHTML(turn.word) + ' by ' + escapeHTML(turn.drawer) + '</a>'
+
+// Reveals the word of the turn that just ended and offers its timelapse for
+// download, the turn being one of the summaries sent by the server. The game
+// over screen of a previous game is hidden.
+export function applyTimelapseLink(turn) {
+    gameOver.style.display = "none"
+    turnReveal.innerHTML = 'The word was <b>' + escapeHTML(turn.word) + '</b>. ' + timelapseLink(turn)
+}
+
+// Shows the game over screen, offering the timelapses of all turns of the
+// game.
+export function applyGameOver(turns) {
+    turnReveal.innerHTML = ""
+    gameOverTimelapses.innerHTML = turns.map(turn => '<li>' + timelapseLink(turn) + '</li>').join("")
+    gameOver.style.display = "block"
+}
+
+// Offers the recording of the lobby for download on the game over screen, so
+// it can be replayed.
+export function applyRecordingLink() {
+    recordingLink.href = "/v1/lobby/" + window.lobbyId + "/recording.scribble"
+}
+
+const formatReplayTime = milliseconds => {
+    let seconds = Math.floor(milliseconds / 1000)
+    return Math.floor(seconds / 60) + ":" + String(seconds % 60).padStart(2, "0")
+}
+
+// Shows the playback of a replay, position and duration being in
+// milliseconds.
+export function applyReplayStatus(status, position) {
+    replayControls.style.display = "flex"
+    replayPlay.textContent = status.paused ? "Play" : "Pause"
+    replaySpeed.value = String(status.speed)
+    replayPosition.max = status.duration
+    replayPosition.value = position
+    replayTime.innerText = formatReplayTime(position) + " / " + formatReplayTime(status.duration)
+}
@@ -7,6 +7,7 @@ import socket from './lib/socket';
 import { registerMessages } from './components/messages'
 import { registerCircles, registerTools } from './components/tools';
 import { registerOverlay } from './components/overlay';
+import { registerReplayControls } from './components/replay';
 import { registerSocketHandlers } from './socket-handlers'
 
 window.setInterval(function () {
@@ -24,6 +25,7 @@ registerOverlay()
 registerCircles()
 registerTools()
 registerMessages()
+registerReplayControls()
 
 elements.startDialog.style.display = "none"
 elements.startDialogWaiting.style.display = "none"
@@ -99,17 +99,29 @@ class GameState {
         })
 
     }
-    undoDrawing = () => {
+    // undoDrawing removes the latest gesture, which is either a fill or all
+    // trailing lines sharing a gestureId, just like the server does. If a
+    // count is given, that many operations are removed instead.
+    undoDrawing = (count) => {
         let currentDrawing = [...this.state.currentDrawing]
 
-        currentDrawing.splice(-1, 1)
-        
-        let final = currentDrawing[currentDrawing.length - 1]
-
-        if (final && final.type == "line") {
-            let gestureId = final.data.gestureId
-            currentDrawing = currentDrawing.filter(v => v.type != "line" || v.data.gestureId != gestureId)
+        if (count === undefined) {
+            count = 0
+            let final = currentDrawing[currentDrawing.length - 1]
+            if (final && final.type == "line") {
+                let gestureId = final.data.gestureId
+                for (let i = currentDrawing.length - 1; i >= 0; i--) {
+                    let op = currentDrawing[i]
+                    if (op.type != "line" || op.data.gestureId != gestureId) {
+                        break
+                    }
+                    count++
+                }
+            } else if (final) {
+                count = 1
+            }
         }
+        currentDrawing.splice(currentDrawing.length - count, count)
 
         this.setState({ currentDrawing })
     }
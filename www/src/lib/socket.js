@@ -14,15 +14,36 @@
 // }
 //         // document.cookie = `X-UserSession=${clientID()};`
 
+// protocolVersion is the version of the websocket protocol this client
+// speaks, see PROTOCOL.md.
+const protocolVersion = 2
+
 class Socket {
     handlers = {}
+    // lastSeq is the sequence number of the last event received. It is sent
+    // when reconnecting, so that the server only sends the missed events.
+    // Sequence numbers are only valid within the epoch of the ready event.
+    lastSeq = 0
+    epoch = ""
     constructor() {
-        let wsURL = (location.protocol === 'https:' ? "wss://" : "ws://") + location.hostname + ":" + location.port + "/v1/ws?lobby_id=" + window.lobbyId
+        this.wsURL = (location.protocol === 'https:' ? "wss://" : "ws://") + location.hostname + ":" + location.port + "/v1/ws?v=" + protocolVersion + "&lobby_id=" + window.lobbyId
 
       
-        this.socket = new ReconnectingWebSocket(wsURL, null, { debug: false, reconnectInterval: 3000, automaticOpen: false });
+        this.socket = new ReconnectingWebSocket(this.wsURL, null, { debug: false, reconnectInterval: 3000, automaticOpen: false });
         this.socket.onmessage = e => {
             let parsed = JSON.parse(e.data);
+            if (parsed.type === "ready") {
+                this.epoch = parsed.data.epoch
+            }
+            if (parsed.seq) {
+                // A ready event is a full snapshot, everything else that
+                // isn't newer than what we've got is a duplicate.
+                if (parsed.type !== "ready" && parsed.seq <= this.lastSeq) {
+                    return
+                }
+                this.lastSeq = parsed.seq
+                this.socket.url = this.wsURL + "&epoch=" + encodeURIComponent(this.epoch) + "&seq=" + this.lastSeq
+            }
             if (typeof this.handlers[parsed.type] == 'undefined') {
                 console.error("socket received unknown message type " + parsed.type)
                 return
@@ -36,6 +57,11 @@ class Socket {
         this.socket.open()
     }
 
+    // close closes the connection for good, without reconnecting.
+    close() {
+        this.socket.close()
+    }
+
     addHandler(type, fn) {
         this.handlers[type] = fn
     }
@@ -104,6 +130,19 @@ class Socket {
             type: "undo",
         }));
     }
+    sendRedo() {
+        this.socket.send(JSON.stringify({
+            type: "redo",
+        }));
+    }
+    // sendReplayControl controls the playback of a replay lobby, see
+    // ReplayControl in PROTOCOL.md.
+    sendReplayControl(control) {
+        this.socket.send(JSON.stringify({
+            type: "replay-control",
+            data: control,
+        }));
+    }
 }
 
 export default new Socket()
\ No newline at end of file
@@ -5,6 +5,7 @@ import * as elements from './elements'
 import gameState from './lib/game-state'
 import socket from './lib/socket';
 import { resetTools } from './components/tools';
+import { applyReplayStatus } from './components/replay';
 import { PEN, SMALL_CIRCLE } from './constants';
 
 
@@ -19,11 +20,19 @@ export function registerSocketHandlers() {
             ownID: ready.playerId,
             maxRounds: ready.maxRounds,
             roundEndTime: ready.roundEndTime,
+            currentDrawing: ready.currentDrawing || [],
         })
 
         elements.applyRounds(ready.round, ready.maxRounds);
 
-        if (ready.round === 0) {
+        if (ready.replay) {
+            // The snapshot is sent again whenever the playback jumps, so
+            // it replaces whatever has been shown so far.
+            elements.hideDialog()
+            elements.wordContainer.innerHTML = ""
+            canvas.clear()
+            applyReplayStatus(ready.replay)
+        } else if (ready.round === 0) {
             if (ready.ownerId === ready.playerId) {
                 elements.showDialog(elements.startDialog)                
             } else {
@@ -34,6 +43,12 @@ export function registerSocketHandlers() {
         if (ready.players) {
             elements.applyPlayers(ready.players, gameState.state.ownID)
         }
+        // Large drawings begin with an image, the operations go on top.
+        if (ready.snapshot) {
+            canvas.applySnapshot(ready.snapshot)
+        } else {
+            canvas.dropSnapshot()
+        }
         if (ready.currentDrawing && ready.currentDrawing.length) {
             canvas.applyDrawData(ready.currentDrawing)
         }
@@ -57,6 +72,18 @@ export function registerSocketHandlers() {
     socket.addHandler("system-message", (pkt) => {
         elements.applyMessage("system-message", "System", pkt.data);
     })
+    socket.addHandler("hello", (pkt) => {
+        console.log("server speaks protocol version " + pkt.data.version);
+    })
+    socket.addHandler("error", (pkt) => {
+        console.error("server rejected " + pkt.data.packetType + ": " + pkt.data.code);
+        elements.applyMessage("system-message", "System", pkt.data.message);
+    })
+    socket.addHandler("session-replaced", (pkt) => {
+        // Reconnecting would take the session back from the other tab.
+        socket.close()
+        elements.applyMessage("system-message", "System", pkt.data);
+    })
     socket.addHandler("non-guessing-player-message", (pkt) => {
         elements.applyMessage("non-guessing-player-message", pkt.data.author, pkt.data.content);
     })
@@ -77,19 +104,46 @@ export function registerSocketHandlers() {
 
         canvas.fill(...elements.scaleDown(pkt.data.x, pkt.data.y), pkt.data.color);
     })
+    socket.addHandler("draw-batch", (pkt) => {
+        // Line and fill packets collected by the server, in drawing order.
+        pkt.data.forEach(op => socket.handlers[op.type](op))
+    })
+
+    socket.addHandler("turn-over", (pkt) => {
+        elements.applyTimelapseLink(pkt.data)
+    })
+    socket.addHandler("game-over", (pkt) => {
+        elements.applyGameOver(pkt.data)
+        elements.applyGalleryLink()
+        elements.applyRecordingLink()
+    })
+    socket.addHandler("replay-status", (pkt) => {
+        applyReplayStatus(pkt.data)
+    })
 
     socket.addHandler("clear-drawing-board", (pkt) => {
         gameState.setState({ currentDrawing: [] })
 
+        canvas.dropSnapshot()
         canvas.clear()
     })
+    socket.addHandler("redo", (pkt) => {
+        // Restored by the server for everyone, including the drawer.
+        pkt.data.forEach(op => socket.handlers[op.type](op))
+    })
     socket.addHandler("undo", (pkt) => {
+        if (gameState.state.currentDrawing.length === 0 && canvas.hasSnapshot()) {
+            // The gesture is part of the snapshot, which only the server
+            // can redraw.
+            canvas.applySnapshot("/v1/lobby/" + window.lobbyId + "/drawing.png")
+            return
+        }
+        // The server might have stored the gesture with fewer operations
+        // than were received, so it is looked up rather than counted.
         gameState.undoDrawing()
         
         canvas.clear();
         canvas.applyDrawData(gameState.state.currentDrawing)
-
-        canvas.fill(...elements.scaleDown(pkt.data.x, pkt.data.y), pkt.data.color);
     })
 
 
@@ -109,6 +163,7 @@ export function registerSocketHandlers() {
 
         audio.endTurn()
 
+        canvas.dropSnapshot()
         canvas.clear();
         gameState.clearDrawing()
 